@@ -0,0 +1,89 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// CAAAnswers records which of the CAA lookups made with a context returned
+// by WithCAAAnswers the resolver actually answered, with NOERROR or
+// NXDOMAIN. LookupCAA reports a server failure as no records, so this is
+// the only way to tell the two apart.
+type CAAAnswers struct {
+	sync.Mutex
+	answered    map[string]bool
+	nonexistent map[string]bool
+}
+
+type caaAnswersKey struct{}
+
+// WithCAAAnswers returns a context that records whether each CAA lookup
+// made with it was answered into the returned CAAAnswers.
+func WithCAAAnswers(ctx context.Context) (context.Context, *CAAAnswers) {
+	answers := &CAAAnswers{
+		answered:    make(map[string]bool),
+		nonexistent: make(map[string]bool),
+	}
+	return context.WithValue(ctx, caaAnswersKey{}, answers), answers
+}
+
+// CAAAnswersFrom returns the CAAAnswers attached to ctx by WithCAAAnswers,
+// or nil if there are none.
+func CAAAnswersFrom(ctx context.Context) *CAAAnswers {
+	answers, _ := ctx.Value(caaAnswersKey{}).(*CAAAnswers)
+	return answers
+}
+
+func (a *CAAAnswers) record(hostname string, answered bool) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.answered[strings.ToLower(strings.TrimRight(hostname, "."))] = answered
+}
+
+// recordNameError notes that the resolver answered NXDOMAIN for hostname.
+func (a *CAAAnswers) recordNameError(hostname string) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.nonexistent[strings.ToLower(strings.TrimRight(hostname, "."))] = true
+}
+
+// Answered returns true if a CAA lookup for hostname was answered. It is
+// false for names that weren't looked up, or whose lookup failed.
+func (a *CAAAnswers) Answered(hostname string) bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.answered[strings.ToLower(strings.TrimRight(hostname, "."))]
+}
+
+// NameError returns true if a CAA lookup for hostname was answered with
+// NXDOMAIN, meaning that neither hostname nor any name below it exists (RFC
+// 8020).
+func (a *CAAAnswers) NameError(hostname string) bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.nonexistent[strings.ToLower(strings.TrimRight(hostname, "."))]
+}
+
+// Lookups returns whether each name looked up was answered, keyed by name.
+func (a *CAAAnswers) Lookups() map[string]bool {
+	a.Lock()
+	defer a.Unlock()
+	lookups := make(map[string]bool, len(a.answered))
+	for name, answered := range a.answered {
+		lookups[name] = answered
+	}
+	return lookups
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// ErrUnrelatedAuthority is returned when CheckAuthority is set for responses
+// whose authority section is for a zone that doesn't contain the name
+// queried.
+var ErrUnrelatedAuthority = errors.New("DNS response has authority for an unrelated zone")
+
+// CheckAuthority makes the resolver reject responses whose authority
+// section names a zone that contains neither the name queried nor any name
+// the answer aliased it to. Such a response suggests the query went to a
+// resolver that isn't configured for the zone, e.g. when RouteZone is
+// missing an internal zone in a split-horizon setup. Without it, these
+// responses are only counted.
+func (dnsResolver *DNSResolverImpl) CheckAuthority() {
+	dnsResolver.checkAuthority = true
+}
+
+// unrelatedAuthority returns true if r, the response to m, has SOA or NS
+// records in its authority section for a zone that contains none of the
+// names the query was for.
+func unrelatedAuthority(m, r *dns.Msg) bool {
+	if len(m.Question) == 0 {
+		return false
+	}
+	names := []string{m.Question[0].Name}
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			names = append(names, rr.Target)
+		case *dns.DNAME:
+			names = append(names, rr.Target)
+		}
+	}
+	for _, rr := range r.Ns {
+		switch rr.(type) {
+		case *dns.SOA, *dns.NS:
+		default:
+			continue
+		}
+		related := false
+		for _, name := range names {
+			if dns.IsSubDomain(strings.ToLower(rr.Header().Name), strings.ToLower(name)) {
+				related = true
+				break
+			}
+		}
+		if !related {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// authorityExchanger answers every query with no records, and an SOA record
+// for zone in the authority section.
+type authorityExchanger struct {
+	zone string
+}
+
+func (ae authorityExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Ns = append(r.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: ae.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+		Ns:     "ns." + ae.zone,
+		Mbox:   "hostmaster." + ae.zone,
+		Minttl: 60,
+	})
+	return r, time.Millisecond, nil
+}
+
+func TestCheckAuthority(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+
+	// Authority for the name's own zone, or an ancestor's, is expected.
+	dr.CheckAuthority()
+	for _, zone := range []string{"corp.example.com.", "Example.COM.", "."} {
+		dr.dnsClient = authorityExchanger{zone}
+		_, _, err := dr.LookupCAA(context.Background(), "www.corp.example.com")
+		test.AssertNotError(t, err, "Lookup with authority for "+zone+" failed")
+	}
+
+	// A resolver answering with authority for an unrelated zone, e.g. a
+	// public one that has never heard of an internal zone, is suspect.
+	dr.dnsClient = authorityExchanger{"example.net."}
+	_, _, err := dr.LookupCAA(context.Background(), "www.corp.example.com")
+	test.AssertError(t, err, "Lookup with unrelated authority should fail")
+	test.AssertEquals(t, err.(*dnsError).underlying, ErrUnrelatedAuthority)
+
+	// Without the check, it is let through.
+	dr.checkAuthority = false
+	_, _, err = dr.LookupCAA(context.Background(), "www.corp.example.com")
+	test.AssertNotError(t, err, "Lookup without the authority check failed")
+}
+
+func TestUnrelatedAuthority(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeCAA)
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNS}, Ns: "ns.example.org."}}
+	test.Assert(t, unrelatedAuthority(m, r), "NS records for another zone should be unrelated")
+
+	// Authority for the zone an alias points into is related.
+	r.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME}, Target: "cdn.example.org."}}
+	test.Assert(t, !unrelatedAuthority(m, r), "Authority for the CNAME target's zone should be related")
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// edns0ExtendedError is the EDNS0 option code for Extended DNS Errors (RFC
+// 8914).
+const edns0ExtendedError = 15
+
+// The Extended DNS Error info codes that report a DNSSEC validation failure,
+// from DNSSEC Bogus through NSEC Missing (RFC 8914 section 4).
+const (
+	edeDNSSECBogus = 6
+	edeNSECMissing = 12
+)
+
+// ErrDNSSECBogus is returned for CAA lookups that the resolver failed
+// because the answer didn't pass DNSSEC validation, unless IgnoreBogusCAA is
+// set.
+var ErrDNSSECBogus = errors.New("DNSSEC validation failed")
+
+// bogus returns true if r is a server failure that the resolver attributes
+// to DNSSEC validation with an Extended DNS Error. Resolvers that don't send
+// them can't be told apart from any other server failure.
+func bogus(r *dns.Msg) bool {
+	if r.Rcode != dns.RcodeServerFailure {
+		return false
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != edns0ExtendedError || len(local.Data) < 2 {
+			continue
+		}
+		code := binary.BigEndian.Uint16(local.Data)
+		if code >= edeDNSSECBogus && code <= edeNSECMissing {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoreBogusCAA makes CAA lookups that failed DNSSEC validation return no
+// records, like any other server failure, instead of ErrDNSSECBogus. It is
+// for operators who don't rely on DNSSEC, since a bogus answer may hide
+// records that forbid issuance.
+func (dnsResolver *DNSResolverImpl) IgnoreBogusCAA() {
+	dnsResolver.ignoreBogusCAA = true
+}
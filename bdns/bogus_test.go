@@ -0,0 +1,65 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// servfailExchanger answers every query with SERVFAIL, carrying an Extended
+// DNS Error with info code ede unless it is zero.
+type servfailExchanger struct {
+	ede uint16
+}
+
+func (se servfailExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetRcode(m, dns.RcodeServerFailure)
+	if se.ede != 0 {
+		r.SetEdns0(4096, true)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+			Code: edns0ExtendedError,
+			Data: []byte{byte(se.ede >> 8), byte(se.ede)},
+		})
+	}
+	return r, time.Millisecond, nil
+}
+
+func TestBogusCAA(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+
+	// A server failure the resolver doesn't blame on DNSSEC still looks
+	// like an absence of records, including one with an unrelated
+	// Extended DNS Error (No Reachable Authority).
+	for _, ede := range []uint16{0, 22} {
+		dr.dnsClient = servfailExchanger{ede}
+		caas, _, err := dr.LookupCAA(context.Background(), "example.com")
+		test.AssertNotError(t, err, "Lookup with a transient server failure failed")
+		test.AssertEquals(t, len(caas), 0)
+	}
+
+	// DNSSEC Bogus and Signature Expired are validation failures, which
+	// fail the lookup by default.
+	for _, ede := range []uint16{6, 7} {
+		dr.dnsClient = servfailExchanger{ede}
+		_, _, err := dr.LookupCAA(context.Background(), "example.com")
+		test.AssertError(t, err, "Bogus lookup should fail")
+		test.AssertEquals(t, err.(*dnsError).underlying, ErrDNSSECBogus)
+		test.AssertEquals(t, err.Error(), "DNS problem: DNSSEC validation failure looking up CAA for example.com")
+	}
+
+	dr.IgnoreBogusCAA()
+	caas, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Bogus lookup should be ignored")
+	test.AssertEquals(t, len(caas), 0)
+}
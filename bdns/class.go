@@ -0,0 +1,13 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+// SetCAAClass makes CAA queries ask for records of the given class, e.g.
+// dns.ClassCHAOS, instead of IN. CAA is only ever published in the IN class;
+// this is for test zones in lab setups that use another.
+func (dnsResolver *DNSResolverImpl) SetCAAClass(class uint16) {
+	dnsResolver.caaClass = class
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// classExchanger records the class of each question it is sent.
+type classExchanger struct {
+	classes []uint16
+}
+
+func (ce *classExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	ce.classes = append(ce.classes, m.Question[0].Qclass)
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, time.Millisecond, nil
+}
+
+func TestSetCAAClass(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	ce := &classExchanger{}
+	dr.dnsClient = ce
+
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "LookupCAA failed")
+	dr.SetCAAClass(dns.ClassCHAOS)
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "LookupCAA failed")
+	// Only CAA queries use the class.
+	_, _, err = dr.LookupTXT(context.Background(), "example.com")
+	test.AssertNotError(t, err, "LookupTXT failed")
+
+	test.AssertDeepEquals(t, ce.classes, []uint16{dns.ClassINET, dns.ClassCHAOS, dns.ClassINET})
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"errors"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// DefaultMaxCNAMEChain is the longest CNAME chain a CAA lookup follows
+// unless LimitCNAMEChain says otherwise.
+const DefaultMaxCNAMEChain = 8
+
+// ErrCNAMEChainTooLong is returned for CAA lookups whose answer follows
+// more CNAMEs than the resolver's limit.
+var ErrCNAMEChainTooLong = errors.New("CNAME chain too long")
+
+// LimitCNAMEChain sets the longest CNAME chain a CAA lookup may follow.
+// Every name a lookup is aliased through costs the recursive resolver
+// queries, so long chains, even without loops, can be used to amplify the
+// work a single check causes. Lookups over the limit fail, and are counted
+// as CNAMEChainTooLong.
+func (dnsResolver *DNSResolverImpl) LimitCNAMEChain(max int) {
+	dnsResolver.maxCNAMEChain = max
+}
+
+// cnameChain returns the number of CNAME records among answers, which is
+// the length of the chain the resolver followed to answer the query.
+func cnameChain(answers []dns.RR) int {
+	var n int
+	for _, answer := range answers {
+		if _, ok := answer.(*dns.CNAME); ok {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/metrics"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// chainExchanger answers CAA queries through a chain of CNAMEs, links long,
+// ending in a single issue record.
+type chainExchanger struct {
+	links int
+}
+
+func (ce chainExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	name := m.Question[0].Name
+	for i := 0; i < ce.links; i++ {
+		target := fmt.Sprintf("link%d.example.net.", i)
+		r.Answer = append(r.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+			Target: target,
+		})
+		name = target
+	}
+	r.Answer = append(r.Answer, &dns.CAA{
+		Hdr:   dns.RR_Header{Name: name, Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+		Tag:   "issue",
+		Value: "letsencrypt.org",
+	})
+	return r, time.Millisecond, nil
+}
+
+func TestLimitCNAMEChain(t *testing.T) {
+	stats := mocks.NewStatter()
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, metrics.NewStatsdScope(&stats, "fakesvc"), clock.NewFake(), 1)
+	dr.LimitCNAMEChain(3)
+
+	dr.dnsClient = chainExchanger{links: 3}
+	caas, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Chain at the limit should be followed")
+	test.AssertEquals(t, len(caas), 1)
+	test.AssertEquals(t, stats.Counters["fakesvc.CAA.CNAMEChainTooLong"], int64(0))
+
+	dr.dnsClient = chainExchanger{links: 4}
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Chain over the limit should fail")
+	test.AssertEquals(t, err.(*dnsError).underlying, ErrCNAMEChainTooLong)
+	test.AssertEquals(t, err.Error(), "DNS problem: CNAME chain too long looking up CAA for example.com")
+	test.AssertEquals(t, stats.Counters["fakesvc.CAA.CNAMEChainTooLong"], int64(1))
+
+	// Unless changed, the default applies.
+	dr = NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	dr.dnsClient = chainExchanger{links: DefaultMaxCNAMEChain}
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Chain at the default limit should be followed")
+	dr.dnsClient = chainExchanger{links: DefaultMaxCNAMEChain + 1}
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Chain over the default limit should fail")
+}
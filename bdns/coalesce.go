@@ -0,0 +1,95 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/metrics"
+)
+
+// flightKey identifies identical queries.
+type flightKey struct {
+	name  string
+	qtype uint16
+}
+
+// flight is a query in progress that other callers can wait on.
+type flight struct {
+	done    chan struct{}
+	waiters int
+	m       *dns.Msg
+	err     error
+}
+
+// flightGroup tracks the queries in flight so that identical ones are only
+// sent once.
+type flightGroup struct {
+	sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// join returns the flight for key, and whether the caller started it and
+// so must send the query and call land.
+func (g *flightGroup) join(key flightKey) (*flight, bool) {
+	g.Lock()
+	defer g.Unlock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// land records the result of the flight for key and releases its waiters.
+func (g *flightGroup) land(key flightKey, f *flight) {
+	g.Lock()
+	delete(g.flights, key)
+	g.Unlock()
+	close(f.done)
+}
+
+// CoalesceQueries makes concurrent identical queries share a single
+// exchange with the server, so that a burst of checks for the same name
+// doesn't multiply the load on the resolver.
+func (dnsResolver *DNSResolverImpl) CoalesceQueries() {
+	dnsResolver.flights = &flightGroup{flights: make(map[flightKey]*flight)}
+}
+
+// exchangeShared is exchangeOne for resolvers that coalesce queries. Every
+// caller gets its own copy of the response, as callers may modify it.
+func (dnsResolver *DNSResolverImpl) exchangeShared(ctx context.Context, hostname string, qtype uint16, msgStats metrics.Scope) (*dns.Msg, error) {
+	key := flightKey{strings.ToLower(dns.Fqdn(hostname)), qtype}
+	f, leader := dnsResolver.flights.join(key)
+	if leader {
+		f.m, f.err = dnsResolver.exchange(ctx, hostname, qtype, msgStats)
+		dnsResolver.flights.land(key, f)
+		if f.m == nil {
+			return nil, f.err
+		}
+		return f.m.Copy(), f.err
+	}
+	msgStats.Inc("Coalesced", 1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done:
+	}
+	// The query is tied to the context of the caller that sent it. If that
+	// caller gave up, we may still have time to ask ourselves.
+	if f.err == context.Canceled || f.err == context.DeadlineExceeded {
+		return dnsResolver.exchange(ctx, hostname, qtype, msgStats)
+	}
+	if f.m == nil {
+		return nil, f.err
+	}
+	return f.m.Copy(), f.err
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// gatedExchanger counts queries and holds each one until release is
+// closed, answering with a single CAA record.
+type gatedExchanger struct {
+	sync.Mutex
+	queries int
+	release chan struct{}
+}
+
+func (ge *gatedExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	ge.Lock()
+	ge.queries++
+	ge.Unlock()
+	<-ge.release
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.CAA{
+		Hdr:   dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+		Tag:   "issue",
+		Value: "letsencrypt.org",
+	})
+	return r, time.Millisecond, nil
+}
+
+func (ge *gatedExchanger) count() int {
+	ge.Lock()
+	defer ge.Unlock()
+	return ge.queries
+}
+
+// waiting returns how many callers are waiting on another's query for key.
+func (g *flightGroup) waiting(key flightKey) int {
+	g.Lock()
+	defer g.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f.waiters
+	}
+	return 0
+}
+
+func TestCoalesceQueries(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	exchanger := &gatedExchanger{release: make(chan struct{})}
+	dr.dnsClient = exchanger
+	dr.CoalesceQueries()
+
+	const lookups = 10
+	var wg sync.WaitGroup
+	results := make([][]*dns.CAA, lookups)
+	errs := make([]error, lookups)
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, errs[i] = dr.LookupCAA(context.Background(), "example.com")
+		}(i)
+	}
+	key := flightKey{"example.com.", dns.TypeCAA}
+	for dr.flights.waiting(key) < lookups-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(exchanger.release)
+	wg.Wait()
+
+	test.AssertEquals(t, exchanger.count(), 1)
+	for i := range results {
+		test.AssertNotError(t, errs[i], "Coalesced lookup failed")
+		test.AssertEquals(t, len(results[i]), 1)
+	}
+	// Every caller gets its own copy of the records.
+	test.Assert(t, results[0][0] != results[1][0], "Callers shouldn't share records")
+
+	// Once the query has finished, a new one is sent.
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Lookup failed")
+	test.AssertEquals(t, exchanger.count(), 2)
+}
+
+func TestCoalesceQueriesLeaderCanceled(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	exchanger := &gatedExchanger{release: make(chan struct{})}
+	dr.dnsClient = exchanger
+	dr.CoalesceQueries()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, _, err := dr.LookupCAA(ctx, "example.com")
+		leaderDone <- err
+	}()
+	for exchanger.count() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	followerDone := make(chan error)
+	go func() {
+		_, _, err := dr.LookupCAA(context.Background(), "example.com")
+		followerDone <- err
+	}()
+	key := flightKey{"example.com.", dns.TypeCAA}
+	for dr.flights.waiting(key) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The follower's context is still live, so it sends its own query when
+	// the leader gives up.
+	cancel()
+	test.AssertError(t, <-leaderDone, "Canceled lookup should fail")
+	close(exchanger.release)
+	test.AssertNotError(t, <-followerDone, "Follower lookup should succeed")
+	test.AssertEquals(t, exchanger.count(), 2)
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// edns0Cookie is the EDNS0 option code for DNS cookies (RFC 7873).
+const edns0Cookie = 10
+
+const (
+	clientCookieLen       = 8
+	minServerCookieLength = 8
+	maxServerCookieLength = 32
+)
+
+// ErrCookieMismatch is returned when a response carries a DNS cookie that
+// doesn't echo the client cookie we sent, which indicates the response was
+// spoofed.
+var ErrCookieMismatch = errors.New("DNS response does not echo our client cookie")
+
+// cookieState is what we know about a single server's cookie support.
+type cookieState struct {
+	client      []byte
+	server      []byte
+	unsupported bool
+}
+
+// cookieExchanger adds DNS cookies (RFC 7873) to queries sent by the
+// wrapped exchanger. A client cookie is generated for each server and the
+// server cookie it returns is sent back on later queries. Responses that
+// carry a cookie must echo our client cookie. Servers that answer without a
+// cookie are assumed not to support them and are no longer sent one.
+type cookieExchanger struct {
+	exchanger
+	sync.Mutex
+	servers map[string]*cookieState
+}
+
+func newCookieExchanger(inner exchanger) *cookieExchanger {
+	return &cookieExchanger{
+		exchanger: inner,
+		servers:   make(map[string]*cookieState),
+	}
+}
+
+// state returns a copy of the cookie state for server, creating a client
+// cookie for it on first use.
+func (ce *cookieExchanger) state(server string) (cookieState, error) {
+	ce.Lock()
+	defer ce.Unlock()
+	if s, ok := ce.servers[server]; ok {
+		return *s, nil
+	}
+	client := make([]byte, clientCookieLen)
+	if _, err := rand.Read(client); err != nil {
+		return cookieState{}, err
+	}
+	s := &cookieState{client: client}
+	ce.servers[server] = s
+	return *s, nil
+}
+
+func (ce *cookieExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	state, err := ce.state(a)
+	if err != nil {
+		return nil, 0, err
+	}
+	if state.unsupported || m.IsEdns0() == nil {
+		return ce.exchanger.Exchange(m, a)
+	}
+
+	// Work on a copy so that the caller's message can be resent as is.
+	q := m.Copy()
+	opt := q.IsEdns0()
+	cookie := &dns.EDNS0_LOCAL{
+		Code: edns0Cookie,
+		Data: append(append([]byte{}, state.client...), state.server...),
+	}
+	opt.Option = append(append([]dns.EDNS0{}, opt.Option...), cookie)
+
+	r, rtt, err := ce.exchanger.Exchange(q, a)
+	if err != nil {
+		return r, rtt, err
+	}
+	if r.Rcode == dns.RcodeFormatError {
+		// Some servers reject options they don't understand rather than
+		// ignoring them. Stop sending cookies and ask again without one.
+		ce.update(a, func(s *cookieState) { s.unsupported = true })
+		return ce.exchanger.Exchange(m, a)
+	}
+
+	returned := findCookie(r)
+	if returned == nil {
+		ce.update(a, func(s *cookieState) { s.unsupported = true })
+		return r, rtt, nil
+	}
+	if len(returned) < clientCookieLen || !bytes.Equal(returned[:clientCookieLen], state.client) {
+		return nil, rtt, ErrCookieMismatch
+	}
+	server := returned[clientCookieLen:]
+	if len(server) >= minServerCookieLength && len(server) <= maxServerCookieLength {
+		ce.update(a, func(s *cookieState) { s.server = append([]byte{}, server...) })
+	}
+	return r, rtt, nil
+}
+
+func (ce *cookieExchanger) update(server string, f func(*cookieState)) {
+	ce.Lock()
+	defer ce.Unlock()
+	if s, ok := ce.servers[server]; ok {
+		f(s)
+	}
+}
+
+// findCookie returns the cookie option data in r, or nil if there is none.
+func findCookie(r *dns.Msg) []byte {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == edns0Cookie {
+			return local.Data
+		}
+	}
+	return nil
+}
+
+// UseCookies makes the resolver send DNS cookies with its queries and reject
+// responses that fail to echo them. It should be called after UseTLS, if
+// that is used.
+func (dnsResolver *DNSResolverImpl) UseCookies() {
+	dnsResolver.dnsClient = newCookieExchanger(dnsResolver.dnsClient)
+}
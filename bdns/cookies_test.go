@@ -0,0 +1,99 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/test"
+)
+
+// cookieServer answers every query and, if cookies are enabled, echoes the
+// client cookie along with its own server cookie. It records the cookie
+// sent with each query.
+type cookieServer struct {
+	sync.Mutex
+	enabled     bool
+	serverValue []byte
+	// clientOverride, if set, replaces the client cookie in responses.
+	clientOverride []byte
+	received       [][]byte
+}
+
+func (cs *cookieServer) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	cs.Lock()
+	defer cs.Unlock()
+	sent := findCookie(m)
+	cs.received = append(cs.received, sent)
+	r := new(dns.Msg)
+	r.SetReply(m)
+	if cs.enabled && len(sent) >= clientCookieLen {
+		client := sent[:clientCookieLen]
+		if cs.clientOverride != nil {
+			client = cs.clientOverride
+		}
+		r.SetEdns0(4096, true)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+			Code: edns0Cookie,
+			Data: append(append([]byte{}, client...), cs.serverValue...),
+		})
+	}
+	return r, time.Millisecond, nil
+}
+
+func TestDNSCookies(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"cookies:53"}, testStats, clock.NewFake(), 1)
+	server := &cookieServer{enabled: true, serverValue: []byte("servercookie")}
+	dr.dnsClient = server
+	dr.UseCookies()
+
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "First lookup failed")
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Second lookup failed")
+
+	test.AssertEquals(t, len(server.received), 2)
+	first, second := server.received[0], server.received[1]
+	// The first query carries only a client cookie.
+	test.AssertEquals(t, len(first), clientCookieLen)
+	// The second carries the same client cookie and the cached server cookie.
+	test.Assert(t, bytes.Equal(second[:clientCookieLen], first), "Client cookie changed between queries")
+	test.AssertEquals(t, string(second[clientCookieLen:]), "servercookie")
+}
+
+func TestDNSCookieMismatch(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"cookies:53"}, testStats, clock.NewFake(), 1)
+	server := &cookieServer{enabled: true, serverValue: []byte("servercookie"), clientOverride: []byte("spoofed!")}
+	dr.dnsClient = server
+	dr.UseCookies()
+
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Lookup with a spoofed cookie should fail")
+}
+
+func TestDNSCookiesUnsupported(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"nocookies:53"}, testStats, clock.NewFake(), 1)
+	server := &cookieServer{}
+	dr.dnsClient = server
+	dr.UseCookies()
+
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "First lookup failed")
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Second lookup failed")
+
+	test.AssertEquals(t, len(server.received), 2)
+	test.Assert(t, server.received[0] != nil, "First query should have carried a cookie")
+	test.Assert(t, server.received[1] == nil, "Cookies should not be sent to a server that doesn't support them")
+}
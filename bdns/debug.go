@@ -0,0 +1,56 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// LookupCAARaw sends a CAA query for hostname and returns the response in
+// wire format, exactly as the resolver answered it, for offline analysis.
+// The CAA override and response checks that LookupCAA applies are skipped.
+func (dnsResolver *DNSResolverImpl) LookupCAARaw(ctx context.Context, hostname string) ([]byte, error) {
+	r, err := dnsResolver.exchangeOne(ctx, hostname, dns.TypeCAA, dnsResolver.caaStats)
+	if err != nil {
+		return nil, &dnsError{dns.TypeCAA, hostname, err, -1}
+	}
+	return r.Pack()
+}
+
+// DebugCAAHandler returns a handler that answers GET requests of the form
+// "?name=example.com" with the raw response to a CAA query for the name,
+// as returned by LookupCAARaw. Since this exposes DNS internals, requests
+// must carry "Authorization: Bearer <token>"; an empty token rejects every
+// request.
+func DebugCAAHandler(resolver *DNSResolverImpl, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if r.Method != "GET" || name == "" {
+			http.Error(w, "a name is required", http.StatusBadRequest)
+			return
+		}
+		// The query may take every try, each up to the read timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), resolver.readTimeout*time.Duration(resolver.maxTries))
+		defer cancel()
+		raw, err := resolver.LookupCAARaw(ctx, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(raw)
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/test"
+)
+
+func TestDebugCAAHandler(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	srv := httptest.NewServer(DebugCAAHandler(dr, "secret"))
+	defer srv.Close()
+
+	get := func(query, auth string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+query, nil)
+		test.AssertNotError(t, err, "Failed to create request")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		test.AssertNotError(t, err, "Request failed")
+		return resp
+	}
+
+	resp := get("?name=bracewel.net", "Bearer secret")
+	defer resp.Body.Close()
+	test.AssertEquals(t, resp.StatusCode, http.StatusOK)
+	test.AssertEquals(t, resp.Header.Get("Content-Type"), dnsMessageType)
+	body, err := ioutil.ReadAll(resp.Body)
+	test.AssertNotError(t, err, "Failed to read response")
+	m := new(dns.Msg)
+	test.AssertNotError(t, m.Unpack(body), "Raw response should parse")
+	test.AssertEquals(t, m.Question[0].Name, "bracewel.net.")
+	test.AssertEquals(t, len(m.Answer), 1)
+	caa, ok := m.Answer[0].(*dns.CAA)
+	test.Assert(t, ok, "Answer should be a CAA record")
+	test.AssertEquals(t, caa.Value, "letsencrypt.org")
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		resp := get("?name=bracewel.net", auth)
+		resp.Body.Close()
+		test.AssertEquals(t, resp.StatusCode, http.StatusUnauthorized)
+	}
+	resp = get("", "Bearer secret")
+	resp.Body.Close()
+	test.AssertEquals(t, resp.StatusCode, http.StatusBadRequest)
+
+	// Without a token the handler is closed to everyone.
+	closed := httptest.NewServer(DebugCAAHandler(dr, ""))
+	defer closed.Close()
+	resp, err = http.Get(closed.URL + "?name=bracewel.net")
+	test.AssertNotError(t, err, "Request failed")
+	resp.Body.Close()
+	test.AssertEquals(t, resp.StatusCode, http.StatusUnauthorized)
+}
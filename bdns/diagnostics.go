@@ -0,0 +1,87 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// QueryDiagnostic describes a DNS query, with enough detail to explain its
+// failure without reproducing it with dig.
+type QueryDiagnostic struct {
+	Name   string
+	Type   string
+	Server string
+	// Rcode is the response code, or -1 if no response was received.
+	Rcode int
+	// RTT is the round-trip time of the last try, as reported by the
+	// client.
+	RTT   time.Duration
+	Tries int
+	// Err is the error the last try failed with, if any.
+	Err string
+}
+
+// Failed returns true if the query got no response, or one with an rcode
+// other than NOERROR or NXDOMAIN.
+func (d QueryDiagnostic) Failed() bool {
+	return d.Err != "" || (d.Rcode != dns.RcodeSuccess && d.Rcode != dns.RcodeNameError)
+}
+
+func (d QueryDiagnostic) String() string {
+	result := d.Err
+	if result == "" {
+		result = dns.RcodeToString[d.Rcode]
+	}
+	return fmt.Sprintf("%s %s @%s: %s after %d tries, rtt %s", d.Type, d.Name, d.Server, result, d.Tries, d.RTT)
+}
+
+// DiagnosticsRecorder collects a QueryDiagnostic for every query sent with a
+// context returned by WithDiagnostics. Queries coalesced with another
+// caller's are not recorded.
+type DiagnosticsRecorder struct {
+	sync.Mutex
+	queries []QueryDiagnostic
+}
+
+type diagnosticsKey struct{}
+
+// WithDiagnostics returns a context that records every DNS query made with it
+// into the returned recorder.
+func WithDiagnostics(ctx context.Context) (context.Context, *DiagnosticsRecorder) {
+	recorder := &DiagnosticsRecorder{}
+	return context.WithValue(ctx, diagnosticsKey{}, recorder), recorder
+}
+
+func diagnosticsFrom(ctx context.Context) *DiagnosticsRecorder {
+	recorder, _ := ctx.Value(diagnosticsKey{}).(*DiagnosticsRecorder)
+	return recorder
+}
+
+func (r *DiagnosticsRecorder) add(d QueryDiagnostic) {
+	r.Lock()
+	defer r.Unlock()
+	r.queries = append(r.queries, d)
+}
+
+// Failures returns the recorded queries that failed, in the order they
+// finished.
+func (r *DiagnosticsRecorder) Failures() []QueryDiagnostic {
+	r.Lock()
+	defer r.Unlock()
+	var failures []QueryDiagnostic
+	for _, d := range r.queries {
+		if d.Failed() {
+			failures = append(failures, d)
+		}
+	}
+	return failures
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// diagnosticExchanger answers servfail.example.com with SERVFAIL, fails to
+// reach the server for unreachable.example.com, times out once for
+// timeout.example.com before answering it, and answers everything else with
+// an empty response.
+type diagnosticExchanger struct {
+	timedOut bool
+}
+
+func (de *diagnosticExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	switch m.Question[0].Name {
+	case "servfail.example.com.":
+		r.Rcode = dns.RcodeServerFailure
+	case "unreachable.example.com.":
+		return nil, 0, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	case "timeout.example.com.":
+		if !de.timedOut {
+			de.timedOut = true
+			return nil, 0, &net.OpError{Op: "read", Net: "tcp", Err: tryTimeoutError{}}
+		}
+	}
+	return r, 3 * time.Millisecond, nil
+}
+
+func TestDiagnostics(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 2)
+	dr.dnsClient = &diagnosticExchanger{}
+	ctx, diagnostics := WithDiagnostics(context.Background())
+
+	_, _, err := dr.LookupCAA(ctx, "ok.example.com")
+	test.AssertNotError(t, err, "Lookup failed")
+	_, _, err = dr.LookupCAA(ctx, "timeout.example.com")
+	test.AssertNotError(t, err, "Lookup failed after a retry")
+	test.AssertEquals(t, len(diagnostics.Failures()), 0)
+
+	// A SERVFAIL is recorded, though LookupCAA treats it as no records.
+	_, _, err = dr.LookupCAA(ctx, "servfail.example.com")
+	test.AssertNotError(t, err, "SERVFAIL lookup failed")
+	_, _, err = dr.LookupCAA(ctx, "unreachable.example.com")
+	test.AssertError(t, err, "Lookup of unreachable server succeeded")
+	failures := diagnostics.Failures()
+	test.AssertEquals(t, len(failures), 2)
+	test.AssertDeepEquals(t, failures[0], QueryDiagnostic{
+		Name:   "servfail.example.com",
+		Type:   "CAA",
+		Server: dnsLoopbackAddr,
+		Rcode:  dns.RcodeServerFailure,
+		RTT:    3 * time.Millisecond,
+		Tries:  1,
+	})
+	test.AssertEquals(t, failures[0].String(), "CAA servfail.example.com @"+dnsLoopbackAddr+": SERVFAIL after 1 tries, rtt 3ms")
+	test.AssertEquals(t, failures[1].Rcode, -1)
+	test.AssertEquals(t, failures[1].Err, "dial tcp: connection refused")
+
+	// Without a recorder nothing is collected.
+	_, _, err = dr.LookupCAA(context.Background(), "unreachable.example.com")
+	test.AssertError(t, err, "Lookup of unreachable server succeeded")
+	test.AssertEquals(t, len(diagnostics.Failures()), 2)
+}
@@ -6,8 +6,8 @@
 package bdns
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"strings"
 	"time"
@@ -116,11 +116,20 @@ var (
 	}
 )
 
-// DNSResolver queries for DNS records
+// DNSResolver queries for DNS records.
+//
+// Implementations must be safe for concurrent use and must honour the
+// context's deadline and cancellation. LookupHost must not return addresses
+// in restricted ranges unless configured for testing. An empty result with a
+// nil error means the name has no records of that type; resolution failures,
+// including SERVFAIL, should be reported as errors so that callers fail
+// closed. LookupCAA returns the records at exactly the name given, along with
+// any DNAME records the resolver followed to find them; callers climb the
+// tree, and follow DNAME redirections, themselves.
 type DNSResolver interface {
 	LookupTXT(context.Context, string) (txts []string, authorities []string, err error)
 	LookupHost(context.Context, string) ([]net.IP, error)
-	LookupCAA(context.Context, string) ([]*dns.CAA, error)
+	LookupCAA(context.Context, string) ([]*dns.CAA, []*dns.DNAME, error)
 	LookupMX(context.Context, string) ([]string, error)
 }
 
@@ -128,8 +137,26 @@ type DNSResolver interface {
 type DNSResolverImpl struct {
 	dnsClient                exchanger
 	servers                  []string
+	zoneServers              map[string][]string
 	allowRestrictedAddresses bool
+	checkResponses           bool
+	lenientHeaders           bool
+	dialTimeout              time.Duration
+	caaOverride              *caaOverride
+	requireAuthenticatedCAA  bool
+	strictParsing            bool
+	ignoreBogusCAA           bool
+	checkAuthority           bool
+	maxCNAMEChain            int
+	caaClass                 uint16
+	limiter                  *queryLimiter
+	selector                 *latencySelector
+	flights                  *flightGroup
 	maxTries                 int
+	readTimeout              time.Duration
+	tryTimeouts              []time.Duration
+	serverTimeouts           map[string]time.Duration
+	after                    func(time.Duration) <-chan time.Time
 	clk                      clock.Clock
 	stats                    metrics.Scope
 	txtStats                 metrics.Scope
@@ -148,17 +175,16 @@ type exchanger interface {
 // provided list of DNS servers for resolution.
 func NewDNSResolverImpl(readTimeout time.Duration, servers []string, stats metrics.Scope, clk clock.Clock, maxTries int) *DNSResolverImpl {
 	// TODO(jmhodges): make constructor use an Option func pattern
-	dnsClient := new(dns.Client)
-
 	// Set timeout for underlying net.Conn
-	dnsClient.ReadTimeout = readTimeout
-	dnsClient.Net = "tcp"
+	dnsClient := &tcpExchanger{timeout: readTimeout}
 
 	return &DNSResolverImpl{
 		dnsClient:                dnsClient,
 		servers:                  servers,
 		allowRestrictedAddresses: false,
 		maxTries:                 maxTries,
+		maxCNAMEChain:            DefaultMaxCNAMEChain,
+		readTimeout:              readTimeout,
 		clk:                      clk,
 		stats:                    stats,
 		txtStats:                 stats.NewScope("TXT"),
@@ -177,25 +203,36 @@ func NewTestDNSResolverImpl(readTimeout time.Duration, servers []string, stats m
 	return resolver
 }
 
-// exchangeOne performs a single DNS exchange with a randomly chosen server
-// out of the server list, returning the response, time, and error (if any).
+// exchangeOne performs a single DNS exchange with a server chosen by the
+// server selection strategy, returning the response, time, and error (if any).
 // This method sets the DNSSEC OK bit on the message to true before sending
 // it to the resolver in case validation isn't the resolvers default behaviour.
 func (dnsResolver *DNSResolverImpl) exchangeOne(ctx context.Context, hostname string, qtype uint16, msgStats metrics.Scope) (*dns.Msg, error) {
+	if dnsResolver.flights != nil {
+		return dnsResolver.exchangeShared(ctx, hostname, qtype, msgStats)
+	}
+	return dnsResolver.exchange(ctx, hostname, qtype, msgStats)
+}
+
+// exchange sends a query for hostname, retrying temporary failures.
+func (dnsResolver *DNSResolverImpl) exchange(ctx context.Context, hostname string, qtype uint16, msgStats metrics.Scope) (resp *dns.Msg, err error) {
 	m := new(dns.Msg)
 	// Set question type
 	m.SetQuestion(dns.Fqdn(hostname), qtype)
+	if qtype == dns.TypeCAA && dnsResolver.caaClass != 0 {
+		m.Question[0].Qclass = dnsResolver.caaClass
+	}
 	// Set DNSSEC OK bit for resolver
 	m.SetEdns0(4096, true)
 
-	if len(dnsResolver.servers) < 1 {
+	servers := dnsResolver.serversFor(hostname)
+	if len(servers) < 1 {
 		return nil, fmt.Errorf("Not configured with at least one DNS Server")
 	}
 
 	dnsResolver.stats.Inc("Rate", 1)
 
-	// Randomly pick a server
-	chosenServer := dnsResolver.servers[rand.Intn(len(dnsResolver.servers))]
+	chosenServer := dnsResolver.chooseServer(servers, "")
 
 	client := dnsResolver.dnsClient
 
@@ -203,42 +240,225 @@ func (dnsResolver *DNSResolverImpl) exchangeOne(ctx context.Context, hostname st
 	start := dnsResolver.clk.Now()
 	msgStats.Inc("Calls", 1)
 	defer msgStats.TimingDuration("Latency", dnsResolver.clk.Now().Sub(start))
+	var rtt time.Duration
+	if recorder := diagnosticsFrom(ctx); recorder != nil {
+		defer func() {
+			d := QueryDiagnostic{
+				Name:   hostname,
+				Type:   dns.TypeToString[qtype],
+				Server: chosenServer,
+				Rcode:  -1,
+				RTT:    rtt,
+				Tries:  tries,
+			}
+			if resp != nil {
+				d.Rcode = resp.Rcode
+			}
+			if err != nil {
+				d.Err = err.Error()
+			}
+			recorder.add(d)
+		}()
+	}
 	for {
 		msgStats.Inc("Tries", 1)
 		ch := make(chan dnsResp, 1)
 
-		go func() {
-			rsp, rtt, err := client.Exchange(m, chosenServer)
+		limiter := dnsResolver.limiter
+		if limiter != nil {
+			if err := limiter.acquire(ctx, dnsResolver.stats); err != nil {
+				msgStats.Inc("Cancels", 1)
+				msgStats.Inc("Errors", 1)
+				return nil, err
+			}
+		}
+		go func(server string) {
+			rsp, rtt, err := client.Exchange(m, server)
+			if limiter != nil {
+				limiter.release()
+			}
 			msgStats.TimingDuration("SingleTryLatency", rtt)
-			ch <- dnsResp{m: rsp, err: err}
-		}()
+			if recorder := rttRecorderFrom(ctx); recorder != nil && err == nil {
+				recorder.add(rtt)
+			}
+			ch <- dnsResp{m: rsp, rtt: rtt, err: err}
+		}(chosenServer)
+		var r dnsResp
 		select {
 		case <-ctx.Done():
 			msgStats.Inc("Cancels", 1)
 			msgStats.Inc("Errors", 1)
 			return nil, ctx.Err()
-		case r := <-ch:
+		case r = <-ch:
+		case <-dnsResolver.tryTimer(tries, chosenServer):
+			// The exchange carries on in the background, but its result
+			// is dropped.
+			msgStats.Inc("TryTimeouts", 1)
+			r = dnsResp{err: &net.OpError{Op: "read", Net: "tcp", Err: tryTimeoutError{}}}
+		}
+		rtt = r.rtt
+		if selector := dnsResolver.selector; selector != nil {
 			if r.err != nil {
-				msgStats.Inc("Errors", 1)
-				operr, ok := r.err.(*net.OpError)
-				isRetryable := ok && operr.Temporary()
-				hasRetriesLeft := tries < dnsResolver.maxTries
-				if isRetryable && hasRetriesLeft {
-					tries++
-					continue
-				} else if isRetryable && !hasRetriesLeft {
-					msgStats.Inc("RanOutOfTries", 1)
-				}
+				selector.observe(chosenServer, dnsResolver.serverTimeout(chosenServer))
 			} else {
-				msgStats.Inc("Successes", 1)
+				selector.observe(chosenServer, rtt)
+			}
+		}
+		if r.err != nil {
+			msgStats.Inc("Errors", 1)
+			operr, ok := r.err.(*net.OpError)
+			isRetryable := ok && operr.Temporary()
+			hasRetriesLeft := tries < dnsResolver.maxTries
+			if isRetryable && hasRetriesLeft {
+				tries++
+				if next := dnsResolver.chooseServer(servers, chosenServer); next != chosenServer {
+					msgStats.Inc("ServerFallbacks", 1)
+					chosenServer = next
+				}
+				continue
+			} else if isRetryable && !hasRetriesLeft {
+				msgStats.Inc("RanOutOfTries", 1)
+			}
+		} else {
+			if err := checkHeader(r.m); err != nil {
+				msgStats.Inc("MalformedHeaders", 1)
+				if !dnsResolver.lenientHeaders {
+					msgStats.Inc("Errors", 1)
+					return nil, err
+				}
 			}
-			return r.m, r.err
+			if dnsResolver.checkResponses {
+				if err := checkResponse(m, r.m); err != nil {
+					msgStats.Inc("Errors", 1)
+					msgStats.Inc("Mismatches", 1)
+					return nil, err
+				}
+			}
+			if unrelatedAuthority(m, r.m) {
+				msgStats.Inc("UnrelatedAuthority", 1)
+				if dnsResolver.checkAuthority {
+					msgStats.Inc("Errors", 1)
+					return nil, ErrUnrelatedAuthority
+				}
+			}
+			msgStats.Inc("Successes", 1)
+		}
+		return r.m, r.err
+	}
+}
+
+// RouteZone directs queries for zone, and any name below it, to servers
+// rather than the default server list. This supports split-horizon setups
+// where internal zones must only be answered by internal resolvers. When
+// routed zones overlap, the longest match wins.
+func (dnsResolver *DNSResolverImpl) RouteZone(zone string, servers []string) {
+	if dnsResolver.zoneServers == nil {
+		dnsResolver.zoneServers = make(map[string][]string)
+	}
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	dnsResolver.zoneServers[zone] = servers
+}
+
+// serversFor returns the servers that should be asked about hostname.
+func (dnsResolver *DNSResolverImpl) serversFor(hostname string) []string {
+	name := strings.ToLower(strings.TrimRight(hostname, "."))
+	for {
+		if servers, ok := dnsResolver.zoneServers[name]; ok {
+			return servers
+		}
+		idx := strings.IndexByte(name, '.')
+		if idx < 0 {
+			return dnsResolver.servers
+		}
+		name = name[idx+1:]
+	}
+}
+
+// SetDialTimeout bounds how long establishing a connection to a server may
+// take, separately from the timeout for the query itself. For DNS-over-TLS
+// this includes the handshake.
+func (dnsResolver *DNSResolverImpl) SetDialTimeout(timeout time.Duration) {
+	dnsResolver.dialTimeout = timeout
+	setDialTimeout(dnsResolver.dnsClient, timeout)
+}
+
+func setDialTimeout(ex exchanger, timeout time.Duration) {
+	switch c := ex.(type) {
+	case *tcpExchanger:
+		c.dialTimeout = timeout
+	case *tlsExchanger:
+		c.dialTimeout = timeout
+	case *cookieExchanger:
+		setDialTimeout(c.exchanger, timeout)
+	}
+}
+
+// CheckResponses makes the resolver reject responses whose transaction ID
+// or question section don't match the query that was sent. This guards
+// against spoofed answers from off-path attackers.
+func (dnsResolver *DNSResolverImpl) CheckResponses() {
+	dnsResolver.checkResponses = true
+}
+
+// RequireAuthenticatedCAA makes CAA lookups fail unless the resolver sets
+// the AD (Authenticated Data) bit on its response, i.e. unless it validated
+// the answer with DNSSEC. It is for use with a trusted, validating resolver.
+func (dnsResolver *DNSResolverImpl) RequireAuthenticatedCAA() {
+	dnsResolver.requireAuthenticatedCAA = true
+}
+
+// StrictParsing makes CAA lookups fail on responses with malformed records,
+// or with records for an unrelated name, rather than recovering the
+// well-formed, related ones.
+func (dnsResolver *DNSResolverImpl) StrictParsing() {
+	dnsResolver.strictParsing = true
+}
+
+// ErrMalformedResponse is returned for responses with malformed records when
+// StrictParsing is set.
+var ErrMalformedResponse = errors.New("DNS response has malformed records")
+
+// validCAATag returns true if tag is well-formed: at most 15 ASCII letters
+// and digits (RFC 8659 section 4.1.1). Empty tags are let through, as they
+// are dealt with as blank records.
+func validCAATag(tag string) bool {
+	if len(tag) > 15 {
+		return false
+	}
+	for _, c := range tag {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
 		}
 	}
+	return true
+}
+
+// ErrNotAuthenticated is returned for CAA responses without the AD bit when
+// RequireAuthenticatedCAA is set.
+var ErrNotAuthenticated = errors.New("response was not DNSSEC-authenticated")
+
+// ErrResponseMismatch is returned when a response doesn't answer the query
+// that was sent.
+var ErrResponseMismatch = errors.New("DNS response does not match query")
+
+// checkResponse verifies that r is a response to query m: the transaction
+// IDs are equal and the question sections match in name, type and class.
+func checkResponse(m, r *dns.Msg) error {
+	if r.Id != m.Id || len(r.Question) != len(m.Question) {
+		return ErrResponseMismatch
+	}
+	for i, q := range m.Question {
+		rq := r.Question[i]
+		if !strings.EqualFold(rq.Name, q.Name) || rq.Qtype != q.Qtype || rq.Qclass != q.Qclass {
+			return ErrResponseMismatch
+		}
+	}
+	return nil
 }
 
 type dnsResp struct {
 	m   *dns.Msg
+	rtt time.Duration
 	err error
 }
 
@@ -310,29 +530,126 @@ func (dnsResolver *DNSResolverImpl) LookupHost(ctx context.Context, hostname str
 
 // LookupCAA sends a DNS query to find all CAA records associated with
 // the provided hostname. If the response code from the resolver is
-// SERVFAIL an empty slice of CAA records is returned.
-func (dnsResolver *DNSResolverImpl) LookupCAA(ctx context.Context, hostname string) ([]*dns.CAA, error) {
+// SERVFAIL an empty slice of CAA records is returned, unless the resolver
+// reports a DNSSEC validation failure (see IgnoreBogusCAA).
+func (dnsResolver *DNSResolverImpl) LookupCAA(ctx context.Context, hostname string) ([]*dns.CAA, []*dns.DNAME, error) {
 	dnsType := dns.TypeCAA
+	if records, ok := dnsResolver.caaOverride.lookup(hostname); ok {
+		dnsResolver.caaStats.Inc("Overridden", 1)
+		CAAAnswersFrom(ctx).record(hostname, true)
+		return records, nil, nil
+	}
 	r, err := dnsResolver.exchangeOne(ctx, hostname, dnsType, dnsResolver.caaStats)
 	if err != nil {
-		return nil, &dnsError{dnsType, hostname, err, -1}
+		return nil, nil, &dnsError{dnsType, hostname, err, -1}
+	}
+	if dnsResolver.requireAuthenticatedCAA && !r.AuthenticatedData {
+		dnsResolver.caaStats.Inc("NotAuthenticated", 1)
+		return nil, nil, &dnsError{dnsType, hostname, ErrNotAuthenticated, -1}
 	}
 
 	// On resolver validation failure, or other server failures, return empty an
 	// set and no error.
+	CAAAnswersFrom(ctx).record(hostname, r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError)
+	if r.Rcode == dns.RcodeNameError {
+		CAAAnswersFrom(ctx).recordNameError(hostname)
+	}
 	var CAAs []*dns.CAA
 	if r.Rcode == dns.RcodeServerFailure {
-		return CAAs, nil
+		if bogus(r) {
+			dnsResolver.caaStats.Inc("Bogus", 1)
+			if !dnsResolver.ignoreBogusCAA {
+				return nil, nil, &dnsError{dnsType, hostname, ErrDNSSECBogus, -1}
+			}
+		}
+		return CAAs, nil, nil
+	}
+	if cnameChain(r.Answer) > dnsResolver.maxCNAMEChain {
+		dnsResolver.caaStats.Inc("CNAMEChainTooLong", 1)
+		return nil, nil, &dnsError{dnsType, hostname, ErrCNAMEChainTooLong, -1}
 	}
 
+	var DNAMEs []*dns.DNAME
+	owners := answerOwners(hostname, r.Answer)
 	for _, answer := range r.Answer {
-		if answer.Header().Rrtype == dnsType {
-			if caaR, ok := answer.(*dns.CAA); ok {
-				CAAs = append(CAAs, caaR)
+		switch rr := answer.(type) {
+		case *dns.CAA:
+			if !owners[strings.ToLower(dns.Fqdn(rr.Hdr.Name))] {
+				dnsResolver.caaStats.Inc("UnrelatedOwner", 1)
+				if dnsResolver.strictParsing {
+					return nil, nil, &dnsError{dnsType, hostname, ErrUnrelatedOwner, -1}
+				}
+				continue
+			}
+			if !validCAATag(rr.Tag) {
+				dnsResolver.caaStats.Inc("Malformed", 1)
+				if dnsResolver.strictParsing {
+					return nil, nil, &dnsError{dnsType, hostname, ErrMalformedResponse, -1}
+				}
+				continue
+			}
+			CAAs = append(CAAs, rr)
+		case *dns.DNAME:
+			DNAMEs = append(DNAMEs, rr)
+		}
+	}
+	if len(DNAMEs) > 0 {
+		dnsResolver.caaStats.Inc("DNAME", 1)
+	}
+	markWildcardCAA(r.Answer, CAAs)
+	return CAAs, DNAMEs, nil
+}
+
+// ErrUnrelatedOwner is returned for CAA responses with records owned by a
+// name the query didn't lead to, when StrictParsing is set. Otherwise those
+// records are dropped.
+var ErrUnrelatedOwner = errors.New("DNS response has records for an unrelated name")
+
+// answerOwners returns the names, lowercased and fully qualified, that the
+// records answering a query for qname may be owned by: qname itself, and
+// the names the CNAMEs in answer lead to from it. Records synthesized from a
+// wildcard or a DNAME are owned by one of those too.
+func answerOwners(qname string, answer []dns.RR) map[string]bool {
+	owners := map[string]bool{strings.ToLower(dns.Fqdn(qname)): true}
+	for added := true; added; {
+		added = false
+		for _, rr := range answer {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !owners[strings.ToLower(dns.Fqdn(cname.Hdr.Name))] {
+				continue
+			}
+			target := strings.ToLower(dns.Fqdn(cname.Target))
+			if !owners[target] {
+				owners[target] = true
+				added = true
+			}
+		}
+	}
+	return owners
+}
+
+// markWildcardCAA rewrites the owner name of CAA records that were
+// synthesized from a wildcard to the wildcard itself, e.g.
+// "*.example.com.", so that callers can tell them apart. Synthesis shows in
+// the covering RRSIG, whose label count is smaller than that of the owner
+// name (RFC 4035 section 5.3.4).
+func markWildcardCAA(answer []dns.RR, CAAs []*dns.CAA) {
+	for _, rr := range answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.TypeCovered != dns.TypeCAA {
+			continue
+		}
+		labels := dns.SplitDomainName(sig.Hdr.Name)
+		if int(sig.Labels) >= len(labels) {
+			continue
+		}
+		wildcard := "*." + dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels):], "."))
+		for _, caa := range CAAs {
+			if strings.EqualFold(caa.Hdr.Name, sig.Hdr.Name) {
+				caa.Hdr.Name = wildcard
 			}
 		}
 	}
-	return CAAs, nil
 }
 
 // LookupMX sends a DNS query to find a MX record associated hostname and returns the
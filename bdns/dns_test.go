@@ -98,7 +98,50 @@ func mockDNSQuery(w dns.ResponseWriter, r *dns.Msg) {
 				record.Flag = 1
 				appendAnswer(record)
 			}
+			if q.Name == "unrelated.example.com." {
+				record := new(dns.CAA)
+				record.Hdr = dns.RR_Header{Name: "evil.example.net.", Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 0}
+				record.Tag = "issue"
+				record.Value = "evil.example.net"
+				appendAnswer(record)
+				record = new(dns.CAA)
+				record.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 0}
+				record.Tag = "issue"
+				record.Value = "letsencrypt.org"
+				appendAnswer(record)
+			}
+			if q.Name == "www.wildcard.example.com." {
+				record := new(dns.CAA)
+				record.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 0}
+				record.Tag = "issue"
+				record.Value = "letsencrypt.org"
+				appendAnswer(record)
+				sig := new(dns.RRSIG)
+				sig.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 0}
+				sig.TypeCovered = dns.TypeCAA
+				sig.Algorithm = dns.ECDSAP256SHA256
+				// Signed as *.wildcard.example.com, which has three labels.
+				sig.Labels = 3
+				sig.SignerName = "example.com."
+				sig.Signature = "AAAA"
+				appendAnswer(sig)
+			}
+			if q.Name == "www.dname.example.com." {
+				// Redirected to a name with no CAA records.
+				dname := new(dns.DNAME)
+				dname.Hdr = dns.RR_Header{Name: "dname.example.com.", Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: 0}
+				dname.Target = "dname-target.example.net."
+				appendAnswer(dname)
+				cname := new(dns.CNAME)
+				cname.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 0}
+				cname.Target = "www.dname-target.example.net."
+				appendAnswer(cname)
+			}
 			if q.Name == "cname.example.com." {
+				cname := new(dns.CNAME)
+				cname.Hdr = dns.RR_Header{Name: "cname.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 30}
+				cname.Target = "CAA.example.com."
+				appendAnswer(cname)
 				record := new(dns.CAA)
 				record.Hdr = dns.RR_Header{Name: "caa.example.com.", Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 0}
 				record.Tag = "issue"
@@ -205,7 +248,7 @@ func TestDNSLookupsNoServer(t *testing.T) {
 	_, err = obj.LookupHost(context.Background(), "letsencrypt.org")
 	test.AssertError(t, err, "No servers")
 
-	_, err = obj.LookupCAA(context.Background(), "letsencrypt.org")
+	_, _, err = obj.LookupCAA(context.Background(), "letsencrypt.org")
 	test.AssertError(t, err, "No servers")
 }
 
@@ -221,7 +264,7 @@ func TestDNSServFail(t *testing.T) {
 
 	// CAA lookup ignores validation failures from the resolver for now
 	// and returns an empty list of CAA records.
-	emptyCaa, err := obj.LookupCAA(context.Background(), bad)
+	emptyCaa, _, err := obj.LookupCAA(context.Background(), bad)
 	test.Assert(t, len(emptyCaa) == 0, "Query returned non-empty list of CAA records")
 	test.AssertNotError(t, err, "LookupCAA returned an error")
 }
@@ -290,17 +333,44 @@ func TestDNSNXDOMAIN(t *testing.T) {
 func TestDNSLookupCAA(t *testing.T) {
 	obj := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
 
-	caas, err := obj.LookupCAA(context.Background(), "bracewel.net")
+	caas, _, err := obj.LookupCAA(context.Background(), "bracewel.net")
 	test.AssertNotError(t, err, "CAA lookup failed")
 	test.Assert(t, len(caas) > 0, "Should have CAA records")
 
-	caas, err = obj.LookupCAA(context.Background(), "nonexistent.letsencrypt.org")
+	caas, _, err = obj.LookupCAA(context.Background(), "nonexistent.letsencrypt.org")
 	test.AssertNotError(t, err, "CAA lookup failed")
 	test.Assert(t, len(caas) == 0, "Shouldn't have CAA records")
 
-	caas, err = obj.LookupCAA(context.Background(), "cname.example.com")
+	caas, _, err = obj.LookupCAA(context.Background(), "cname.example.com")
 	test.AssertNotError(t, err, "CAA lookup failed")
 	test.Assert(t, len(caas) > 0, "Should follow CNAME to find CAA")
+
+	// Records for a name the query didn't lead to are dropped, or fail
+	// the lookup with strict parsing.
+	caas, _, err = obj.LookupCAA(context.Background(), "unrelated.example.com")
+	test.AssertNotError(t, err, "CAA lookup failed")
+	test.AssertEquals(t, len(caas), 1)
+	test.AssertEquals(t, caas[0].Value, "letsencrypt.org")
+	strict := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	strict.StrictParsing()
+	_, _, err = strict.LookupCAA(context.Background(), "unrelated.example.com")
+	test.AssertError(t, err, "Record for an unrelated name should fail the lookup")
+	test.AssertEquals(t, err.(*dnsError).underlying, ErrUnrelatedOwner)
+
+	caas, dnames, err := obj.LookupCAA(context.Background(), "www.dname.example.com")
+	test.AssertNotError(t, err, "CAA lookup failed")
+	test.AssertEquals(t, len(caas), 0)
+	test.AssertEquals(t, len(dnames), 1)
+	test.AssertEquals(t, dnames[0].Target, "dname-target.example.net.")
+
+	caas, _, err = obj.LookupCAA(context.Background(), "www.wildcard.example.com")
+	test.AssertNotError(t, err, "CAA lookup failed")
+	test.AssertEquals(t, len(caas), 1)
+	test.AssertEquals(t, caas[0].Hdr.Name, "*.wildcard.example.com.")
+
+	caas, _, err = obj.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertNotError(t, err, "CAA lookup failed")
+	test.AssertEquals(t, caas[0].Hdr.Name, "bracewel.net.")
 }
 
 func TestDNSTXTAuthorities(t *testing.T) {
@@ -325,7 +395,7 @@ func (te *testExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration
 	te.Lock()
 	defer te.Unlock()
 	msg := &dns.Msg{
-		MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess},
+		MsgHdr: dns.MsgHdr{Response: true, Rcode: dns.RcodeSuccess},
 	}
 	if len(te.errs) <= te.count {
 		return nil, 0, errTooManyRequests
@@ -497,6 +567,284 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+// perNameExchanger fails the first queries for each name with the errors
+// listed for it, then succeeds, counting how often each name was queried.
+type perNameExchanger struct {
+	sync.Mutex
+	errs   map[string][]error
+	counts map[string]int
+}
+
+func (pe *perNameExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	pe.Lock()
+	defer pe.Unlock()
+	name := m.Question[0].Name
+	n := pe.counts[name]
+	pe.counts[name] = n + 1
+	if n < len(pe.errs[name]) {
+		return nil, 0, pe.errs[name][n]
+	}
+	return &dns.Msg{MsgHdr: dns.MsgHdr{Response: true, Rcode: dns.RcodeSuccess}}, time.Millisecond, nil
+}
+
+func TestRetryScopedToFailingName(t *testing.T) {
+	isTempErr := &net.OpError{Op: "read", Err: tempError(true)}
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 3)
+	pe := &perNameExchanger{
+		errs:   map[string][]error{"b.example.com.": {isTempErr}},
+		counts: make(map[string]int),
+	}
+	dr.dnsClient = pe
+
+	// Look up every name in the climb concurrently, as the VA does.
+	names := []string{"a.b.example.com", "b.example.com", "example.com", "com"}
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			_, _, errs[i] = dr.LookupCAA(context.Background(), name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		test.AssertNotError(t, errs[i], "CAA lookup failed for "+name)
+		expected := 1
+		if name == "b.example.com" {
+			expected = 2
+		}
+		if pe.counts[name+"."] != expected {
+			t.Errorf("%s was queried %d times, expected %d", name, pe.counts[name+"."], expected)
+		}
+	}
+}
+
+// recordingExchanger answers every query successfully and remembers which
+// server each query was sent to.
+type recordingExchanger struct {
+	sync.Mutex
+	servers []string
+}
+
+func (re *recordingExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	re.Lock()
+	defer re.Unlock()
+	re.servers = append(re.servers, a)
+	return &dns.Msg{MsgHdr: dns.MsgHdr{Response: true, Rcode: dns.RcodeSuccess}}, time.Millisecond, nil
+}
+
+func (re *recordingExchanger) last() string {
+	re.Lock()
+	defer re.Unlock()
+	return re.servers[len(re.servers)-1]
+}
+
+func TestRouteZone(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"public:53"}, testStats, clock.NewFake(), 1)
+	re := &recordingExchanger{}
+	dr.dnsClient = re
+	dr.RouteZone("corp.example.", []string{"internal:53"})
+	dr.RouteZone("lab.corp.example", []string{"lab:53"})
+
+	testCases := []struct {
+		name   string
+		server string
+	}{
+		{"corp.example", "internal:53"},
+		{"host.CORP.example.", "internal:53"},
+		{"a.b.lab.corp.example", "lab:53"},
+		{"notcorp.example", "public:53"},
+		{"example.com", "public:53"},
+	}
+	for _, tc := range testCases {
+		_, _, err := dr.LookupCAA(context.Background(), tc.name)
+		test.AssertNotError(t, err, "CAA lookup failed")
+		if re.last() != tc.server {
+			t.Errorf("Lookup for %s went to %s, expected %s", tc.name, re.last(), tc.server)
+		}
+	}
+}
+
+// mismatchExchanger answers every query with a response for a different
+// name, or with a different transaction ID.
+type mismatchExchanger struct {
+	wrongID bool
+}
+
+func (me mismatchExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	if me.wrongID {
+		r.Id = m.Id + 1
+	} else {
+		r.Question[0].Name = "evil.example.net."
+	}
+	return r, time.Millisecond, nil
+}
+
+func TestCheckResponses(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	dr.dnsClient = mismatchExchanger{}
+
+	// Without validation the mismatched response is accepted.
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Unvalidated lookup failed")
+
+	dr.CheckResponses()
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Response for a different name should be rejected")
+	test.AssertEquals(t, err.(*dnsError).underlying, ErrResponseMismatch)
+
+	dr.dnsClient = mismatchExchanger{wrongID: true}
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Response with a different ID should be rejected")
+
+	m := new(dns.Msg)
+	m.SetQuestion("Example.COM.", dns.TypeCAA)
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Question[0].Name = "example.com."
+	test.AssertNotError(t, checkResponse(m, r), "Names differing only in case should match")
+	r.Question[0].Qtype = dns.TypeA
+	test.AssertEquals(t, checkResponse(m, r), ErrResponseMismatch)
+}
+
+// adExchanger answers every query, setting the AD bit if authenticated.
+type adExchanger struct {
+	authenticated bool
+}
+
+func (ae adExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.AuthenticatedData = ae.authenticated
+	return r, time.Millisecond, nil
+}
+
+func TestRequireAuthenticatedCAA(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	dr.dnsClient = adExchanger{authenticated: false}
+
+	// Without the option the AD bit is ignored.
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Lookup without AD bit failed")
+
+	dr.RequireAuthenticatedCAA()
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Lookup without AD bit should fail")
+	test.AssertEquals(t, err.Error(), "DNS problem: response not authenticated with DNSSEC looking up CAA for example.com")
+
+	dr.dnsClient = adExchanger{authenticated: true}
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Lookup with AD bit failed")
+}
+
+// rttExchanger answers every query, reporting RTTs from a fixed sequence.
+type rttExchanger struct {
+	sync.Mutex
+	rtts []time.Duration
+}
+
+func (re *rttExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	re.Lock()
+	defer re.Unlock()
+	rtt := re.rtts[0]
+	re.rtts = re.rtts[1:]
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, rtt, nil
+}
+
+func TestRTTRecorder(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	dr.dnsClient = &rttExchanger{rtts: []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}}
+
+	ctx, recorder := WithRTTRecorder(context.Background())
+	for _, name := range []string{"a.example.com", "example.com", "com"} {
+		_, _, err := dr.LookupCAA(ctx, name)
+		test.AssertNotError(t, err, "CAA lookup failed")
+	}
+	test.AssertEquals(t, recorder.Summary(), RTTSummary{
+		Queries: 3,
+		Min:     10 * time.Millisecond,
+		Max:     30 * time.Millisecond,
+		Total:   60 * time.Millisecond,
+	})
+
+	// Lookups without a recorder are unaffected.
+	dr.dnsClient = &rttExchanger{rtts: []time.Duration{time.Millisecond}}
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "CAA lookup failed")
+}
+
+// rcodeExchanger answers every query with an empty response with the
+// given rcode.
+type rcodeExchanger int
+
+func (re rcodeExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetRcode(m, int(re))
+	return r, time.Millisecond, nil
+}
+
+func TestCAAAnswers(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	ctx, answers := WithCAAAnswers(context.Background())
+
+	for _, rcode := range []int{dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeServerFailure, dns.RcodeRefused} {
+		dr.dnsClient = rcodeExchanger(rcode)
+		name := fmt.Sprintf("%s.example.com", strings.ToLower(dns.RcodeToString[rcode]))
+		caas, _, err := dr.LookupCAA(ctx, name)
+		test.AssertNotError(t, err, "CAA lookup failed")
+		test.AssertEquals(t, len(caas), 0)
+	}
+	test.Assert(t, answers.Answered("noerror.example.com"), "NOERROR should count as answered")
+	test.Assert(t, answers.Answered("NXDOMAIN.example.com."), "NXDOMAIN should count as answered")
+	test.Assert(t, !answers.Answered("servfail.example.com"), "SERVFAIL shouldn't count as answered")
+	test.Assert(t, !answers.Answered("refused.example.com"), "REFUSED shouldn't count as answered")
+	test.Assert(t, !answers.Answered("example.com"), "Names not looked up shouldn't count as answered")
+	test.Assert(t, answers.NameError("nxdomain.example.com"), "NXDOMAIN should be recorded as a name error")
+	test.Assert(t, !answers.NameError("noerror.example.com"), "NOERROR shouldn't be recorded as a name error")
+}
+
+// malformedCAAExchanger answers every query with one well-formed and one
+// malformed CAA record.
+type malformedCAAExchanger struct{}
+
+func (malformedCAAExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	hdr := dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET}
+	r.Answer = append(r.Answer,
+		&dns.CAA{Hdr: hdr, Tag: "issue", Value: "letsencrypt.org"},
+		&dns.CAA{Hdr: hdr, Tag: "issue wild", Value: ";"},
+	)
+	return r, time.Millisecond, nil
+}
+
+func TestStrictParsing(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	dr.dnsClient = malformedCAAExchanger{}
+
+	// By default the well-formed records are recovered.
+	caas, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Lenient lookup failed")
+	test.AssertEquals(t, len(caas), 1)
+	test.AssertEquals(t, caas[0].Tag, "issue")
+
+	dr.StrictParsing()
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Strict lookup should reject malformed records")
+	test.AssertEquals(t, err.(*dnsError).underlying, ErrMalformedResponse)
+	test.AssertEquals(t, err.Error(), "DNS problem: malformed response looking up CAA for example.com")
+
+	for tag, valid := range map[string]bool{"issue": true, "IODEF": true, "tbs1": true, "": true, "issue-wild": false, "1234567890abcdef": false} {
+		test.AssertEquals(t, validCAATag(tag), valid)
+	}
+}
+
 type tempError bool
 
 func (t tempError) Temporary() bool { return bool(t) }
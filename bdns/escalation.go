@@ -0,0 +1,72 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"time"
+)
+
+// tryTimeoutError is the error for a try abandoned after its timeout from
+// the schedule set with EscalateTimeouts. It is temporary, so the query is
+// retried if it has tries left.
+type tryTimeoutError struct{}
+
+func (tryTimeoutError) Error() string   { return "try timed out" }
+func (tryTimeoutError) Timeout() bool   { return true }
+func (tryTimeoutError) Temporary() bool { return true }
+
+// EscalateTimeouts gives each try of a query its own timeout from schedule:
+// the first try waits schedule[0], the second schedule[1], and so on, with
+// the last entry applying to any further tries. A short first timeout keeps
+// the common case fast, while longer ones for retries still tolerate slow
+// resolvers. The read timeout and the query's context still bound every
+// try, so entries beyond them have no effect.
+func (dnsResolver *DNSResolverImpl) EscalateTimeouts(schedule []time.Duration) {
+	dnsResolver.tryTimeouts = schedule
+}
+
+// SetServerTimeouts gives tries sent to the servers listed their own
+// timeouts, so that a fast server can be given up on quickly in favour of
+// the others, while servers not listed keep the read timeout. As with
+// EscalateTimeouts, the read timeout still bounds every try, so it should be
+// set for the slowest server. Where both apply, the shorter of a try's
+// escalation timeout and its server's timeout is used.
+func (dnsResolver *DNSResolverImpl) SetServerTimeouts(timeouts map[string]time.Duration) {
+	dnsResolver.serverTimeouts = timeouts
+}
+
+// serverTimeout returns the timeout for a try sent to server.
+func (dnsResolver *DNSResolverImpl) serverTimeout(server string) time.Duration {
+	if timeout, ok := dnsResolver.serverTimeouts[server]; ok && timeout < dnsResolver.readTimeout {
+		return timeout
+	}
+	return dnsResolver.readTimeout
+}
+
+// tryTimer returns a channel that fires when the given try, counting from
+// one, has run out of time, or nil if tries have no timeout of their own.
+func (dnsResolver *DNSResolverImpl) tryTimer(try int, server string) <-chan time.Time {
+	var timeout time.Duration
+	if len(dnsResolver.tryTimeouts) > 0 {
+		i := try - 1
+		if i >= len(dnsResolver.tryTimeouts) {
+			i = len(dnsResolver.tryTimeouts) - 1
+		}
+		timeout = dnsResolver.tryTimeouts[i]
+	}
+	if serverTimeout, ok := dnsResolver.serverTimeouts[server]; ok && (timeout == 0 || serverTimeout < timeout) {
+		timeout = serverTimeout
+	}
+	if timeout == 0 {
+		return nil
+	}
+	// after is only set by tests.
+	after := dnsResolver.after
+	if after == nil {
+		after = time.After
+	}
+	return after(timeout)
+}
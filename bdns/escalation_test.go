@@ -0,0 +1,142 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// stallingExchanger never answers the first stalls tries, and answers every
+// later one at once. It signals started as each try begins.
+type stallingExchanger struct {
+	sync.Mutex
+	tries   int
+	stalls  int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (se *stallingExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	se.Lock()
+	se.tries++
+	stall := se.tries <= se.stalls
+	se.Unlock()
+	se.started <- struct{}{}
+	if stall {
+		<-se.release
+		return nil, 0, context.Canceled
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, time.Millisecond, nil
+}
+
+// expiringTimers replaces time.After, recording each timeout asked for. The
+// first expiring timers fire as soon as their try has started, so that tries
+// reach the exchanger in order, and the rest never do.
+type expiringTimers struct {
+	sync.Mutex
+	expiring  int
+	started   chan struct{}
+	durations []time.Duration
+}
+
+func (et *expiringTimers) after(d time.Duration) <-chan time.Time {
+	et.Lock()
+	defer et.Unlock()
+	et.durations = append(et.durations, d)
+	if len(et.durations) > et.expiring {
+		return nil
+	}
+	ch := make(chan time.Time, 1)
+	go func() {
+		<-et.started
+		ch <- time.Time{}
+	}()
+	return ch
+}
+
+func TestEscalateTimeouts(t *testing.T) {
+	schedule := []time.Duration{100 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second}
+	testCases := []struct {
+		maxTries  int
+		stalls    int
+		succeeds  bool
+		durations []time.Duration
+	}{
+		// The fast case only ever uses the first timeout.
+		{3, 0, true, schedule[:1]},
+		{3, 2, true, schedule},
+		// Tries beyond the schedule keep its last timeout.
+		{5, 4, true, append(schedule, 2*time.Second, 2*time.Second)},
+		// Running out of tries fails the query.
+		{2, 2, false, schedule[:2]},
+	}
+	for _, tc := range testCases {
+		dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), tc.maxTries)
+		started := make(chan struct{}, tc.maxTries)
+		se := &stallingExchanger{stalls: tc.stalls, started: started, release: make(chan struct{})}
+		dr.dnsClient = se
+		et := &expiringTimers{expiring: tc.stalls, started: started}
+		dr.after = et.after
+		dr.EscalateTimeouts(schedule)
+
+		_, _, err := dr.LookupTXT(context.Background(), "example.com")
+		close(se.release)
+		if tc.succeeds {
+			test.AssertNotError(t, err, "Lookup should succeed")
+		} else {
+			test.AssertError(t, err, "Lookup should fail")
+			test.AssertEquals(t, err.Error(), "DNS problem: query timed out looking up TXT for example.com")
+		}
+		test.AssertDeepEquals(t, et.durations, tc.durations)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	testCases := []struct {
+		schedule  []time.Duration
+		durations []time.Duration
+	}{
+		// The fast server is abandoned after its own timeout, and the retry
+		// goes to the slow one, which gets longer.
+		{nil, []time.Duration{100 * time.Millisecond, 3 * time.Second}},
+		// The shorter of the schedule's timeout and the server's applies.
+		{[]time.Duration{time.Second}, []time.Duration{100 * time.Millisecond, time.Second}},
+	}
+	for _, tc := range testCases {
+		servers := []string{"fast:53", "slow:53"}
+		dr := NewTestDNSResolverImpl(time.Second*10, servers, testStats, clock.NewFake(), 2)
+		started := make(chan struct{}, 2)
+		se := &stallingExchanger{stalls: 1, started: started, release: make(chan struct{})}
+		dr.dnsClient = se
+		et := &expiringTimers{expiring: 1, started: started}
+		dr.after = et.after
+		// Latency selection tries the servers in the order listed.
+		test.AssertNotError(t, dr.SetServerSelection(ServerSelectionLatency), "Couldn't select by latency")
+		dr.EscalateTimeouts(tc.schedule)
+		dr.SetServerTimeouts(map[string]time.Duration{"fast:53": 100 * time.Millisecond, "slow:53": 3 * time.Second})
+
+		_, _, err := dr.LookupTXT(context.Background(), "example.com")
+		close(se.release)
+		test.AssertNotError(t, err, "Lookup should succeed on the slow server")
+		test.AssertDeepEquals(t, et.durations, tc.durations)
+		test.AssertEquals(t, dr.selector.averages["fast:53"], 100*time.Millisecond)
+	}
+
+	// Servers without a timeout of their own have no try timer.
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"other:53"}, testStats, clock.NewFake(), 1)
+	dr.SetServerTimeouts(map[string]time.Duration{"fast:53": 100 * time.Millisecond})
+	test.Assert(t, dr.tryTimer(1, "other:53") == nil, "Unlisted server has a try timer")
+	test.AssertEquals(t, dr.serverTimeout("other:53"), 10*time.Second)
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"errors"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// ErrMalformedHeader is returned for responses whose header is malformed,
+// unless LenientHeaders is set.
+var ErrMalformedHeader = errors.New("DNS response has a malformed header")
+
+// checkHeader verifies that the header of r is that of a well-formed
+// response: the QR bit is set and the reserved Z bit is clear (RFC 1035
+// section 4.1.1).
+func checkHeader(r *dns.Msg) error {
+	if !r.Response || r.Zero {
+		return ErrMalformedHeader
+	}
+	return nil
+}
+
+// LenientHeaders makes the resolver accept responses with malformed
+// headers, as long as their records can be parsed, rather than rejecting
+// them. They are counted as MalformedHeaders either way. Since a malformed
+// header suggests a broken or spoofing resolver, rejecting them is the
+// default.
+func (dnsResolver *DNSResolverImpl) LenientHeaders() {
+	dnsResolver.lenientHeaders = true
+}
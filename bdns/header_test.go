@@ -0,0 +1,64 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/metrics"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// malformedHeaderExchanger answers CAA queries with a single issue record,
+// in a response whose header has the QR bit clear, or the Z bit set if zero
+// is true.
+type malformedHeaderExchanger struct {
+	zero bool
+}
+
+func (mhe malformedHeaderExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	if mhe.zero {
+		r.Zero = true
+	} else {
+		r.Response = false
+	}
+	r.Answer = append(r.Answer, &dns.CAA{
+		Hdr:   dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+		Tag:   "issue",
+		Value: "letsencrypt.org",
+	})
+	return r, time.Millisecond, nil
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	stats := mocks.NewStatter()
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, metrics.NewStatsdScope(&stats, "fakesvc"), clock.NewFake(), 1)
+
+	// By default, responses without the QR bit or with the Z bit set are
+	// rejected.
+	for _, zero := range []bool{false, true} {
+		dr.dnsClient = malformedHeaderExchanger{zero: zero}
+		_, _, err := dr.LookupCAA(context.Background(), "example.com")
+		test.AssertError(t, err, "Malformed header should fail the lookup")
+		test.AssertEquals(t, err.(*dnsError).underlying, ErrMalformedHeader)
+	}
+	test.AssertEquals(t, stats.Counters["fakesvc.CAA.MalformedHeaders"], int64(2))
+
+	// Leniently, their records are used.
+	dr.LenientHeaders()
+	dr.dnsClient = malformedHeaderExchanger{}
+	caas, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Lenient lookup failed")
+	test.AssertEquals(t, len(caas), 1)
+	test.AssertEquals(t, stats.Counters["fakesvc.CAA.MalformedHeaders"], int64(3))
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// dnsMessageType is the media type for DNS wire-format messages (RFC 8484).
+const dnsMessageType = "application/dns-message"
+
+// httpsExchanger sends DNS queries over HTTPS as described in RFC 8484. The
+// server address passed to Exchange is the URL of the DoH endpoint.
+type httpsExchanger struct {
+	client *http.Client
+}
+
+func (he *httpsExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest("POST", a, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := he.client.Do(req)
+	if err != nil {
+		// Surface network errors directly so that temporary ones are
+		// retried like any other transport's.
+		if urlErr, ok := err.(*url.Error); ok {
+			if opErr, ok := urlErr.Err.(*net.OpError); ok {
+				return nil, 0, opErr
+			}
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH server returned HTTP status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, 0, fmt.Errorf("DoH server returned unexpected content type %q", ct)
+	}
+	// A DNS message is at most 65535 bytes.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) > dns.MaxMsgSize {
+		return nil, 0, fmt.Errorf("DoH response exceeds %d bytes", dns.MaxMsgSize)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	if r.Id != m.Id {
+		return nil, 0, dns.ErrId
+	}
+	return r, time.Since(start), nil
+}
+
+// UseHTTPS switches the resolver to sending all queries over HTTPS with the
+// given client. The resolver's servers must then be DoH endpoint URLs, such
+// as "https://resolver.example/dns-query".
+func (dnsResolver *DNSResolverImpl) UseHTTPS(client *http.Client) {
+	dnsResolver.dnsClient = &httpsExchanger{client: client}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// dohHandler answers DoH queries for big.example with more CAA records than
+// fit in a UDP response, and everything else with mockDNSQuery.
+func dohHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		test.AssertNotError(t, err, "Failed to read DoH request")
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, "bad message", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		dw := &httpResponseWriter{w: w}
+		if req.Question[0].Name != "big.example." {
+			mockDNSQuery(dw, req)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		for i := 0; i < 100; i++ {
+			resp.Answer = append(resp.Answer, &dns.CAA{
+				Hdr:   dns.RR_Header{Name: "big.example.", Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+				Tag:   "issue",
+				Value: fmt.Sprintf("ca%d.example; account=%s", i, strings.Repeat("x", 40)),
+			})
+		}
+		test.AssertNotError(t, dw.WriteMsg(resp), "Failed to write DoH response")
+	}
+}
+
+// httpResponseWriter is a dns.ResponseWriter that writes messages as the
+// body of an HTTP response.
+type httpResponseWriter struct {
+	dns.ResponseWriter
+	w http.ResponseWriter
+}
+
+func (hw *httpResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = hw.w.Write(packed)
+	return err
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(dohHandler(t))
+	defer srv.Close()
+
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{srv.URL + "/dns-query"}, testStats, clock.NewFake(), 1)
+	dr.UseHTTPS(srv.Client())
+
+	caas, _, err := dr.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertNotError(t, err, "CAA lookup over DoH failed")
+	test.AssertEquals(t, len(caas), 1)
+
+	caas, _, err = dr.LookupCAA(context.Background(), "big.example")
+	test.AssertNotError(t, err, "Large CAA lookup over DoH failed")
+	test.AssertEquals(t, len(caas), 100)
+}
+
+func TestDNSOverHTTPSErrors(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer srv.Close()
+
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{srv.URL}, testStats, clock.NewFake(), 1)
+	dr.UseHTTPS(srv.Client())
+	_, _, err := dr.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertError(t, err, "Non-DNS response should be rejected")
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"sync/atomic"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/metrics"
+)
+
+// queryLimiter bounds the queries a resolver has in flight at once, across
+// every lookup made with it. Queries beyond the limit wait for a slot.
+type queryLimiter struct {
+	slots   chan struct{}
+	waiting int64
+}
+
+// LimitQueries caps the DNS queries the resolver has in flight at once at
+// max, however many lookups and checks are running concurrently. Further
+// queries queue until one finishes, or their context is done. The queue
+// depth is reported as the QueryQueueDepth gauge. A try abandoned after its
+// timeout keeps its slot until the exchange actually ends.
+func (dnsResolver *DNSResolverImpl) LimitQueries(max int) {
+	dnsResolver.limiter = &queryLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire waits for a free slot, or for ctx to be done.
+func (l *queryLimiter) acquire(ctx context.Context, stats metrics.Scope) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	stats.Inc("QueriesQueued", 1)
+	stats.Gauge("QueryQueueDepth", atomic.AddInt64(&l.waiting, 1))
+	defer func() {
+		stats.Gauge("QueryQueueDepth", atomic.AddInt64(&l.waiting, -1))
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (l *queryLimiter) release() {
+	<-l.slots
+}
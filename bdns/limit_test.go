@@ -0,0 +1,89 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// heldExchanger holds every query until release is closed, keeping track of
+// how many are in flight at once.
+type heldExchanger struct {
+	sync.Mutex
+	inflight, max int
+	release       chan struct{}
+}
+
+func (he *heldExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	he.Lock()
+	he.inflight++
+	if he.inflight > he.max {
+		he.max = he.inflight
+	}
+	he.Unlock()
+	<-he.release
+	he.Lock()
+	he.inflight--
+	he.Unlock()
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, time.Millisecond, nil
+}
+
+func TestLimitQueries(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	he := &heldExchanger{release: make(chan struct{})}
+	dr.dnsClient = he
+	dr.LimitQueries(2)
+
+	const lookups = 6
+	var wg sync.WaitGroup
+	errs := make(chan error, lookups)
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := dr.LookupCAA(context.Background(), "example.com")
+			errs <- err
+		}()
+	}
+
+	// Two queries reach the resolver, and the rest queue behind them.
+	held := func() int {
+		he.Lock()
+		defer he.Unlock()
+		return he.inflight
+	}
+	for atomic.LoadInt64(&dr.limiter.waiting) < lookups-2 || held() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(he.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		test.AssertNotError(t, err, "Queued lookup failed")
+	}
+	test.AssertEquals(t, he.max, 2)
+	test.AssertEquals(t, atomic.LoadInt64(&dr.limiter.waiting), int64(0))
+
+	// A query that can't get a slot gives up when its context is done.
+	for i := 0; i < 2; i++ {
+		dr.limiter.slots <- struct{}{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := dr.LookupCAA(ctx, "example.com")
+	test.AssertError(t, err, "Lookup without a free slot should time out")
+}
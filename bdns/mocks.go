@@ -74,12 +74,41 @@ func (mock *MockDNSResolver) LookupHost(_ context.Context, hostname string) ([]n
 }
 
 // LookupCAA returns mock records for use in tests.
-func (mock *MockDNSResolver) LookupCAA(_ context.Context, domain string) ([]*dns.CAA, error) {
+func (mock *MockDNSResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
 	var results []*dns.CAA
 	var record dns.CAA
+	if strings.TrimRight(domain, ".") == "servfail-empty.com" {
+		// A server failure, which LookupCAA reports as no records.
+		CAAAnswersFrom(ctx).record(domain, false)
+		return nil, nil, nil
+	}
+	CAAAnswersFrom(ctx).record(domain, true)
+	if trimmed := strings.TrimRight(domain, "."); trimmed == "nxdomain.com" || strings.HasSuffix(trimmed, ".nxdomain.com") {
+		// Neither nxdomain.com nor any name under it exists.
+		CAAAnswersFrom(ctx).recordNameError(domain)
+		return nil, nil, nil
+	}
+	if strings.HasSuffix(strings.TrimRight(domain, "."), ".wildcard-caa.com") {
+		// Synthesized from a *.wildcard-caa.com record.
+		record.Hdr = dns.RR_Header{Name: "*.wildcard-caa.com.", Rrtype: dns.TypeCAA, Class: dns.ClassINET}
+		record.Tag = "issue"
+		record.Value = "letsencrypt.org"
+		return append(results, &record), nil, nil
+	}
+	if strings.HasSuffix(strings.TrimRight(domain, "."), ".dname.com") {
+		// Redirected by a DNAME at dname.com to dname-target.com, which has
+		// no CAA records at the redirected name itself.
+		return nil, []*dns.DNAME{mockDNAME("dname.com.", "dname-target.com.")}, nil
+	}
+	if strings.HasSuffix(strings.TrimRight(domain, "."), ".dname-loop-a.com") {
+		return nil, []*dns.DNAME{mockDNAME("dname-loop-a.com.", "dname-loop-b.com.")}, nil
+	}
+	if strings.HasSuffix(strings.TrimRight(domain, "."), ".dname-loop-b.com") {
+		return nil, []*dns.DNAME{mockDNAME("dname-loop-b.com.", "dname-loop-a.com.")}, nil
+	}
 	switch strings.TrimRight(domain, ".") {
 	case "caa-timeout.com":
-		return nil, &dnsError{dns.TypeCAA, "always.timeout", MockTimeoutError(), -1}
+		return nil, nil, &dnsError{dns.TypeCAA, "always.timeout", MockTimeoutError(), -1}
 	case "reserved.com":
 		record.Tag = "issue"
 		record.Value = "symantec.com"
@@ -89,15 +118,15 @@ func (mock *MockDNSResolver) LookupCAA(_ context.Context, domain string) ([]*dns
 		record.Tag = "issue"
 		record.Value = "symantec.com"
 		results = append(results, &record)
-	case "present.com", "present.servfail.com":
+	case "present.com", "present.servfail.com", "present.servfail-empty.com":
 		record.Tag = "issue"
 		record.Value = "letsencrypt.org"
 		results = append(results, &record)
 	case "com":
 		// com has no CAA records.
-		return nil, nil
+		return nil, nil, nil
 	case "servfail.com", "servfail.present.com":
-		return results, fmt.Errorf("SERVFAIL")
+		return results, nil, fmt.Errorf("SERVFAIL")
 	case "multi-crit-present.com":
 		record.Flag = 1
 		record.Tag = "issue"
@@ -106,7 +135,7 @@ func (mock *MockDNSResolver) LookupCAA(_ context.Context, domain string) ([]*dns
 		secondRecord := record
 		secondRecord.Value = "letsencrypt.org"
 		results = append(results, &secondRecord)
-	case "unknown-critical.com":
+	case "unknown-critical.com", "unknown-critical.present.com":
 		record.Flag = 128
 		record.Tag = "foo"
 		record.Value = "bar"
@@ -121,6 +150,30 @@ func (mock *MockDNSResolver) LookupCAA(_ context.Context, domain string) ([]*dns
 		record.Tag = "foo"
 		record.Value = "bar"
 		results = append(results, &record)
+	case "iodef-only.com":
+		record.Tag = "iodef"
+		record.Value = "mailto:security@iodef-only.com"
+		results = append(results, &record)
+		secondRecord := record
+		secondRecord.Tag = "foo"
+		secondRecord.Value = "bar"
+		results = append(results, &secondRecord)
+	case "wildcard-deny.com":
+		record.Tag = "issue"
+		record.Value = "letsencrypt.org"
+		results = append(results, &record)
+		secondRecord := record
+		secondRecord.Tag = "issuewild"
+		secondRecord.Value = ";"
+		results = append(results, &secondRecord)
+	case "blank.com":
+		record.Tag = "iodef"
+		record.Value = "  "
+		results = append(results, &record)
+	case "blank-issue.com":
+		record.Tag = "issue"
+		record.Value = " "
+		results = append(results, &record)
 	case "present-with-parameter.com":
 		record.Tag = "issue"
 		record.Value = "  letsencrypt.org  ;foo=bar;baz=bar"
@@ -129,8 +182,35 @@ func (mock *MockDNSResolver) LookupCAA(_ context.Context, domain string) ([]*dns
 		record.Tag = "issue"
 		record.Value = ";"
 		results = append(results, &record)
+	case "validationmethods-http.com":
+		record.Tag = "issue"
+		record.Value = "letsencrypt.org; validationmethods=http-01"
+		results = append(results, &record)
+	case "validationmethods-spaces.com":
+		record.Tag = "issue"
+		record.Value = "letsencrypt.org; validationmethods= HTTP-01 , tls-sni-01 "
+		results = append(results, &record)
+	case "dname.com":
+		record.Tag = "issue"
+		record.Value = "letsencrypt.org"
+		results = append(results, &record)
+	case "dname-target.com":
+		record.Tag = "issue"
+		record.Value = "symantec.com"
+		results = append(results, &record)
+	case "validationmethods-dns.com":
+		record.Tag = "issue"
+		record.Value = "letsencrypt.org; validationmethods=dns-01"
+		results = append(results, &record)
+	}
+	return results, nil, nil
+}
+
+func mockDNAME(owner, target string) *dns.DNAME {
+	return &dns.DNAME{
+		Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeDNAME, Class: dns.ClassINET},
+		Target: target,
 	}
-	return results, nil
 }
 
 // LookupMX is a mock
@@ -0,0 +1,67 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"io"
+	"strings"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// caaOverride holds CAA answers loaded from a local zone file. Every owner
+// name in the file is answered from it, so a name with other records but no
+// CAA records is answered as having none.
+type caaOverride struct {
+	names   map[string]bool
+	records map[string][]*dns.CAA
+}
+
+// LoadCAAOverride reads a zone file whose records take the place of DNS for
+// CAA lookups. Lookups for any owner name that appears in the file are
+// answered from it alone; all other names are looked up as usual. filename
+// is used only in error messages.
+func (dnsResolver *DNSResolverImpl) LoadCAAOverride(r io.Reader, filename string) error {
+	override := &caaOverride{
+		names:   make(map[string]bool),
+		records: make(map[string][]*dns.CAA),
+	}
+	var parseErr error
+	for token := range dns.ParseZone(r, ".", filename) {
+		// Keep draining the channel after an error so that the parser
+		// finishes.
+		if parseErr != nil {
+			continue
+		}
+		if token.Error != nil {
+			parseErr = token.Error
+			continue
+		}
+		name := strings.ToLower(token.RR.Header().Name)
+		override.names[name] = true
+		if caa, ok := token.RR.(*dns.CAA); ok {
+			override.records[name] = append(override.records[name], caa)
+		}
+	}
+	if parseErr != nil {
+		return parseErr
+	}
+	dnsResolver.caaOverride = override
+	return nil
+}
+
+// lookup returns the overriding CAA records for hostname, and whether the
+// override covers it at all.
+func (o *caaOverride) lookup(hostname string) ([]*dns.CAA, bool) {
+	if o == nil {
+		return nil, false
+	}
+	name := strings.ToLower(dns.Fqdn(hostname))
+	if !o.names[name] {
+		return nil, false
+	}
+	return o.records[name], true
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/test"
+)
+
+const overrideZone = `
+$ORIGIN example.org.
+$TTL 300
+@           IN CAA 0 issue "ca.example.net"
+@           IN CAA 0 iodef "mailto:security@example.org"
+www         IN A   192.0.2.1
+`
+
+func TestCAAOverride(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	re := &recordingExchanger{}
+	dr.dnsClient = re
+	err := dr.LoadCAAOverride(strings.NewReader(overrideZone), "override.zone")
+	test.AssertNotError(t, err, "Failed to load override zone")
+
+	caas, _, err := dr.LookupCAA(context.Background(), "Example.ORG")
+	test.AssertNotError(t, err, "Overridden lookup failed")
+	test.AssertEquals(t, len(caas), 2)
+	test.AssertEquals(t, caas[0].Value, "ca.example.net")
+
+	// A name with other records in the file has no CAA records.
+	caas, _, err = dr.LookupCAA(context.Background(), "www.example.org")
+	test.AssertNotError(t, err, "Overridden lookup failed")
+	test.AssertEquals(t, len(caas), 0)
+	test.AssertEquals(t, len(re.servers), 0)
+
+	// Other names go to DNS.
+	_, _, err = dr.LookupCAA(context.Background(), "other.example.org")
+	test.AssertNotError(t, err, "Lookup failed")
+	test.AssertEquals(t, len(re.servers), 1)
+}
+
+func TestCAAOverrideParseError(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	err := dr.LoadCAAOverride(strings.NewReader("example.org. IN CAA bogus\n"), "bad.zone")
+	test.AssertError(t, err, "Malformed zone should fail to load")
+	test.Assert(t, dr.caaOverride == nil, "Failed load shouldn't install an override")
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/metrics"
+)
+
+const (
+	// pcapMagic marks a pcap file with microsecond timestamps, written in
+	// little-endian byte order.
+	pcapMagic = 0xa1b2c3d4
+	// pcapLinkTypeRaw is LINKTYPE_RAW: each packet starts with an IP header.
+	pcapLinkTypeRaw = 101
+	// pcapSnapLen is the longest packet we record, which covers any DNS
+	// message with its IPv4 and UDP headers.
+	pcapSnapLen = 65535
+
+	pcapFileHeaderLen   = 24
+	pcapRecordHeaderLen = 16
+	ipv4HeaderLen       = 20
+	udpHeaderLen        = 8
+
+	// pcapClientPort is the source port recorded for our queries.
+	pcapClientPort = 53000
+)
+
+// PacketCapture writes DNS messages to a pcap file, as UDP packets between
+// us and the resolver, so that tools like tcpdump and Wireshark can read
+// them whatever transport was actually used. When the file would grow past
+// its size cap, it is renamed with a ".1" suffix, replacing any earlier
+// one, and a new file is started. A PacketCapture may be shared by several
+// resolvers.
+type PacketCapture struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+	size     int64
+}
+
+// NewPacketCapture creates, or truncates, the pcap file at path. If maxBytes
+// is positive, the file is rotated before it would grow past it.
+func NewPacketCapture(path string, maxBytes int64) (*PacketCapture, error) {
+	pw := &PacketCapture{path: path, maxBytes: maxBytes}
+	if err := pw.open(); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// open starts a new file at pw.path, with the pcap file header.
+func (pw *PacketCapture) open() error {
+	f, err := os.OpenFile(pw.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, pcapFileHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	pw.f = f
+	pw.size = pcapFileHeaderLen
+	return nil
+}
+
+// rotate moves the current file aside and starts a new one.
+func (pw *PacketCapture) rotate() error {
+	pw.f.Close()
+	if err := os.Rename(pw.path, pw.path+".1"); err != nil {
+		return err
+	}
+	return pw.open()
+}
+
+// write records msg as a UDP packet from src to dst, sent at t. Messages
+// that can't be packed are skipped.
+func (pw *PacketCapture) write(t time.Time, msg *dns.Msg, src, dst net.IP, srcPort, dstPort int) error {
+	payload, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	origLen := ipv4HeaderLen + udpHeaderLen + len(payload)
+	if len(payload) > pcapSnapLen-ipv4HeaderLen-udpHeaderLen {
+		payload = payload[:pcapSnapLen-ipv4HeaderLen-udpHeaderLen]
+	}
+	packet := make([]byte, pcapRecordHeaderLen+ipv4HeaderLen+udpHeaderLen+len(payload))
+	record := packet[:pcapRecordHeaderLen]
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)-pcapRecordHeaderLen))
+	binary.LittleEndian.PutUint32(record[12:], uint32(origLen))
+
+	ip := packet[pcapRecordHeaderLen : pcapRecordHeaderLen+ipv4HeaderLen]
+	ip[0] = 0x45 // IPv4, five-word header
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)-pcapRecordHeaderLen))
+	ip[8] = 64 // TTL
+	ip[9] = 17 // UDP
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip))
+
+	udp := packet[pcapRecordHeaderLen+ipv4HeaderLen : pcapRecordHeaderLen+ipv4HeaderLen+udpHeaderLen]
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLen+len(payload)))
+	// A zero checksum means none was computed, which IPv4 allows.
+	copy(packet[pcapRecordHeaderLen+ipv4HeaderLen+udpHeaderLen:], payload)
+
+	pw.Lock()
+	defer pw.Unlock()
+	if pw.maxBytes > 0 && pw.size+int64(len(packet)) > pw.maxBytes && pw.size > pcapFileHeaderLen {
+		if err := pw.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := pw.f.Write(packet)
+	pw.size += int64(n)
+	return err
+}
+
+// ipv4Checksum returns the checksum of an IPv4 header whose checksum field
+// is zero.
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// captureExchanger records each query sent with the wrapped exchanger, and
+// each response received, with a PacketCapture. Failures to write are
+// counted as CaptureErrors.
+type captureExchanger struct {
+	exchanger
+	w     *PacketCapture
+	clk   clock.Clock
+	stats metrics.Scope
+}
+
+func (ce *captureExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	client := net.IPv4(127, 0, 0, 1)
+	server := net.IPv4zero
+	serverPort := 53
+	if host, port, err := net.SplitHostPort(a); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			server = ip
+		}
+		if p, err := net.LookupPort("udp", port); err == nil {
+			serverPort = p
+		}
+	}
+	sent := ce.clk.Now()
+	if err := ce.w.write(sent, m, client, server, pcapClientPort, serverPort); err != nil {
+		ce.stats.Inc("CaptureErrors", 1)
+	}
+	r, rtt, err := ce.exchanger.Exchange(m, a)
+	if err == nil && r != nil {
+		if err := ce.w.write(sent.Add(rtt), r, server, client, serverPort, pcapClientPort); err != nil {
+			ce.stats.Inc("CaptureErrors", 1)
+		}
+	}
+	return r, rtt, err
+}
+
+// CapturePackets writes every DNS query the resolver sends, and every
+// response it receives, to pc, for offline analysis with standard tools.
+// Messages are recorded as UDP packets between 127.0.0.1 and the resolver,
+// whichever transport carried them. It should be called after the
+// transport is chosen, e.g. after UseTLS or UseUDP.
+func (dnsResolver *DNSResolverImpl) CapturePackets(pc *PacketCapture) {
+	dnsResolver.dnsClient = &captureExchanger{
+		exchanger: dnsResolver.dnsClient,
+		w:         pc,
+		clk:       dnsResolver.clk,
+		stats:     dnsResolver.stats,
+	}
+}
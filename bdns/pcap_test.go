@@ -0,0 +1,95 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// readPCAP parses the DNS messages out of a pcap file written by
+// PacketCapture.
+func readPCAP(t *testing.T, path string) []*dns.Msg {
+	b, err := ioutil.ReadFile(path)
+	test.AssertNotError(t, err, "Couldn't read capture")
+	test.Assert(t, len(b) >= pcapFileHeaderLen, "Capture is missing its header")
+	test.AssertEquals(t, binary.LittleEndian.Uint32(b), uint32(pcapMagic))
+	test.AssertEquals(t, binary.LittleEndian.Uint32(b[20:]), uint32(pcapLinkTypeRaw))
+	b = b[pcapFileHeaderLen:]
+	var msgs []*dns.Msg
+	for len(b) > 0 {
+		test.Assert(t, len(b) >= pcapRecordHeaderLen, "Truncated record header")
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		packet := b[pcapRecordHeaderLen : pcapRecordHeaderLen+n]
+		test.AssertEquals(t, packet[9], byte(17))
+		test.AssertEquals(t, ipv4Checksum(packet[:ipv4HeaderLen]), uint16(0))
+		msg := new(dns.Msg)
+		err := msg.Unpack(packet[ipv4HeaderLen+udpHeaderLen:])
+		test.AssertNotError(t, err, "Couldn't parse captured message")
+		msgs = append(msgs, msg)
+		b = b[pcapRecordHeaderLen+n:]
+	}
+	return msgs
+}
+
+func TestCapturePackets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	test.AssertNotError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns.pcap")
+
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	dr.dnsClient = chainExchanger{}
+	pc, err := NewPacketCapture(path, 0)
+	test.AssertNotError(t, err, "NewPacketCapture failed")
+	dr.CapturePackets(pc)
+
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "LookupCAA failed")
+	msgs := readPCAP(t, path)
+	test.AssertEquals(t, len(msgs), 2)
+	test.Assert(t, !msgs[0].Response, "First message should be the query")
+	test.AssertEquals(t, msgs[0].Question[0].Name, "example.com.")
+	test.Assert(t, msgs[1].Response, "Second message should be the response")
+	test.AssertEquals(t, msgs[1].Id, msgs[0].Id)
+	test.AssertEquals(t, msgs[1].Answer[0].(*dns.CAA).Value, "letsencrypt.org")
+}
+
+func TestCapturePacketsRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	test.AssertNotError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns.pcap")
+
+	// The cap leaves room for a single query and its response.
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	dr.dnsClient = chainExchanger{}
+	pc, err := NewPacketCapture(path, 250)
+	test.AssertNotError(t, err, "NewPacketCapture failed")
+	dr.CapturePackets(pc)
+
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		_, _, err = dr.LookupCAA(context.Background(), name)
+		test.AssertNotError(t, err, "LookupCAA failed")
+	}
+	rotated := readPCAP(t, path+".1")
+	current := readPCAP(t, path)
+	test.Assert(t, len(rotated) > 0, "Rotated capture should have messages")
+	test.AssertEquals(t, len(rotated)+len(current), 4)
+	test.AssertEquals(t, current[len(current)-1].Question[0].Name, "b.example.com.")
+	info, err := os.Stat(path)
+	test.AssertNotError(t, err, "Couldn't stat capture")
+	test.Assert(t, info.Size() <= 250, "Capture should stay under its cap")
+}
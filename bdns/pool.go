@@ -0,0 +1,179 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// maxIdleConns bounds the idle connections kept open to each server.
+const maxIdleConns = 8
+
+// pooledConn is a connection to a resolver along with the number of queries
+// sent over it.
+type pooledConn struct {
+	net.Conn
+	queries int
+}
+
+// pooledExchanger sends queries over stream connections (TCP or TLS) that
+// are kept open between queries, one query at a time per connection.
+// Connections the server has closed are found either by health probes or
+// by the next query sent over them, which is then retried on a fresh
+// connection.
+type pooledExchanger struct {
+	sync.Mutex
+	dial    func(a string) (net.Conn, error)
+	timeout time.Duration
+	// maxQueries is the number of queries after which a connection is
+	// retired. Zero means no limit.
+	maxQueries int
+	idle       map[string][]*pooledConn
+	stop       chan struct{}
+}
+
+func newPooledExchanger(dial func(string) (net.Conn, error), timeout time.Duration, maxQueries int) *pooledExchanger {
+	return &pooledExchanger{
+		dial:       dial,
+		timeout:    timeout,
+		maxQueries: maxQueries,
+		idle:       make(map[string][]*pooledConn),
+		stop:       make(chan struct{}),
+	}
+}
+
+func (pe *pooledExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	if conn := pe.get(a); conn != nil {
+		r, err := pe.exchangeOn(conn, m)
+		if err == nil {
+			pe.put(a, conn)
+			return r, time.Since(start), nil
+		}
+		conn.Close()
+		// A timeout means the server is slow rather than that the
+		// connection went away, so there's no point asking again.
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, 0, err
+		}
+	}
+	netConn, err := pe.dial(a)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn := &pooledConn{Conn: netConn}
+	r, err := pe.exchangeOn(conn, m)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	pe.put(a, conn)
+	return r, time.Since(start), nil
+}
+
+func (pe *pooledExchanger) exchangeOn(conn *pooledConn, m *dns.Msg) (*dns.Msg, error) {
+	conn.queries++
+	return exchangeStream(conn, m, pe.timeout)
+}
+
+// get takes the most recently used idle connection to a, if there is one.
+func (pe *pooledExchanger) get(a string) *pooledConn {
+	pe.Lock()
+	defer pe.Unlock()
+	conns := pe.idle[a]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	pe.idle[a] = conns[:len(conns)-1]
+	return conn
+}
+
+// put returns conn to the idle connections to a, unless it has served its
+// last query or there are enough idle connections already.
+func (pe *pooledExchanger) put(a string, conn *pooledConn) {
+	pe.Lock()
+	defer pe.Unlock()
+	if (pe.maxQueries > 0 && conn.queries >= pe.maxQueries) || len(pe.idle[a]) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	pe.idle[a] = append(pe.idle[a], conn)
+}
+
+// probe checks the idle connections every interval until close is called.
+func (pe *pooledExchanger) probe(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pe.stop:
+			return
+		case <-ticker.C:
+			pe.probeIdle()
+		}
+	}
+}
+
+// probeIdle sends a cheap query over each idle connection, closing the ones
+// that fail so that real queries never hit them.
+func (pe *pooledExchanger) probeIdle() {
+	pe.Lock()
+	idle := pe.idle
+	pe.idle = make(map[string][]*pooledConn)
+	pe.Unlock()
+	for a, conns := range idle {
+		for _, conn := range conns {
+			m := new(dns.Msg)
+			m.SetQuestion(".", dns.TypeNS)
+			if _, err := pe.exchangeOn(conn, m); err != nil {
+				conn.Close()
+				continue
+			}
+			pe.put(a, conn)
+		}
+	}
+}
+
+// close stops the health probes and closes the idle connections.
+func (pe *pooledExchanger) close() {
+	close(pe.stop)
+	pe.Lock()
+	defer pe.Unlock()
+	for _, conns := range pe.idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	pe.idle = make(map[string][]*pooledConn)
+}
+
+// PoolConnections makes the resolver keep its TCP or TLS connections open
+// for reuse across queries, retiring each after maxQueries queries (zero
+// for no limit). If probeInterval is nonzero, idle connections are checked
+// that often with a cheap query, and closed if it fails. It must be called
+// after UseTLS, if that is used, and before UseCookies.
+func (dnsResolver *DNSResolverImpl) PoolConnections(maxQueries int, probeInterval time.Duration) error {
+	var pe *pooledExchanger
+	switch client := dnsResolver.dnsClient.(type) {
+	case *tlsExchanger:
+		pe = newPooledExchanger(client.dial, client.timeout, maxQueries)
+	case *tcpExchanger:
+		pe = newPooledExchanger(client.dial, client.timeout, maxQueries)
+	default:
+		return errors.New("connection pooling needs the TCP or TLS transport")
+	}
+	dnsResolver.dnsClient = pe
+	if probeInterval > 0 {
+		go pe.probe(probeInterval)
+	}
+	return nil
+}
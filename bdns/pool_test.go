@@ -0,0 +1,150 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// streamServer answers DNS queries over TCP with mockDNSQuery, keeping
+// track of the connections it has accepted.
+type streamServer struct {
+	sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+}
+
+func newStreamServer(t *testing.T) *streamServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	test.AssertNotError(t, err, "Failed to listen")
+	ss := &streamServer{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ss.Lock()
+			ss.conns = append(ss.conns, conn)
+			ss.Unlock()
+			go ss.serve(conn)
+		}
+	}()
+	return ss
+}
+
+func (ss *streamServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+		w := &streamResponseWriter{conn: conn}
+		mockDNSQuery(w, req)
+	}
+}
+
+// accepted returns the number of connections accepted so far, and the
+// latest of them.
+func (ss *streamServer) accepted() (int, net.Conn) {
+	ss.Lock()
+	defer ss.Unlock()
+	if len(ss.conns) == 0 {
+		return 0, nil
+	}
+	return len(ss.conns), ss.conns[len(ss.conns)-1]
+}
+
+func TestPoolConnections(t *testing.T) {
+	ss := newStreamServer(t)
+	defer ss.listener.Close()
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{ss.listener.Addr().String()}, testStats, clock.NewFake(), 1)
+	test.AssertNotError(t, dr.PoolConnections(0, 0), "Failed to pool connections")
+	defer dr.dnsClient.(*pooledExchanger).close()
+
+	for i := 0; i < 3; i++ {
+		caas, _, err := dr.LookupCAA(context.Background(), "bracewel.net")
+		test.AssertNotError(t, err, "CAA lookup failed")
+		test.AssertEquals(t, len(caas), 1)
+	}
+	accepted, conn := ss.accepted()
+	test.AssertEquals(t, accepted, 1)
+
+	// Kill the pooled connection behind the resolver's back. The next query
+	// transparently moves to a fresh connection.
+	conn.Close()
+	caas, _, err := dr.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertNotError(t, err, "CAA lookup after the connection died failed")
+	test.AssertEquals(t, len(caas), 1)
+	accepted, _ = ss.accepted()
+	test.AssertEquals(t, accepted, 2)
+}
+
+func TestPoolConnectionsMaxQueries(t *testing.T) {
+	ss := newStreamServer(t)
+	defer ss.listener.Close()
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{ss.listener.Addr().String()}, testStats, clock.NewFake(), 1)
+	test.AssertNotError(t, dr.PoolConnections(2, 0), "Failed to pool connections")
+	defer dr.dnsClient.(*pooledExchanger).close()
+
+	for i := 0; i < 5; i++ {
+		_, _, err := dr.LookupCAA(context.Background(), "bracewel.net")
+		test.AssertNotError(t, err, "CAA lookup failed")
+	}
+	accepted, _ := ss.accepted()
+	test.AssertEquals(t, accepted, 3)
+}
+
+func TestPoolConnectionsProbes(t *testing.T) {
+	ss := newStreamServer(t)
+	defer ss.listener.Close()
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{ss.listener.Addr().String()}, testStats, clock.NewFake(), 1)
+	test.AssertNotError(t, dr.PoolConnections(0, 5*time.Millisecond), "Failed to pool connections")
+	pe := dr.dnsClient.(*pooledExchanger)
+	defer pe.close()
+
+	_, _, err := dr.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertNotError(t, err, "CAA lookup failed")
+	_, conn := ss.accepted()
+	conn.Close()
+
+	// The probes find the dead connection and drop it before any real
+	// query is sent over it.
+	deadline := time.Now().Add(time.Second)
+	for pe.get(ss.listener.Addr().String()) != nil {
+		test.Assert(t, time.Now().Before(deadline), "Dead connection was never evicted")
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, _, err = dr.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertNotError(t, err, "CAA lookup failed")
+	accepted, _ := ss.accepted()
+	test.AssertEquals(t, accepted, 2)
+}
+
+func TestPoolConnectionsTransport(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{"127.0.0.1:4053"}, testStats, clock.NewFake(), 1)
+	dr.UseHTTPS(nil)
+	test.AssertError(t, dr.PoolConnections(0, 0), "Pooling DoH connections should fail")
+}
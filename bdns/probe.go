@@ -0,0 +1,29 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ProbeCAASupport sends a CAA query for hostname to check that the resolver
+// implements the type, returning an error if it answers NOTIMP, or doesn't
+// answer at all. LookupCAA can't tell a resolver that doesn't implement CAA
+// from a domain without records, so such a resolver would allow issuance
+// for every domain; this lets a VA refuse to start with one instead.
+func (dnsResolver *DNSResolverImpl) ProbeCAASupport(ctx context.Context, hostname string) error {
+	dnsType := dns.TypeCAA
+	r, err := dnsResolver.exchangeOne(ctx, hostname, dnsType, dnsResolver.caaStats)
+	if err != nil {
+		return &dnsError{dnsType, hostname, err, -1}
+	}
+	if r.Rcode == dns.RcodeNotImplemented {
+		dnsResolver.caaStats.Inc("NotImplemented", 1)
+		return &dnsError{dnsType, hostname, nil, r.Rcode}
+	}
+	return nil
+}
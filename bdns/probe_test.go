@@ -0,0 +1,45 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// notImplExchanger answers CAA queries with NOTIMP, like resolvers that
+// predate the type, and every other query normally.
+type notImplExchanger struct{}
+
+func (notImplExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	if m.Question[0].Qtype == dns.TypeCAA {
+		r.Rcode = dns.RcodeNotImplemented
+	}
+	return r, time.Millisecond, nil
+}
+
+func TestProbeCAASupport(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{dnsLoopbackAddr}, testStats, clock.NewFake(), 1)
+	err := dr.ProbeCAASupport(context.Background(), "letsencrypt.org")
+	test.AssertNotError(t, err, "Probe of a resolver that implements CAA failed")
+
+	dr.dnsClient = notImplExchanger{}
+	err = dr.ProbeCAASupport(context.Background(), "letsencrypt.org")
+	test.AssertError(t, err, "Probe of a resolver that doesn't implement CAA succeeded")
+	test.AssertEquals(t, err.Error(), "DNS problem: NOTIMPL looking up CAA for letsencrypt.org")
+
+	// Without the probe, the same resolver looks like it found no records.
+	caas, _, err := dr.LookupCAA(context.Background(), "letsencrypt.org")
+	test.AssertNotError(t, err, "LookupCAA failed")
+	test.AssertEquals(t, len(caas), 0)
+}
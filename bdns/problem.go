@@ -33,6 +33,14 @@ func (d dnsError) Error() string {
 			}
 		} else if d.underlying == context.Canceled || d.underlying == context.DeadlineExceeded {
 			detail = detailDNSTimeout
+		} else if d.underlying == ErrNotAuthenticated {
+			detail = detailNotAuthenticated
+		} else if d.underlying == ErrMalformedResponse || d.underlying == ErrMalformedHeader {
+			detail = detailMalformedResponse
+		} else if d.underlying == ErrDNSSECBogus {
+			detail = detailDNSSECBogus
+		} else if d.underlying == ErrCNAMEChainTooLong {
+			detail = detailCNAMEChainTooLong
 		} else {
 			detail = detailServerFailure
 		}
@@ -48,6 +56,10 @@ func (d dnsError) Error() string {
 const detailDNSTimeout = "query timed out"
 const detailDNSNetFailure = "networking error"
 const detailServerFailure = "server failure at resolver"
+const detailNotAuthenticated = "response not authenticated with DNSSEC"
+const detailMalformedResponse = "malformed response"
+const detailDNSSECBogus = "DNSSEC validation failure"
+const detailCNAMEChainTooLong = "CNAME chain too long"
 
 // ProblemDetailsFromDNSError checks the error returned from Lookup...  methods
 // and tests if the error was an underlying net.OpError or an error caused by
@@ -0,0 +1,125 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/metrics"
+)
+
+// ErrQuorumDisagreement is returned by a QuorumResolver when its resolvers
+// disagree about which issuers a name's CAA records authorize.
+var ErrQuorumDisagreement = errors.New("resolvers disagree about CAA records")
+
+// QuorumResolver looks up CAA records with each of several resolvers, and
+// only returns them if all agree on the issuers they authorize. Other
+// lookups are made with the first resolver alone.
+type QuorumResolver struct {
+	DNSResolver
+	resolvers []DNSResolver
+	stats     metrics.Scope
+}
+
+// NewQuorumResolver returns a QuorumResolver over resolvers, of which there
+// must be at least one.
+func NewQuorumResolver(resolvers []DNSResolver, stats metrics.Scope) *QuorumResolver {
+	return &QuorumResolver{
+		DNSResolver: resolvers[0],
+		resolvers:   resolvers,
+		stats:       stats.NewScope("Quorum"),
+	}
+}
+
+// LookupCAA queries every resolver in parallel and merges their records with
+// mergeCAARecords. DNAME records are taken from the first resolver. Any
+// failed lookup fails the whole lookup.
+func (qr *QuorumResolver) LookupCAA(ctx context.Context, hostname string) ([]*dns.CAA, []*dns.DNAME, error) {
+	type result struct {
+		caas   []*dns.CAA
+		dnames []*dns.DNAME
+		err    error
+	}
+	results := make([]result, len(qr.resolvers))
+	var wg sync.WaitGroup
+	for i, resolver := range qr.resolvers {
+		wg.Add(1)
+		go func(resolver DNSResolver, r *result) {
+			defer wg.Done()
+			r.caas, r.dnames, r.err = resolver.LookupCAA(ctx, hostname)
+		}(resolver, &results[i])
+	}
+	wg.Wait()
+
+	sets := make([][]*dns.CAA, len(results))
+	for i, r := range results {
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		sets[i] = r.caas
+	}
+	merged, err := mergeCAARecords(sets)
+	if err != nil {
+		qr.stats.Inc("Disagreements", 1)
+		return nil, nil, &dnsError{dns.TypeCAA, hostname, err, -1}
+	}
+	return merged, results[0].dnames, nil
+}
+
+// mergeCAARecords combines the CAA record sets that several resolvers
+// returned for the same name. The merge is the union of the sets, without
+// duplicates, in the order records were first seen. Resolvers may order
+// records differently, and some may return records others don't, which is
+// harmless unless it changes the issuers authorized: if the sets differ in
+// their issue or issuewild properties, ErrQuorumDisagreement is returned.
+func mergeCAARecords(sets [][]*dns.CAA) ([]*dns.CAA, error) {
+	var merged []*dns.CAA
+	seen := make(map[string]bool)
+	var issuers string
+	for i, set := range sets {
+		if i == 0 {
+			issuers = issuerKey(set)
+		} else if issuerKey(set) != issuers {
+			return nil, ErrQuorumDisagreement
+		}
+		for _, caa := range set {
+			key := fmt.Sprintf("%d %s %s", caa.Flag, strings.ToLower(caa.Tag), strings.TrimSpace(caa.Value))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, caa)
+		}
+	}
+	return merged, nil
+}
+
+// issuerKey summarizes the issue and issuewild properties of a record set,
+// independently of their order and of repeats, so that sets authorizing
+// the same issuers have the same key.
+func issuerKey(caas []*dns.CAA) string {
+	var properties []string
+	seen := make(map[string]bool)
+	for _, caa := range caas {
+		tag := strings.ToLower(caa.Tag)
+		if tag != "issue" && tag != "issuewild" {
+			continue
+		}
+		property := tag + " " + strings.TrimSpace(caa.Value)
+		if !seen[property] {
+			seen[property] = true
+			properties = append(properties, property)
+		}
+	}
+	sort.Strings(properties)
+	return strings.Join(properties, "\n")
+}
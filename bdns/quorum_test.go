@@ -0,0 +1,81 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"testing"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+func caaRecord(tag, value string) *dns.CAA {
+	return &dns.CAA{
+		Hdr:   dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+		Tag:   tag,
+		Value: value,
+	}
+}
+
+// staticCAAResolver returns the same CAA records for every name.
+type staticCAAResolver struct {
+	MockDNSResolver
+	caas []*dns.CAA
+}
+
+func (sr *staticCAAResolver) LookupCAA(context.Context, string) ([]*dns.CAA, []*dns.DNAME, error) {
+	return sr.caas, nil, nil
+}
+
+func TestMergeCAARecords(t *testing.T) {
+	le := caaRecord("issue", "letsencrypt.org")
+	other := caaRecord("issue", "example.net")
+	iodef := caaRecord("iodef", "mailto:security@example.com")
+
+	// Reordered but equal sets agree.
+	merged, err := mergeCAARecords([][]*dns.CAA{{le, other}, {other, caaRecord("ISSUE", " letsencrypt.org ")}})
+	test.AssertNotError(t, err, "Reordered sets should agree")
+	test.AssertDeepEquals(t, merged, []*dns.CAA{le, other})
+
+	// So do sets that only differ in properties that don't name issuers,
+	// which are merged.
+	merged, err = mergeCAARecords([][]*dns.CAA{{le}, {le, iodef}})
+	test.AssertNotError(t, err, "Sets differing in iodef should agree")
+	test.AssertDeepEquals(t, merged, []*dns.CAA{le, iodef})
+
+	// Differing issuer sets disagree, including supersets.
+	for _, sets := range [][][]*dns.CAA{
+		{{le}, {other}},
+		{{le}, {le, other}},
+		{{le}, {le, caaRecord("issuewild", ";")}},
+		{{le}, nil},
+	} {
+		_, err = mergeCAARecords(sets)
+		test.AssertEquals(t, err, ErrQuorumDisagreement)
+	}
+}
+
+func TestQuorumResolver(t *testing.T) {
+	le := caaRecord("issue", "letsencrypt.org")
+	other := caaRecord("issue", "example.net")
+	first := &staticCAAResolver{caas: []*dns.CAA{le, other}}
+	second := &staticCAAResolver{caas: []*dns.CAA{other, le}}
+	qr := NewQuorumResolver([]DNSResolver{first, second}, testStats)
+
+	caas, _, err := qr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Agreeing resolvers should return records")
+	test.AssertDeepEquals(t, caas, []*dns.CAA{le, other})
+
+	second.caas = []*dns.CAA{le}
+	_, _, err = qr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Disagreeing resolvers should fail the lookup")
+	test.AssertEquals(t, err.(*dnsError).underlying, ErrQuorumDisagreement)
+
+	// Other lookups go to the first resolver.
+	_, err = qr.LookupHost(context.Background(), "example.com")
+	test.AssertNotError(t, err, "LookupHost failed")
+}
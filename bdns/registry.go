@@ -0,0 +1,75 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+
+	"github.com/letsencrypt/boulder/metrics"
+)
+
+// ResolverConfig holds the settings passed to a ResolverFactory.
+type ResolverConfig struct {
+	Servers  []string
+	Timeout  time.Duration
+	MaxTries int
+	Stats    metrics.Scope
+	Clock    clock.Clock
+}
+
+// ResolverFactory constructs a DNSResolver from config. Registered factories
+// let operators substitute their own resolver, such as one backed by an
+// internal DNS proxy, for DNSResolverImpl.
+type ResolverFactory func(config ResolverConfig) (DNSResolver, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]ResolverFactory)
+)
+
+// RegisterResolver makes a resolver implementation available by name to
+// NewRegisteredResolver. It is intended to be called from an init function,
+// and panics if name is already registered or factory is nil.
+func RegisterResolver(name string, factory ResolverFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("bdns: RegisterResolver factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("bdns: RegisterResolver called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// NewRegisteredResolver constructs the resolver registered under name.
+func NewRegisteredResolver(name string, config ResolverConfig) (DNSResolver, error) {
+	factoriesMu.Lock()
+	factory, ok := factories[name]
+	factoriesMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS resolver implementation %q (registered: %v)", name, RegisteredResolvers())
+	}
+	return factory(config)
+}
+
+// RegisteredResolvers returns the sorted names of the registered resolver
+// implementations.
+func RegisteredResolvers() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
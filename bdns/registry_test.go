@@ -0,0 +1,55 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/test"
+)
+
+// proxyResolver stands in for an operator's own implementation.
+type proxyResolver struct {
+	MockDNSResolver
+	config ResolverConfig
+}
+
+func TestRegisterResolver(t *testing.T) {
+	RegisterResolver("test-proxy", func(config ResolverConfig) (DNSResolver, error) {
+		return &proxyResolver{config: config}, nil
+	})
+	test.AssertContains(t, strings.Join(RegisteredResolvers(), ","), "test-proxy")
+
+	config := ResolverConfig{
+		Servers:  []string{"proxy.internal:53"},
+		Timeout:  time.Second,
+		MaxTries: 2,
+		Stats:    testStats,
+		Clock:    clock.NewFake(),
+	}
+	resolver, err := NewRegisteredResolver("test-proxy", config)
+	test.AssertNotError(t, err, "Failed to construct registered resolver")
+	proxy, ok := resolver.(*proxyResolver)
+	test.Assert(t, ok, "Registered factory was not used")
+	test.AssertDeepEquals(t, proxy.config.Servers, config.Servers)
+
+	caas, _, err := resolver.LookupCAA(context.Background(), "present.com")
+	test.AssertNotError(t, err, "Lookup through registered resolver failed")
+	test.AssertEquals(t, len(caas), 1)
+
+	_, err = NewRegisteredResolver("missing", config)
+	test.AssertError(t, err, "Unregistered name should fail")
+
+	defer func() {
+		test.Assert(t, recover() != nil, "Duplicate registration should panic")
+	}()
+	RegisterResolver("test-proxy", func(ResolverConfig) (DNSResolver, error) { return nil, nil })
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// RTTSummary aggregates the round-trip times the resolver reported for a
+// group of queries. It excludes time spent on our side, such as queueing.
+type RTTSummary struct {
+	Queries int
+	Min     time.Duration
+	Max     time.Duration
+	Total   time.Duration
+}
+
+// RTTRecorder collects the round-trip times of every successful exchange
+// made with a context returned by WithRTTRecorder.
+type RTTRecorder struct {
+	sync.Mutex
+	summary RTTSummary
+}
+
+type rttRecorderKey struct{}
+
+// WithRTTRecorder returns a context that records the round-trip time of
+// every DNS exchange made with it into the returned recorder.
+func WithRTTRecorder(ctx context.Context) (context.Context, *RTTRecorder) {
+	recorder := &RTTRecorder{}
+	return context.WithValue(ctx, rttRecorderKey{}, recorder), recorder
+}
+
+func rttRecorderFrom(ctx context.Context) *RTTRecorder {
+	recorder, _ := ctx.Value(rttRecorderKey{}).(*RTTRecorder)
+	return recorder
+}
+
+func (r *RTTRecorder) add(rtt time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	if r.summary.Queries == 0 || rtt < r.summary.Min {
+		r.summary.Min = rtt
+	}
+	if rtt > r.summary.Max {
+		r.summary.Max = rtt
+	}
+	r.summary.Total += rtt
+	r.summary.Queries++
+}
+
+// Summary returns the round-trip times recorded so far.
+func (r *RTTRecorder) Summary() RTTSummary {
+	r.Lock()
+	defer r.Unlock()
+	return r.summary
+}
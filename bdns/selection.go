@@ -0,0 +1,98 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Strategies for choosing which of the configured servers to query.
+const (
+	// ServerSelectionRandom picks a server at random for each query, and
+	// sends its retries to the same server. It is the default.
+	ServerSelectionRandom = "random"
+	// ServerSelectionLatency picks the server with the lowest average
+	// round-trip time, and sends retries to the next best.
+	ServerSelectionLatency = "latency"
+)
+
+// latencyWeight is the weight of each new round-trip time in a server's
+// exponentially weighted moving average.
+const latencyWeight = 0.3
+
+// latencySelector keeps a moving average of the round-trip time of every
+// server queried. Servers that haven't been queried yet average zero, so
+// each is tried once before the averages decide.
+type latencySelector struct {
+	sync.Mutex
+	averages map[string]time.Duration
+}
+
+// pick returns the server in servers with the lowest average, other than
+// those in exclude unless that excludes them all. Ties go to the server
+// listed first.
+func (ls *latencySelector) pick(servers []string, exclude string) string {
+	ls.Lock()
+	defer ls.Unlock()
+	best := ""
+	var bestAverage time.Duration
+	for _, server := range servers {
+		if server == exclude {
+			continue
+		}
+		if average := ls.averages[server]; best == "" || average < bestAverage {
+			best, bestAverage = server, average
+		}
+	}
+	if best == "" {
+		return servers[0]
+	}
+	return best
+}
+
+// observe folds rtt into server's average.
+func (ls *latencySelector) observe(server string, rtt time.Duration) {
+	ls.Lock()
+	defer ls.Unlock()
+	average, ok := ls.averages[server]
+	if !ok {
+		ls.averages[server] = rtt
+		return
+	}
+	ls.averages[server] = time.Duration(latencyWeight*float64(rtt) + (1-latencyWeight)*float64(average))
+}
+
+// SetServerSelection sets the strategy, ServerSelectionRandom or
+// ServerSelectionLatency, for choosing which server to query. With
+// ServerSelectionLatency, a failed try counts as taking the whole read
+// timeout, or the server's own timeout if it has one. A server is only measured when chosen, so one that has been
+// slow is only tried again once the others' averages rise above its own.
+func (dnsResolver *DNSResolverImpl) SetServerSelection(strategy string) error {
+	switch strategy {
+	case "", ServerSelectionRandom:
+		dnsResolver.selector = nil
+	case ServerSelectionLatency:
+		dnsResolver.selector = &latencySelector{averages: make(map[string]time.Duration)}
+	default:
+		return fmt.Errorf("unknown server selection strategy %q", strategy)
+	}
+	return nil
+}
+
+// chooseServer returns the server to send a try to. previous is the server
+// the last try of the same query went to, if any.
+func (dnsResolver *DNSResolverImpl) chooseServer(servers []string, previous string) string {
+	if dnsResolver.selector != nil {
+		return dnsResolver.selector.pick(servers, previous)
+	}
+	if previous != "" {
+		return previous
+	}
+	return servers[rand.Intn(len(servers))]
+}
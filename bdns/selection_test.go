@@ -0,0 +1,99 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/metrics"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// latencyExchanger reports a fixed round-trip time for each server, and
+// counts the queries each receives. Servers listed in down fail with a
+// temporary error.
+type latencyExchanger struct {
+	sync.Mutex
+	rtts    map[string]time.Duration
+	down    map[string]bool
+	queries map[string]int
+}
+
+func (le *latencyExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	le.Lock()
+	defer le.Unlock()
+	le.queries[a]++
+	if le.down[a] {
+		return nil, 0, &net.OpError{Op: "read", Net: "tcp", Err: tryTimeoutError{}}
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, le.rtts[a], nil
+}
+
+func TestServerSelectionLatency(t *testing.T) {
+	stats := mocks.NewStatter()
+	servers := []string{"slow:53", "fast:53", "medium:53"}
+	dr := NewTestDNSResolverImpl(time.Second, servers, metrics.NewStatsdScope(&stats, "fakesvc"), clock.NewFake(), 2)
+	le := &latencyExchanger{
+		rtts:    map[string]time.Duration{"slow:53": 200 * time.Millisecond, "fast:53": 5 * time.Millisecond, "medium:53": 50 * time.Millisecond},
+		down:    make(map[string]bool),
+		queries: make(map[string]int),
+	}
+	dr.dnsClient = le
+	test.AssertError(t, dr.SetServerSelection("fastest"), "Unknown strategy accepted")
+	test.AssertNotError(t, dr.SetServerSelection(ServerSelectionLatency), "Couldn't select by latency")
+
+	// Each server is tried once, after which the fastest gets every query.
+	for i := 0; i < 20; i++ {
+		_, _, err := dr.LookupCAA(context.Background(), "example.com")
+		test.AssertNotError(t, err, "Lookup failed")
+	}
+	test.AssertDeepEquals(t, le.queries, map[string]int{"slow:53": 1, "fast:53": 18, "medium:53": 1})
+
+	// When it slows down, its average rises past the next best's.
+	le.rtts["fast:53"] = 300 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		_, _, err := dr.LookupCAA(context.Background(), "example.com")
+		test.AssertNotError(t, err, "Lookup failed")
+	}
+	test.Assert(t, le.queries["medium:53"] > 5, "Medium server should have taken over")
+
+	// A failed try is retried on another server, and the failed server is
+	// avoided afterwards.
+	le.rtts["fast:53"] = 5 * time.Millisecond
+	le.queries = make(map[string]int)
+	le.down["medium:53"] = true
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Lookup failed despite a working server")
+	test.AssertEquals(t, le.queries["medium:53"], 1)
+	test.AssertEquals(t, stats.Counters["fakesvc.CAA.ServerFallbacks"], int64(1))
+	_, _, err = dr.LookupCAA(context.Background(), "example.com")
+	test.AssertNotError(t, err, "Lookup failed")
+	test.AssertEquals(t, le.queries["medium:53"], 1)
+}
+
+func TestServerSelectionRandom(t *testing.T) {
+	dr := NewTestDNSResolverImpl(time.Second, []string{"a:53", "b:53"}, testStats, clock.NewFake(), 2)
+	le := &latencyExchanger{
+		down:    map[string]bool{"a:53": true, "b:53": true},
+		queries: make(map[string]int),
+	}
+	dr.dnsClient = le
+	test.AssertNotError(t, dr.SetServerSelection(ServerSelectionRandom), "Couldn't select randomly")
+
+	// Retries go to the server first chosen.
+	_, _, err := dr.LookupCAA(context.Background(), "example.com")
+	test.AssertError(t, err, "Lookup succeeded with every server down")
+	test.Assert(t, le.queries["a:53"] == 2 || le.queries["b:53"] == 2, "Retry went to a different server")
+}
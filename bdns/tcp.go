@@ -0,0 +1,46 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"net"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// tcpExchanger sends DNS queries over TCP, using a fresh connection for each
+// query. Unlike dns.Client, it reads responses with exchangeStream, which
+// copes with a length prefix split across reads and with responses split
+// across messages.
+type tcpExchanger struct {
+	timeout time.Duration
+	// dialTimeout bounds connection setup. If zero, timeout is used.
+	dialTimeout time.Duration
+}
+
+func (te *tcpExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	conn, err := te.dial(a)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	r, err := exchangeStream(conn, m, te.timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, time.Since(start), nil
+}
+
+// dial opens a TCP connection to the resolver at a.
+func (te *tcpExchanger) dial(a string) (net.Conn, error) {
+	dialTimeout := te.dialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = te.timeout
+	}
+	return net.DialTimeout("tcp", a, dialTimeout)
+}
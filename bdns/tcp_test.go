@@ -0,0 +1,112 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// serveSplitCAA answers each CAA query over TCP with the given issuers split
+// across messages of perMessage records, with the TC bit set on all but the
+// last. Each message is written in small pieces, splitting even the length
+// prefix.
+func serveSplitCAA(t *testing.T, issuers []string, perMessage int) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	test.AssertNotError(t, err, "Failed to listen")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				req := new(dns.Msg)
+				if err := req.Unpack(buf); err != nil {
+					return
+				}
+				for start := 0; start < len(issuers); start += perMessage {
+					end := start + perMessage
+					if end > len(issuers) {
+						end = len(issuers)
+					}
+					m := new(dns.Msg)
+					m.SetReply(req)
+					m.Truncated = end < len(issuers)
+					for _, issuer := range issuers[start:end] {
+						m.Answer = append(m.Answer, &dns.CAA{
+							Hdr:   dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+							Tag:   "issue",
+							Value: issuer,
+						})
+					}
+					packed, err := m.Pack()
+					if err != nil {
+						return
+					}
+					msg := make([]byte, 2+len(packed))
+					binary.BigEndian.PutUint16(msg, uint16(len(packed)))
+					copy(msg[2:], packed)
+					for i := 0; i < len(msg); i += 7 {
+						j := i + 7
+						if j > len(msg) {
+							j = len(msg)
+						}
+						if _, err := conn.Write(msg[i:j]); err != nil {
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestSplitCAAResponse(t *testing.T) {
+	issuers := []string{"letsencrypt.org", "example.net", "example.org"}
+	addr, stop := serveSplitCAA(t, issuers, 2)
+	defer stop()
+
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{addr}, testStats, clock.NewFake(), 1)
+	caas, _, err := dr.LookupCAA(context.Background(), "split.example.com")
+	test.AssertNotError(t, err, "CAA lookup failed")
+	test.AssertEquals(t, len(caas), len(issuers))
+	for i, caa := range caas {
+		test.AssertEquals(t, caa.Value, issuers[i])
+	}
+}
+
+func TestSplitCAAResponseTooManyMessages(t *testing.T) {
+	issuers := make([]string, maxStreamMessages+1)
+	for i := range issuers {
+		issuers[i] = "letsencrypt.org"
+	}
+	addr, stop := serveSplitCAA(t, issuers, 1)
+	defer stop()
+
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{addr}, testStats, clock.NewFake(), 1)
+	_, _, err := dr.LookupCAA(context.Background(), "split.example.com")
+	test.AssertError(t, err, "A response split across too many messages should fail")
+}
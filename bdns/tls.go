@@ -0,0 +1,195 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// ErrNoMatchingPin is returned when a DNS-over-TLS resolver's certificate
+// doesn't match any of the configured SPKI pins.
+var ErrNoMatchingPin = errors.New("resolver certificate does not match any configured SPKI pin")
+
+// PinnedTLSConfig is the TLS configuration for talking to a DNS-over-TLS
+// resolver, along with the SPKI pins its certificate must match.
+type PinnedTLSConfig struct {
+	*tls.Config
+	// pins are SHA-256 digests of DER SubjectPublicKeyInfos. If there are
+	// none, any certificate that verifies is accepted.
+	pins [][]byte
+}
+
+// tlsExchanger sends DNS queries over TLS as described in RFC 7858, using a
+// fresh connection for each query.
+type tlsExchanger struct {
+	config  *tls.Config
+	pins    [][]byte
+	timeout time.Duration
+	// dialTimeout bounds connection setup, including the TLS handshake. If
+	// zero, timeout is used.
+	dialTimeout time.Duration
+}
+
+func (te *tlsExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	conn, err := te.dial(a)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	r, err := exchangeStream(conn, m, te.timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, time.Since(start), nil
+}
+
+// dial opens a TLS connection to the resolver at a. Once the handshake is
+// done, the resolver's certificate is checked against any pins, and the
+// connection is closed if it matches none of them.
+func (te *tlsExchanger) dial(a string) (net.Conn, error) {
+	dialTimeout := te.dialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = te.timeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", a, te.config)
+	if err != nil {
+		return nil, err
+	}
+	if len(te.pins) > 0 {
+		if err := checkSPKIPins(conn.ConnectionState().PeerCertificates, te.pins); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// maxStreamMessages bounds the messages a response over a stream transport
+// may be split across.
+const maxStreamMessages = 16
+
+// exchangeStream sends m over conn, a stream transport, and reads the
+// response, giving up after timeout if it is nonzero. Some resolvers split
+// a large response across several messages on the stream, setting the TC
+// bit on all but the last; their records are reassembled into one response.
+func exchangeStream(conn net.Conn, m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// Messages on stream transports are prefixed with a two byte length.
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	r, err := readStreamMsg(conn, m.Id)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; r.Truncated; i++ {
+		if i == maxStreamMessages {
+			return nil, fmt.Errorf("response split across more than %d messages", maxStreamMessages)
+		}
+		next, err := readStreamMsg(conn, m.Id)
+		if err != nil {
+			return nil, err
+		}
+		r.Answer = append(r.Answer, next.Answer...)
+		r.Ns = append(r.Ns, next.Ns...)
+		r.Extra = append(r.Extra, next.Extra...)
+		r.Truncated = next.Truncated
+	}
+	return r, nil
+}
+
+// readStreamMsg reads one length-prefixed message with the given ID from
+// conn.
+func readStreamMsg(conn net.Conn, id uint16) (*dns.Msg, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	// Unpack reports any message with the TC bit set as truncated, even
+	// when all of it was there.
+	if err := r.Unpack(resp); err != nil && err != dns.ErrTruncated {
+		return nil, err
+	}
+	if r.Id != id {
+		return nil, dns.ErrId
+	}
+	return r, nil
+}
+
+// UseTLS switches the resolver to sending all queries over TLS using the
+// provided configuration. Any dial timeout set with SetDialTimeout is kept.
+func (dnsResolver *DNSResolverImpl) UseTLS(config *PinnedTLSConfig, timeout time.Duration) {
+	dnsResolver.dnsClient = &tlsExchanger{config: config.Config, pins: config.pins, timeout: timeout, dialTimeout: dnsResolver.dialTimeout}
+}
+
+// NewPinnedTLSConfig returns a TLS configuration for talking to a
+// DNS-over-TLS resolver. The resolver's certificate chain is verified
+// against roots (or the system roots if nil) as usual and, if any pins are
+// given, the leaf certificate's SubjectPublicKeyInfo must additionally hash
+// to one of them. Pins are base64-encoded SHA-256 digests of the DER
+// SubjectPublicKeyInfo, the same format used by HPKP.
+func NewPinnedTLSConfig(roots *x509.CertPool, serverName string, pins []string) (*PinnedTLSConfig, error) {
+	var digests [][]byte
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPKI pin %q: %s", pin, err)
+		}
+		if len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: expected %d bytes, got %d", pin, sha256.Size, len(digest))
+		}
+		digests = append(digests, digest)
+	}
+	config := &tls.Config{
+		RootCAs:    roots,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	return &PinnedTLSConfig{Config: config, pins: digests}, nil
+}
+
+func checkSPKIPins(certs []*x509.Certificate, digests [][]byte) error {
+	if len(certs) == 0 {
+		return ErrNoMatchingPin
+	}
+	spki := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	for _, digest := range digests {
+		if bytes.Equal(spki[:], digest) {
+			return nil
+		}
+	}
+	return ErrNoMatchingPin
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// tlsTestCert returns a self-signed certificate valid for 127.0.0.1 along
+// with a pool containing it and the base64 SHA-256 pin of its public key.
+func tlsTestCert(t *testing.T) (tls.Certificate, *x509.CertPool, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.AssertNotError(t, err, "Failed to generate key")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "resolver"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	test.AssertNotError(t, err, "Failed to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	test.AssertNotError(t, err, "Failed to parse certificate")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool, base64.StdEncoding.EncodeToString(spki[:])
+}
+
+// serveTLSResolver answers every query it receives over TLS using
+// mockDNSQuery. It returns the address it is listening on.
+func serveTLSResolver(t *testing.T, cert tls.Certificate) (string, func()) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	test.AssertNotError(t, err, "Failed to listen")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				req := new(dns.Msg)
+				if err := req.Unpack(buf); err != nil {
+					return
+				}
+				w := &streamResponseWriter{conn: conn}
+				mockDNSQuery(w, req)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// streamResponseWriter is a dns.ResponseWriter that writes length-prefixed
+// messages to a stream connection.
+type streamResponseWriter struct {
+	dns.ResponseWriter
+	conn net.Conn
+}
+
+func (w *streamResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	_, err = w.conn.Write(buf)
+	return err
+}
+
+func TestDNSOverTLSPinMatch(t *testing.T) {
+	cert, pool, pin := tlsTestCert(t)
+	addr, stop := serveTLSResolver(t, cert)
+	defer stop()
+
+	config, err := NewPinnedTLSConfig(pool, "", []string{pin})
+	test.AssertNotError(t, err, "Failed to build pinned TLS config")
+	obj := NewTestDNSResolverImpl(time.Second*10, []string{addr}, testStats, clock.NewFake(), 1)
+	obj.UseTLS(config, time.Second*10)
+
+	caas, _, err := obj.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertNotError(t, err, "CAA lookup over TLS failed")
+	test.Assert(t, len(caas) > 0, "Should have CAA records")
+}
+
+func TestDNSOverTLSPinMismatch(t *testing.T) {
+	cert, pool, _ := tlsTestCert(t)
+	addr, stop := serveTLSResolver(t, cert)
+	defer stop()
+
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	config, err := NewPinnedTLSConfig(pool, "", []string{otherPin})
+	test.AssertNotError(t, err, "Failed to build pinned TLS config")
+
+	te := &tlsExchanger{config: config.Config, pins: config.pins, timeout: time.Second * 10}
+	m := new(dns.Msg)
+	m.SetQuestion("bracewel.net.", dns.TypeCAA)
+	_, _, err = te.Exchange(m, addr)
+	test.AssertError(t, err, "Exchange should have failed on pin mismatch")
+	test.Assert(t, strings.Contains(err.Error(), ErrNoMatchingPin.Error()), "Wrong error: "+err.Error())
+
+	obj := NewTestDNSResolverImpl(time.Second*10, []string{addr}, testStats, clock.NewFake(), 1)
+	obj.UseTLS(config, time.Second*10)
+	_, _, err = obj.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertError(t, err, "CAA lookup should have failed on pin mismatch")
+}
+
+func TestNewPinnedTLSConfigInvalidPins(t *testing.T) {
+	_, err := NewPinnedTLSConfig(nil, "", []string{"not base64!"})
+	test.AssertError(t, err, "Should reject undecodable pin")
+	_, err = NewPinnedTLSConfig(nil, "", []string{base64.StdEncoding.EncodeToString([]byte("short"))})
+	test.AssertError(t, err, "Should reject pin of the wrong length")
+}
+
+func TestDNSDialTimeout(t *testing.T) {
+	// A server that accepts connections but never completes a handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	test.AssertNotError(t, err, "Failed to listen")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, pool, _ := tlsTestCert(t)
+	config, err := NewPinnedTLSConfig(pool, "", nil)
+	test.AssertNotError(t, err, "Failed to build TLS config")
+	obj := NewTestDNSResolverImpl(time.Second*10, []string{ln.Addr().String()}, testStats, clock.NewFake(), 1)
+	obj.SetDialTimeout(100 * time.Millisecond)
+	obj.UseTLS(config, time.Second*10)
+
+	start := time.Now()
+	_, _, err = obj.LookupCAA(context.Background(), "bracewel.net")
+	test.AssertError(t, err, "Lookup should have timed out during the handshake")
+	took := time.Since(start)
+	test.Assert(t, took < 2*time.Second, "Dial timeout didn't apply independently of the query timeout: took "+took.String())
+
+	// The dial timeout also applies to the plain TCP client.
+	plain := NewTestDNSResolverImpl(time.Second*10, []string{ln.Addr().String()}, testStats, clock.NewFake(), 1)
+	plain.SetDialTimeout(100 * time.Millisecond)
+	test.AssertEquals(t, plain.dnsClient.(*tcpExchanger).dialTimeout, 100*time.Millisecond)
+}
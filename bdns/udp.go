@@ -0,0 +1,49 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/metrics"
+)
+
+// udpExchanger sends DNS queries over UDP, retrying them with the wrapped
+// stream exchanger when the response is truncated. Each retry is counted as
+// TCPFallback, scoped by query type.
+type udpExchanger struct {
+	client   *dns.Client
+	fallback exchanger
+	stats    metrics.Scope
+}
+
+func (ue *udpExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := ue.client.Exchange(m, a)
+	if err == dns.ErrTruncated || (err == nil && r.Truncated) {
+		ue.stats.NewScope(dns.TypeToString[m.Question[0].Qtype]).Inc("TCPFallback", 1)
+		return ue.fallback.Exchange(m, a)
+	}
+	return r, rtt, err
+}
+
+// UseUDP makes the resolver send queries over UDP first, falling back to
+// its current transport, TCP unless changed, for responses too large for
+// the EDNS buffer. A high TCPFallback rate suggests raising the buffer. It
+// should be called after PoolConnections, if that is used, and not with
+// UseTLS or UseHTTPS.
+func (dnsResolver *DNSResolverImpl) UseUDP() {
+	dnsResolver.dnsClient = &udpExchanger{
+		client: &dns.Client{
+			Net:          "udp",
+			DialTimeout:  dnsResolver.readTimeout,
+			ReadTimeout:  dnsResolver.readTimeout,
+			WriteTimeout: dnsResolver.readTimeout,
+		},
+		fallback: dnsResolver.dnsClient,
+		stats:    dnsResolver.stats,
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/metrics"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// serveUDP answers CAA queries over UDP with a single issue record, except
+// for big.example.com, whose response is truncated.
+func serveUDP(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	test.AssertNotError(t, err, "Failed to listen")
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if err := req.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if req.Question[0].Name == "big.example.com." {
+				m.Truncated = true
+			} else {
+				m.Answer = append(m.Answer, &dns.CAA{
+					Hdr:   dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+					Tag:   "issue",
+					Value: "udp.example.net",
+				})
+			}
+			packed, err := m.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// fallbackExchanger answers every CAA query with a single issue record.
+type fallbackExchanger struct{}
+
+func (fallbackExchanger) Exchange(m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.CAA{
+		Hdr:   dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET},
+		Tag:   "issue",
+		Value: "tcp.example.net",
+	})
+	return r, time.Millisecond, nil
+}
+
+func TestUseUDP(t *testing.T) {
+	addr, stop := serveUDP(t)
+	defer stop()
+	stats := mocks.NewStatter()
+	dr := NewTestDNSResolverImpl(time.Second*10, []string{addr}, metrics.NewStatsdScope(&stats, "fakesvc"), clock.NewFake(), 1)
+	dr.dnsClient = fallbackExchanger{}
+	dr.UseUDP()
+
+	// A response that fits is taken as is.
+	caas, _, err := dr.LookupCAA(context.Background(), "small.example.com")
+	test.AssertNotError(t, err, "UDP lookup failed")
+	test.AssertEquals(t, len(caas), 1)
+	test.AssertEquals(t, caas[0].Value, "udp.example.net")
+	test.AssertEquals(t, stats.Counters["fakesvc.CAA.TCPFallback"], int64(0))
+
+	// A truncated one is retried over the fallback transport.
+	caas, _, err = dr.LookupCAA(context.Background(), "big.example.com")
+	test.AssertNotError(t, err, "Lookup with a truncated response failed")
+	test.AssertEquals(t, len(caas), 1)
+	test.AssertEquals(t, caas[0].Value, "tcp.example.net")
+	test.AssertEquals(t, stats.Counters["fakesvc.CAA.TCPFallback"], int64(1))
+}
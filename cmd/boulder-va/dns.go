@@ -0,0 +1,51 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/cmd"
+)
+
+// loadDNSOverTLSConfig builds the TLS configuration used to talk to a
+// DNS-over-TLS resolver, reading the CA bundle from disk if one is given.
+func loadDNSOverTLSConfig(c *cmd.DNSOverTLSConfig) (*bdns.PinnedTLSConfig, error) {
+	var roots *x509.CertPool
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACertFile)
+		}
+	}
+	return bdns.NewPinnedTLSConfig(roots, c.ServerName, c.SPKIPins)
+}
+
+// loadDomainList reads a file of domain names, one per line. Blank lines and
+// lines starting with # are ignored.
+func loadDomainList(filename string) ([]string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains, nil
+}
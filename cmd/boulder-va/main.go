@@ -6,14 +6,22 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/letsencrypt/boulder/bdns"
 	"github.com/letsencrypt/boulder/metrics"
 
 	"github.com/letsencrypt/boulder/cmd"
+	"github.com/letsencrypt/boulder/core"
 	blog "github.com/letsencrypt/boulder/log"
 	"github.com/letsencrypt/boulder/rpc"
 	"github.com/letsencrypt/boulder/va"
@@ -52,14 +60,275 @@ func main() {
 		if dnsTries < 1 {
 			dnsTries = 1
 		}
-		if !c.Common.DNSAllowLoopbackAddresses {
-			vai.DNSResolver = bdns.NewDNSResolverImpl(dnsTimeout, []string{c.Common.DNSResolver}, scoped, clk, dnsTries)
-		} else {
-			vai.DNSResolver = bdns.NewTestDNSResolverImpl(dnsTimeout, []string{c.Common.DNSResolver}, scoped, clk, dnsTries)
+		servers := []string{c.Common.DNSResolver}
+		if c.VA.DNSOverHTTPS != "" {
+			servers = []string{c.VA.DNSOverHTTPS}
+		}
+		if c.VA.DNSOverTLS != nil && c.VA.DNSOverHTTPS != "" {
+			cmd.FailOnError(fmt.Errorf("DNSOverTLS and DNSOverHTTPS are mutually exclusive"), "Invalid DNS transport config")
+		}
+		switch c.VA.DNSResponseParsing {
+		case "", "lenient", "strict":
+		default:
+			cmd.FailOnError(fmt.Errorf("unknown DNS response parsing level %q", c.VA.DNSResponseParsing), "Invalid DNS config")
+		}
+		var tlsConfig *bdns.PinnedTLSConfig
+		if c.VA.DNSOverTLS != nil {
+			tlsConfig, err = loadDNSOverTLSConfig(c.VA.DNSOverTLS)
+			cmd.FailOnError(err, "Couldn't load DNS-over-TLS config")
+		}
+		var capture *bdns.PacketCapture
+		if c.VA.DNSCaptureFile != "" {
+			capture, err = bdns.NewPacketCapture(c.VA.DNSCaptureFile, c.VA.DNSCaptureMaxBytes)
+			cmd.FailOnError(err, "Couldn't open DNS capture file")
+		}
+		newResolver := func(servers []string) bdns.DNSResolver {
+			if c.VA.DNSResolverImplementation != "" {
+				resolver, err := bdns.NewRegisteredResolver(c.VA.DNSResolverImplementation, bdns.ResolverConfig{
+					Servers:  servers,
+					Timeout:  dnsTimeout,
+					MaxTries: dnsTries,
+					Stats:    scoped,
+					Clock:    clk,
+				})
+				cmd.FailOnError(err, "Couldn't construct DNS resolver")
+				return resolver
+			}
+			var resolver *bdns.DNSResolverImpl
+			if !c.Common.DNSAllowLoopbackAddresses {
+				resolver = bdns.NewDNSResolverImpl(dnsTimeout, servers, scoped, clk, dnsTries)
+			} else {
+				resolver = bdns.NewTestDNSResolverImpl(dnsTimeout, servers, scoped, clk, dnsTries)
+			}
+			if c.VA.DNSDialTimeout.Duration > 0 {
+				resolver.SetDialTimeout(c.VA.DNSDialTimeout.Duration)
+			}
+			if tlsConfig != nil {
+				resolver.UseTLS(tlsConfig, dnsTimeout)
+			}
+			if c.VA.DNSOverHTTPS != "" {
+				resolver.UseHTTPS(&http.Client{Timeout: dnsTimeout})
+			}
+			if c.VA.DNSPoolConnections {
+				err := resolver.PoolConnections(c.VA.DNSPoolMaxQueries, c.VA.DNSPoolProbeInterval.Duration)
+				cmd.FailOnError(err, "Couldn't pool DNS connections")
+			}
+			if c.VA.DNSUseUDP && tlsConfig == nil && c.VA.DNSOverHTTPS == "" {
+				resolver.UseUDP()
+			}
+			if capture != nil {
+				resolver.CapturePackets(capture)
+			}
+			if len(c.VA.DNSTryTimeouts) > 0 {
+				schedule := make([]time.Duration, len(c.VA.DNSTryTimeouts))
+				for i, d := range c.VA.DNSTryTimeouts {
+					schedule[i] = d.Duration
+				}
+				resolver.EscalateTimeouts(schedule)
+			}
+			if len(c.VA.DNSServerTimeouts) > 0 {
+				timeouts := make(map[string]time.Duration, len(c.VA.DNSServerTimeouts))
+				for server, d := range c.VA.DNSServerTimeouts {
+					timeouts[server] = d.Duration
+				}
+				resolver.SetServerTimeouts(timeouts)
+			}
+			if c.VA.DNSMaxInFlight > 0 {
+				resolver.LimitQueries(c.VA.DNSMaxInFlight)
+			}
+			err := resolver.SetServerSelection(c.VA.DNSServerSelection)
+			cmd.FailOnError(err, "Invalid DNS server selection strategy")
+			if c.VA.DNSCoalesceQueries {
+				resolver.CoalesceQueries()
+			}
+			if c.VA.DNSCookies {
+				resolver.UseCookies()
+			}
+			if c.VA.DNSResponseParsing == "strict" {
+				resolver.StrictParsing()
+			}
+			if c.VA.DNSLenientHeaders {
+				resolver.LenientHeaders()
+			}
+			if c.VA.DNSCheckResponses {
+				resolver.CheckResponses()
+			}
+			if c.VA.DNSCheckAuthority {
+				resolver.CheckAuthority()
+			}
+			if c.VA.CAARequireDNSSEC {
+				resolver.RequireAuthenticatedCAA()
+			}
+			if c.VA.CAAIgnoreDNSSECBogus {
+				resolver.IgnoreBogusCAA()
+			}
+			if c.VA.CAAMaxCNAMEChain > 0 {
+				resolver.LimitCNAMEChain(c.VA.CAAMaxCNAMEChain)
+			}
+			if c.VA.CAAQueryClass != "" {
+				class, ok := dns.StringToClass[strings.ToUpper(c.VA.CAAQueryClass)]
+				if !ok {
+					cmd.FailOnError(fmt.Errorf("unknown DNS class %q", c.VA.CAAQueryClass), "Invalid CAA query class")
+				}
+				resolver.SetCAAClass(class)
+			}
+			if c.VA.CAAOverrideZoneFile != "" {
+				f, err := os.Open(c.VA.CAAOverrideZoneFile)
+				cmd.FailOnError(err, "Couldn't open CAA override zone file")
+				err = resolver.LoadCAAOverride(f, c.VA.CAAOverrideZoneFile)
+				f.Close()
+				cmd.FailOnError(err, "Couldn't load CAA override zone file")
+			}
+			for zone, servers := range c.VA.DNSZoneResolvers {
+				resolver.RouteZone(zone, servers)
+			}
+			if c.VA.DNSProbeCAASupport {
+				err := resolver.ProbeCAASupport(context.Background(), c.VA.IssuerDomain)
+				cmd.FailOnError(err, "DNS resolver failed the CAA support probe")
+			}
+			return resolver
+		}
+		vai.DNSResolver = newResolver(servers)
+		vai.PurposeResolvers = make(map[string]bdns.DNSResolver)
+		for purpose, servers := range c.VA.DNSPurposeResolvers {
+			if !va.ValidResolverPurpose(purpose) {
+				cmd.FailOnError(fmt.Errorf("unknown resolver purpose %q", purpose), "Invalid DNS purpose resolvers")
+			}
+			vai.PurposeResolvers[purpose] = newResolver(servers)
+		}
+		if len(c.VA.CAAQuorumResolvers) > 0 {
+			members := []bdns.DNSResolver{vai.DNSResolver}
+			if resolver, ok := vai.PurposeResolvers[va.ResolverPurposeCAA]; ok {
+				members[0] = resolver
+			}
+			for _, servers := range c.VA.CAAQuorumResolvers {
+				members = append(members, newResolver(servers))
+			}
+			vai.PurposeResolvers[va.ResolverPurposeCAA] = bdns.NewQuorumResolver(members, scoped)
 		}
 		vai.UserAgent = c.VA.UserAgent
 		vai.IssuerDomain = c.VA.IssuerDomain
 
+		if c.VA.CAAResultCacheTTL.Duration > va.MaxCAAResultCacheTTL {
+			cmd.FailOnError(fmt.Errorf("%s exceeds maximum of %s", c.VA.CAAResultCacheTTL.Duration, va.MaxCAAResultCacheTTL), "Invalid CAA result cache TTL")
+		}
+		vai.CAAResultCacheTTL = c.VA.CAAResultCacheTTL.Duration
+		vai.CAACacheMinTTL = c.VA.CAACacheMinTTL.Duration
+		if c.VA.CAACacheImplementation != "" {
+			cache, err := va.NewRegisteredCAACache(c.VA.CAACacheImplementation, va.CAACacheConfig{
+				Servers: c.VA.CAACacheServers,
+				Clock:   clk,
+			})
+			cmd.FailOnError(err, "Couldn't construct CAA cache")
+			vai.UseCAACache(cache)
+		}
+		vai.CAAMaxConcurrentLookups = c.VA.CAAMaxConcurrentLookups
+		vai.CAAClockSkew = c.VA.CAAClockSkew.Duration
+		vai.CAASkipLabelPrefixes = c.VA.CAASkipLabelPrefixes
+		vai.CAAMaxLabels = c.VA.CAAMaxLabels
+		vai.CAAMaxRecords = c.VA.CAAMaxRecords
+		vai.CAALargeResponseSize = c.VA.CAALargeResponseSize
+		vai.CAABlankRecordsAreErrors = c.VA.CAABlankRecordsAreErrors
+		if !va.ValidCAARuleset(c.VA.CAARuleset) {
+			cmd.FailOnError(fmt.Errorf("unknown CAA ruleset %q", c.VA.CAARuleset), "Invalid CAA ruleset")
+		}
+		vai.CAARuleset = c.VA.CAARuleset
+		vai.CAARequireRegisteredDomainAnswer = c.VA.CAARequireRegisteredDomainAnswer
+		if c.VA.CAAQueryLogSampleRate < 0 || c.VA.CAAQueryLogSampleRate > 1 {
+			cmd.FailOnError(fmt.Errorf("%g is not between 0 and 1", c.VA.CAAQueryLogSampleRate), "Invalid CAA query log sample rate")
+		}
+		vai.CAAQueryLogSampleRate = c.VA.CAAQueryLogSampleRate
+		vai.CAARegisteredDomainShortcut = c.VA.CAARegisteredDomainShortcut
+		vai.CAADelegationParameter = c.VA.CAADelegationParameter
+		vai.CAADelegationValues = c.VA.CAADelegationValues
+		for issuer, methods := range c.VA.CAAIssuerMethodPolicies {
+			for _, method := range methods {
+				if !core.ValidChallenge(method) {
+					cmd.FailOnError(fmt.Errorf("unknown validation method %q for %s", method, issuer), "Invalid CAA issuer method policies")
+				}
+			}
+		}
+		vai.CAAIssuerMethodPolicies = c.VA.CAAIssuerMethodPolicies
+		vai.CAAMonitorMaxDomains = c.VA.CAAMonitorMaxDomains
+		vai.CAAMinimizeQueries = c.VA.CAAMinimizeQueries
+		vai.CAAIssuewildFallback = c.VA.CAAIssuewildFallback
+		vai.CAAFallbackIssuerDomain = c.VA.CAAFallbackIssuerDomain
+		vai.CAAAccountURIPrefix = c.VA.CAAAccountURIPrefix
+		if c.VA.CAAIdentitiesFile != "" {
+			err = vai.SetCAAIdentitiesFile(c.VA.CAAIdentitiesFile)
+			cmd.FailOnError(err, "Couldn't load CAA identities file")
+		}
+		vai.CAALameDelegationsAreErrors = c.VA.CAALameDelegationsAreErrors
+		vai.CAAStrictAncestorErrors = c.VA.CAAStrictAncestorErrors
+		vai.CAAResolverDiagnostics = c.VA.CAAResolverDiagnostics
+		vai.CAAReportReservedFlags = c.VA.CAAReportReservedFlags
+		vai.CAAReportUnflaggedUnknown = c.VA.CAAReportUnflaggedUnknown
+		vai.CAAReportShadowedAncestors = c.VA.CAAReportShadowedAncestors
+		if c.VA.CAAAttestationKeyFile != "" {
+			vai.CAAAttestationSigner, err = loadSigningKey(c.VA.CAAAttestationKeyFile)
+			cmd.FailOnError(err, "Couldn't load CAA attestation key")
+		}
+		// Served alongside the pprof handlers by the debug server.
+		http.HandleFunc("/debug/caa-cache", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(vai.CAACacheStats())
+		})
+		if c.VA.DNSDebugLookups {
+			caaResolver := vai.DNSResolver
+			if resolver, ok := vai.PurposeResolvers[va.ResolverPurposeCAA]; ok {
+				caaResolver = resolver
+			}
+			if quorum, ok := caaResolver.(*bdns.QuorumResolver); ok {
+				caaResolver = quorum.DNSResolver
+			}
+			impl, ok := caaResolver.(*bdns.DNSResolverImpl)
+			if !ok {
+				cmd.FailOnError(fmt.Errorf("DNSDebugLookups needs the built-in resolver"), "Invalid DNS debug config")
+			}
+			if c.VA.DNSDebugLookupsToken == "" {
+				cmd.FailOnError(fmt.Errorf("DNSDebugLookups needs DNSDebugLookupsToken"), "Invalid DNS debug config")
+			}
+			http.Handle("/debug/caa-lookup", bdns.DebugCAAHandler(impl, c.VA.DNSDebugLookupsToken))
+		}
+
+		if c.VA.CAAWarmupDomainsFile != "" {
+			domains, err := loadDomainList(c.VA.CAAWarmupDomainsFile)
+			cmd.FailOnError(err, "Couldn't load CAA warmup domains")
+			go vai.WarmCAACache(context.Background(), domains, c.VA.CAAWarmupDuration.Duration)
+		}
+
+		if c.VA.CAAMonitorDomainsFile != "" {
+			domains, err := loadDomainList(c.VA.CAAMonitorDomainsFile)
+			cmd.FailOnError(err, "Couldn't load CAA monitor domains")
+			challengeType := c.VA.CAAMonitorChallengeType
+			if challengeType == "" {
+				challengeType = core.ChallengeTypeHTTP01
+			}
+			monitor, err := vai.NewCAAMonitor(domains, challengeType)
+			cmd.FailOnError(err, "Couldn't create CAA monitor")
+			interval := c.VA.CAAMonitorInterval.Duration
+			if interval <= 0 {
+				interval = time.Minute
+			}
+			changes := make(chan va.CAAChange)
+			go monitor.Run(context.Background(), interval, changes)
+			go func() {
+				for change := range changes {
+					auditlogger.Info(fmt.Sprintf("CAA monitor: decision for %s is [Present: %t, Valid for issuance: %t, Found at: %q]",
+						change.Domain, change.Present, change.Valid, change.Owner))
+				}
+			}()
+		}
+
+		// Hold off consuming requests until the probes have warmed the
+		// resolver's cache, so that cold-start latency doesn't hit real
+		// validations.
+		warmupTimeout := c.VA.WarmupProbeTimeout.Duration
+		if warmupTimeout <= 0 {
+			warmupTimeout = 10 * time.Second
+		}
+		vai.RunWarmupProbes(context.Background(), c.VA.WarmupProbes, warmupTimeout)
+
 		amqpConf := c.VA.AMQP
 		rac, err := rpc.NewRegistrationAuthorityClient(clientName, amqpConf, stats)
 		cmd.FailOnError(err, "Unable to create RA client")
@@ -97,6 +97,306 @@ type Config struct {
 		// before giving up. May be short-circuited by deadlines. A zero value
 		// will be turned into 1.
 		DNSTries int
+
+		// How long establishing a connection to the DNS server may take,
+		// including the TLS handshake for DNSOverTLS. Defaults to
+		// Common.DNSTimeout for DNSOverTLS and to two seconds otherwise.
+		DNSDialTimeout ConfigDuration
+
+		// How long to reuse a CAA decision for an identical check (same
+		// domain, issuer and challenge type). Must not exceed
+		// va.MaxCAAResultCacheTTL. A zero value disables the cache.
+		CAAResultCacheTTL ConfigDuration
+		// The minimum TTL assumed for CAA records when deciding how long a
+		// cached decision remains usable. Capped at the CAA recheck window.
+		CAACacheMinTTL ConfigDuration
+		// CAACacheImplementation, if set, names a cache registered with
+		// va.RegisterCAACache, e.g. one shared by every VA, to hold CAA
+		// decisions instead of each VA's memory. CAACacheServers are
+		// passed to it.
+		CAACacheImplementation string
+		CAACacheServers        []string
+		// A file listing domains, one per line, whose CAA decisions are
+		// loaded into the result cache at startup, with the lookups spread
+		// over CAAWarmupDuration. When CAAAccountURIPrefix is set, each
+		// domain must be followed by the registration ID of the account
+		// that will validate it.
+		CAAWarmupDomainsFile string
+		CAAWarmupDuration    ConfigDuration
+		// Names whose CAA records are looked up before the VA starts
+		// taking requests, to fill the upstream resolver's cache. Startup
+		// waits at most WarmupProbeTimeout (default 10s) for them.
+		WarmupProbes       []string
+		WarmupProbeTimeout ConfigDuration
+		// The most CAA lookups a single check may have in flight while
+		// climbing the DNS tree. A zero value means no limit.
+		CAAMaxConcurrentLookups int
+		// How far clocks may disagree with ours. It is subtracted from the
+		// CAA recheck window so that decisions are rechecked early rather
+		// than late.
+		CAAClockSkew ConfigDuration
+		// Label prefixes, such as "_acme-challenge", that are skipped at the
+		// start of a name before climbing the tree for CAA records.
+		CAASkipLabelPrefixes []string
+		// Names with more labels than this are rejected before any CAA
+		// lookups. A zero value means no limit.
+		CAAMaxLabels int
+		// Checks whose lookups return more CAA records than this in all
+		// fail. A zero value means no limit.
+		CAAMaxRecords int
+		// A single lookup returning CAA records larger than this many bytes
+		// is logged with a warning, but otherwise processed normally. A
+		// zero value disables the warning.
+		CAALargeResponseSize int
+		// Fail CAA checks that find only blank records (empty tags, or
+		// iodef and unknown properties with empty values) instead of
+		// treating them as no records.
+		CAABlankRecordsAreErrors bool
+
+		// CAARuleset selects the CAA processing rules, "rfc8659" (the
+		// default) or "rfc6844". They differ in how DNAME aliases affect
+		// the tree climb.
+		CAARuleset string
+
+		// Fail CAA checks that find no records unless the lookup for the
+		// registered domain was answered, rather than failing at the
+		// resolver.
+		CAARequireRegisteredDomainAnswer bool
+
+		// The fraction, from 0 to 1, of CAA checks whose DNS lookups are
+		// logged in detail. Checks that deny issuance are always logged.
+		CAAQueryLogSampleRate float64
+
+		// Only look up CAA records at the name being checked, its
+		// registered domain, and the registered domain's ancestors,
+		// skipping the labels in between. This departs from the RFC, and
+		// is only safe when CAA policy never lives on intermediate labels.
+		CAARegisteredDomainShortcut bool
+
+		// Maps CAA issuer identities to the validation methods this CA
+		// permits under them for domains whose CAA records restrict
+		// issuance, on top of any validationmethods parameter.
+		CAAIssuerMethodPolicies map[string][]string
+
+		// An issue parameter, e.g. "delegate", through which CAA records
+		// naming another issuer can authorize this CA, when its
+		// comma-separated value lists one of CAADelegationValues.
+		CAADelegationParameter string
+		CAADelegationValues    []string
+
+		// A file listing domains, one per line, whose CAA decisions are
+		// re-checked as they come due and logged whenever they change.
+		// Due domains are polled for every CAAMonitorInterval, which
+		// defaults to a minute, and checked for issuance using
+		// CAAMonitorChallengeType, which defaults to http-01.
+		CAAMonitorDomainsFile   string
+		CAAMonitorInterval      ConfigDuration
+		CAAMonitorChallengeType string
+		// The most domains a CAA monitor may watch. Defaults to 1000.
+		CAAMonitorMaxDomains int
+
+		// Look up the names in a CAA climb one at a time from the top of
+		// the tree down, stopping at the first that doesn't exist, so that
+		// names are only revealed once their parent is known to exist. This
+		// serializes the lookups.
+		CAAMinimizeQueries bool
+
+		// If set, a PEM encoded RSA or ECDSA private key with which to sign
+		// an attestation of each CAA decision, written to the audit log.
+		CAAAttestationKeyFile string
+
+		// Let wildcard names whose issuewild properties only name other
+		// issuers fall back to the issue properties, for operators with
+		// legacy expectations. An issuewild ";" still denies. RFC 8659
+		// doesn't allow this.
+		CAAIssuewildFallback bool
+
+		// A legacy CAA identity to check, and log as such, when a domain's
+		// records don't authorize IssuerDomain, e.g. during a rebranding.
+		CAAFallbackIssuerDomain string
+
+		// CAAIdentitiesFile is a JSON file listing CAA identities, among
+		// IssuerDomain and CAAFallbackIssuerDomain, with an Enabled flag
+		// each, e.g. {"Identities": [{"Domain": "example.net", "Enabled":
+		// false}]}. A disabled identity never authorizes issuance. The file
+		// is reloaded when it changes, and unlisted identities are enabled.
+		CAAIdentitiesFile string
+
+		// CAAAccountURIPrefix, followed by a registration ID, is the URI
+		// of an account as named by accounturi CAA parameters, e.g.
+		// "https://acme-v01.api.letsencrypt.org/acme/reg/". When set, an
+		// issue property must match both the account and the validation
+		// method to authorize issuance. Otherwise accounturi is ignored.
+		CAAAccountURIPrefix string
+
+		// Fail CAA checks when the lookup for an ancestor of the name, below
+		// where any records were found, isn't answered, e.g. because that
+		// zone is lamely delegated. Otherwise this is only logged.
+		CAALameDelegationsAreErrors bool
+		// Fail CAA checks when the lookup for any ancestor of the name
+		// fails, even one above where the deciding records were found,
+		// favouring safety over availability.
+		CAAStrictAncestorErrors bool
+		// Add the resolver, rcode, round-trip time and tries of failed
+		// queries to the problem returned when a CAA lookup fails. These
+		// reach subscribers, so leave it off outside of debugging.
+		CAAResolverDiagnostics bool
+		// Log CAA records that set reserved flag bits, other than bit 1,
+		// which is accepted as the critical bit. Decisions are unaffected.
+		CAAReportReservedFlags bool
+		// Log CAA records with unknown tags and no flags, in case a
+		// resolver or middlebox stripped a critical flag from them.
+		// Decisions are unaffected.
+		CAAReportUnflaggedUnknown bool
+
+		// When a critical unknown CAA property at the exact name being
+		// checked denies issuance, also look up the records above it, and
+		// log when they would have authorized issuance. The check still
+		// fails.
+		CAAReportShadowedAncestors bool
+
+		// DNSOverTLS, if present, makes the VA send its DNS queries to
+		// Common.DNSResolver over TLS.
+		DNSOverTLS *DNSOverTLSConfig
+
+		// DNSOverHTTPS, if present, is the URL of a DNS-over-HTTPS endpoint
+		// that the VA sends its DNS queries to instead of
+		// Common.DNSResolver.
+		DNSOverHTTPS string
+
+		// DNSResolverImplementation, if set, names a resolver registered
+		// with bdns.RegisterResolver to use instead of the built-in one. The
+		// built-in transport options above don't apply to it.
+		DNSResolverImplementation string
+
+		// Maps zones to the resolver addresses that must answer queries for
+		// names at or below them, for split-horizon setups. Names outside
+		// every listed zone use Common.DNSResolver.
+		DNSZoneResolvers map[string][]string
+
+		// Maps query purposes, "caa" or "dns-01", to the resolver
+		// addresses used for them instead of Common.DNSResolver, e.g. to
+		// look up challenge records on a resolver that caches less. All
+		// other DNS options apply to them as well.
+		DNSPurposeResolvers map[string][]string
+
+		// CAAQuorumResolvers lists further sets of DNS servers to look up
+		// CAA records with, alongside the CAA resolver. Each set is a
+		// separate resolver; records are only used when every resolver
+		// agrees on the issuers they authorize, and otherwise the check
+		// fails. Disagreements are counted as Quorum.Disagreements.
+		CAAQuorumResolvers [][]string
+
+		// DNSDebugLookups serves /debug/caa-lookup?name=... on the debug
+		// server, returning the raw wire-format response to a CAA query
+		// for the name. Requests must carry "Authorization: Bearer" and
+		// DNSDebugLookupsToken.
+		DNSDebugLookups      bool
+		DNSDebugLookupsToken string
+
+		// DNSResponseParsing is "lenient" (the default), to drop malformed
+		// CAA records, and records owned by a name the query didn't lead
+		// to, and use the rest of a response, or "strict", to reject
+		// responses with any such records.
+		DNSResponseParsing string
+
+		// DNSLenientHeaders makes the VA use responses with malformed
+		// headers, e.g. without the QR bit, if their records can be
+		// parsed. By default they are rejected.
+		DNSLenientHeaders bool
+
+		// DNSCoalesceQueries makes concurrent identical DNS queries share
+		// a single exchange with the resolver.
+		DNSCoalesceQueries bool
+
+		// DNSPoolConnections keeps TCP and DNS-over-TLS connections to the
+		// resolver open and reuses them across queries. Each connection is
+		// retired after DNSPoolMaxQueries queries, if that is positive, and
+		// idle connections are checked with a probe query every
+		// DNSPoolProbeInterval, if that is positive.
+		DNSPoolConnections   bool
+		DNSPoolMaxQueries    int
+		DNSPoolProbeInterval ConfigDuration
+
+		// DNSUseUDP makes the VA send its DNS queries over UDP, falling
+		// back to TCP for truncated responses, which are counted as
+		// TCPFallback for each query type. It has no effect with
+		// DNSOverTLS or DNSOverHTTPS.
+		DNSUseUDP bool
+
+		// DNSCaptureFile, if set, is a pcap file to which every DNS query
+		// the VA sends, and every response, is written for offline
+		// analysis. Once it reaches DNSCaptureMaxBytes, if that is
+		// positive, it is rotated to DNSCaptureFile + ".1".
+		DNSCaptureFile     string
+		DNSCaptureMaxBytes int64
+
+		// DNSTryTimeouts gives each try of a DNS query its own timeout: the
+		// first try waits DNSTryTimeouts[0], the second DNSTryTimeouts[1],
+		// and so on, with the last applying to any further tries. A short
+		// first timeout followed by longer ones keeps queries fast without
+		// giving up on slow resolvers.
+		DNSTryTimeouts []ConfigDuration
+
+		// DNSServerTimeouts gives tries sent to the DNS servers listed, by
+		// address, their own timeouts, so that a fast local resolver is
+		// given up on quickly in favour of a slower fallback. Common.DNSTimeout
+		// still bounds every try, so it should suit the slowest server.
+		DNSServerTimeouts map[string]ConfigDuration
+
+		// DNSMaxInFlight, if positive, caps the DNS queries the VA has in
+		// flight at once across all of its checks, protecting the resolver
+		// from the combined fan-out of concurrent requests. Queries beyond
+		// the cap queue until others finish.
+		DNSMaxInFlight int
+
+		// DNSServerSelection is how the server for each query is chosen
+		// when several are configured: "random", the default, or
+		// "latency", which prefers the server with the lowest recent
+		// round-trip time and retries failed queries on another.
+		DNSServerSelection string
+
+		// DNSProbeCAASupport makes the VA send a CAA query for IssuerDomain
+		// to the built-in resolver at startup, and refuse to start if it
+		// is answered with NOTIMP, or not at all. Such a resolver would
+		// make every domain look like it had no CAA records.
+		DNSProbeCAASupport bool
+
+		// DNSCookies makes the VA send DNS cookies (RFC 7873) with its
+		// queries, protecting against off-path spoofing.
+		DNSCookies bool
+
+		// DNSCheckResponses makes the VA reject DNS responses whose ID or
+		// question section don't match the query sent.
+		DNSCheckResponses bool
+
+		// DNSCheckAuthority makes the VA reject DNS responses whose
+		// authority section is for a zone unrelated to the name queried,
+		// which suggests the query went to a resolver that isn't configured
+		// for its zone, e.g. one missing from DNSZoneResolvers.
+		DNSCheckAuthority bool
+
+		// CAAOverrideZoneFile, if set, is a zone file whose records answer
+		// CAA lookups for the names in it instead of DNS.
+		CAAOverrideZoneFile string
+
+		// CAARequireDNSSEC fails CAA checks unless Common.DNSResolver
+		// validated the answer with DNSSEC, as shown by the AD bit.
+		CAARequireDNSSEC bool
+
+		// CAAIgnoreDNSSECBogus treats CAA lookups that the resolver reports,
+		// with an Extended DNS Error, as having failed DNSSEC validation as
+		// if no records were found. By default such lookups fail the check.
+		CAAIgnoreDNSSECBogus bool
+
+		// CAAMaxCNAMEChain is the longest CNAME chain a CAA lookup may
+		// follow before failing. If zero, bdns.DefaultMaxCNAMEChain is used.
+		CAAMaxCNAMEChain int
+
+		// CAAQueryClass is the class CAA queries ask for, by its mnemonic,
+		// e.g. "CH". Real CAA records are always IN, the default; this is
+		// for test zones in lab setups.
+		CAAQueryClass string
 	}
 
 	SQL struct {
@@ -222,6 +522,45 @@ func (config *Config) KeyPolicy() core.KeyPolicy {
 	}
 }
 
+// Validate checks the settings every command relies on: the statsd server
+// they all report to, the syslog settings, and a server URL for each AMQP
+// section that is present. Settings particular to one command are left to
+// it.
+func (config *Config) Validate() error {
+	if config.Statsd.Server == "" {
+		return errors.New("Missing statsd server")
+	}
+	if config.Syslog.Network != "" && config.Syslog.Server == "" {
+		return fmt.Errorf("Missing syslog server for network %q", config.Syslog.Network)
+	}
+	if level := config.Syslog.StdoutLevel; level != nil && (*level < 0 || *level > 7) {
+		return fmt.Errorf("Invalid syslog stdout level %d", *level)
+	}
+	amqpConfigs := []struct {
+		name string
+		amqp *AMQPConfig
+	}{
+		{"amqp", config.AMQP},
+		{"activityMonitor", config.ActivityMonitor.AMQP},
+		{"wfe", config.WFE.AMQP},
+		{"ca", config.CA.AMQP},
+		{"ra", config.RA.AMQP},
+		{"sa", config.SA.AMQP},
+		{"va", config.VA.AMQP},
+		{"revoker", config.Revoker.AMQP},
+		{"mailer", config.Mailer.AMQP},
+		{"ocspResponder", config.OCSPResponder.AMQP},
+		{"ocspUpdater", config.OCSPUpdater.AMQP},
+		{"publisher", config.Publisher.AMQP},
+	}
+	for _, c := range amqpConfigs {
+		if c.amqp != nil && c.amqp.Server == "" && c.amqp.ServerURLFile == "" {
+			return fmt.Errorf("Missing AMQP server URL in %s", c.name)
+		}
+	}
+	return nil
+}
+
 // PasswordConfig either contains a password or the path to a file
 // containing a password
 type PasswordConfig struct {
@@ -436,6 +775,20 @@ type GoogleSafeBrowsingConfig struct {
 	DataDir string
 }
 
+// DNSOverTLSConfig describes how to verify a DNS-over-TLS resolver.
+type DNSOverTLSConfig struct {
+	// A PEM file of CA certificates to verify the resolver's certificate
+	// against. If empty, the system roots are used.
+	CACertFile string
+	// The name to verify in the resolver's certificate. If empty, the host
+	// part of the resolver address is used.
+	ServerName string
+	// Base64-encoded SHA-256 hashes of the resolver's SubjectPublicKeyInfo.
+	// If non-empty, the resolver's certificate must match one of them in
+	// addition to chaining to a trusted root.
+	SPKIPins []string
+}
+
 // SyslogConfig defines the config for syslogging.
 type SyslogConfig struct {
 	Network     string
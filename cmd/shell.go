@@ -14,10 +14,12 @@
 //      app.Run()
 //    }
 //
-// All commands share the same invocation pattern.  They take a single
+// All commands share the same invocation pattern.  They take a
 // parameter "-config", which is the name of a JSON file containing
 // the configuration for the app.  This JSON file is unmarshalled into
-// a Config object, which is provided to the app.
+// a Config object, which is provided to the app.  JSON given with
+// "-config-json", or in BOULDER_CONFIG_JSON, is applied on top of it,
+// and can stand in for the file entirely.
 
 package cmd
 
@@ -76,6 +78,11 @@ func NewAppShell(name, usage string) (shell *AppShell) {
 			EnvVar: "BOULDER_CONFIG",
 			Usage:  "Path to Config JSON",
 		},
+		cli.StringFlag{
+			Name:   "config-json",
+			EnvVar: "BOULDER_CONFIG_JSON",
+			Usage:  "Config JSON applied on top of the config file, which may then be absent",
+		},
 	}
 
 	return &AppShell{App: app}
@@ -85,12 +92,7 @@ func NewAppShell(name, usage string) (shell *AppShell) {
 // control to the default commandline action.
 func (as *AppShell) Run() {
 	as.App.Action = func(c *cli.Context) {
-		configFileName := c.GlobalString("config")
-		configJSON, err := ioutil.ReadFile(configFileName)
-		FailOnError(err, "Unable to read config file")
-
-		var config Config
-		err = json.Unmarshal(configJSON, &config)
+		config, err := LoadConfig(c.GlobalString("config"), c.GlobalString("config-json"))
 		FailOnError(err, "Failed to read configuration")
 
 		if as.Config != nil {
@@ -167,6 +169,44 @@ func (m mysqlLogger) Print(v ...interface{}) {
 	m.Err(fmt.Sprintf("[mysql] %s", fmt.Sprint(v...)))
 }
 
+// ErrNoConfig is returned by LoadConfig when neither the config file nor
+// any config JSON was given.
+var ErrNoConfig = errors.New("no config file or config JSON")
+
+// LoadConfig reads the configuration in fileName, then applies configJSON
+// on top of it: values it sets replace the file's, objects are merged field
+// by field, and arrays are replaced whole. Maps, such as the VA's
+// DNSZoneResolvers, are merged key by key, so the JSON can add or replace
+// entries but not remove the file's. The file may be missing if configJSON
+// is given, as in containerized deployments that configure everything
+// through the environment. The merged configuration must pass Validate.
+func LoadConfig(fileName, configJSON string) (Config, error) {
+	var config Config
+	fileJSON, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) && configJSON != "" {
+		fileJSON = nil
+	} else if err != nil {
+		return config, err
+	}
+	if fileJSON == nil && configJSON == "" {
+		return config, ErrNoConfig
+	}
+	if fileJSON != nil {
+		if err := json.Unmarshal(fileJSON, &config); err != nil {
+			return config, fmt.Errorf("%s: %s", fileName, err)
+		}
+	}
+	if configJSON != "" {
+		if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+			return config, fmt.Errorf("config JSON: %s", err)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
 // StatsAndLogging constructs a Statter and an AuditLogger based on its config
 // parameters, and return them both. Crashes if any setup fails.
 // Also sets the constructed AuditLogger as the default logger.
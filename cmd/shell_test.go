@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/letsencrypt/boulder/test"
@@ -51,3 +53,53 @@ func TestPAConfigUnmarshal(t *testing.T) {
 	test.AssertNotError(t, err, "Failed to unmarshal PAConfig")
 	test.AssertError(t, pc4.CheckChallenges(), "Disallow empty challenges map")
 }
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	test.AssertNotError(t, err, "Couldn't create config file")
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"statsd": {"server": "localhost:8125"}, "va": {"userAgent": "file", "issuerDomain": "letsencrypt.org", "dnsTries": 3, "dnsZoneResolvers": {"a.example": ["127.0.0.1:53"]}}}`)
+	test.AssertNotError(t, err, "Couldn't write config file")
+	f.Close()
+	missing := f.Name() + ".missing"
+
+	// File only.
+	config, err := LoadConfig(f.Name(), "")
+	test.AssertNotError(t, err, "Couldn't load config file")
+	test.AssertEquals(t, config.VA.UserAgent, "file")
+	test.AssertEquals(t, config.VA.DNSTries, 3)
+
+	// Environment only, with no config file present.
+	config, err = LoadConfig(missing, `{"statsd": {"server": "localhost:8125"}, "va": {"userAgent": "env"}}`)
+	test.AssertNotError(t, err, "Couldn't load config JSON without a file")
+	test.AssertEquals(t, config.VA.UserAgent, "env")
+	test.AssertEquals(t, config.VA.DNSTries, 0)
+
+	// Merged: the JSON overrides only the values it sets.
+	config, err = LoadConfig(f.Name(), `{"va": {"userAgent": "env", "dnsZoneResolvers": {"b.example": ["127.0.0.2:53"]}}}`)
+	test.AssertNotError(t, err, "Couldn't merge config JSON")
+	test.AssertEquals(t, config.VA.UserAgent, "env")
+	test.AssertEquals(t, config.VA.IssuerDomain, "letsencrypt.org")
+	test.AssertEquals(t, config.VA.DNSTries, 3)
+	// Maps are merged key by key.
+	test.AssertEquals(t, len(config.VA.DNSZoneResolvers), 2)
+
+	_, err = LoadConfig(missing, "")
+	test.AssertError(t, err, "Loaded config without a file or JSON")
+	_, err = LoadConfig(f.Name(), `{"va": `)
+	test.AssertError(t, err, "Loaded invalid config JSON")
+	_, err = LoadConfig(f.Name(), `{"va": {"dnsTries": "three"}}`)
+	test.AssertError(t, err, "Loaded config JSON of the wrong type")
+
+	// The merged configuration must be valid.
+	_, err = LoadConfig(missing, `{}`)
+	test.AssertError(t, err, "Loaded config without a statsd server")
+	_, err = LoadConfig(f.Name(), `{"statsd": {"server": ""}}`)
+	test.AssertError(t, err, "Loaded config JSON that removed the statsd server")
+	_, err = LoadConfig(f.Name(), `{"syslog": {"network": "udp"}}`)
+	test.AssertError(t, err, "Loaded config without a syslog server")
+	_, err = LoadConfig(f.Name(), `{"va": {"amqp": {"insecure": true}}}`)
+	test.AssertError(t, err, "Loaded config without an AMQP server URL")
+	_, err = LoadConfig(f.Name(), `{"va": {"amqp": {"serverURLFile": "amqp_url"}}}`)
+	test.AssertNotError(t, err, "Couldn't load config with an AMQP server URL file")
+}
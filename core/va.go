@@ -19,6 +19,8 @@ type ValidationAuthority interface {
 	// TODO(#1626): remove authz parameter
 	PerformValidation(string, Challenge, Authorization) ([]ValidationRecord, error)
 	IsSafeDomain(*IsSafeDomainRequest) (*IsSafeDomainResponse, error)
+	CAAPolicySummary(*CAAPolicySummaryRequest) (*CAAPolicySummary, error)
+	EvaluateCAARecords(*CAARecordsEvaluationRequest) (*CAARecordsEvaluation, error)
 }
 
 // IsSafeDomainRequest is the request struct for the IsSafeDomain call. The Domain field
@@ -33,3 +35,90 @@ type IsSafeDomainRequest struct {
 type IsSafeDomainResponse struct {
 	IsSafe bool
 }
+
+// CAAPolicySummaryRequest is the request struct for the CAAPolicySummary call.
+type CAAPolicySummaryRequest struct {
+	Domain string
+	// Verbose asks for the names queried while climbing the tree to be
+	// included in the summary.
+	Verbose bool
+}
+
+// CAAPolicySummary describes the CAA policy in effect for a domain, as found
+// by the VA, without deciding whether it permits issuance.
+type CAAPolicySummary struct {
+	Domain string
+	// Owner is the name at which the CAA records were found, which may be an
+	// ancestor of Domain. It is empty when there are none.
+	Owner string
+	// Issuers are the issue properties, which govern non-wildcard names.
+	Issuers []CAAIssuerPolicy
+	// WildcardIssuers are the properties that govern wildcard names: the
+	// issuewild properties if there are any, and otherwise the issue
+	// properties. IssuewildPresent says which.
+	WildcardIssuers  []CAAIssuerPolicy
+	IssuewildPresent bool
+	// AuthorizedIssuers lists each issuer domain named by the issue or
+	// issuewild properties once, in the order first named, whether or not
+	// it is ours.
+	AuthorizedIssuers []string
+	// Iodef are the values of the iodef properties.
+	Iodef []string
+	// UnknownCritical is true when a property we don't understand is marked
+	// critical, which prevents all issuance.
+	UnknownCritical bool
+	// Path lists the names queried for CAA records, from Domain towards the
+	// root and through any DNAME redirections, when the request was
+	// verbose.
+	Path []CAAClimbStep `json:",omitempty"`
+}
+
+// CAAClimbStep is a name queried while climbing the tree for CAA records.
+type CAAClimbStep struct {
+	Name         string
+	RecordsFound bool
+}
+
+// CAARecordsEvaluationRequest is the request struct for the
+// EvaluateCAARecords call.
+type CAARecordsEvaluationRequest struct {
+	// Domain is the name a certificate would be requested for. It may be a
+	// wildcard.
+	Domain string
+	// Records are proposed CAA records in zone file format, one per line.
+	// Blank lines and comments are ignored.
+	Records string
+	// Issuer is the CAA identity to evaluate the records for. When empty,
+	// the VA's own identities are used.
+	Issuer        string
+	ChallengeType string
+	AccountURI    string
+}
+
+// CAARecordsEvaluation is the decision the VA would reach if Records were
+// the CAA records in effect for Domain.
+type CAARecordsEvaluation struct {
+	Valid bool
+	// Relevant is false when none of the records bear on issuance for
+	// Domain, which allows it.
+	Relevant bool
+	// Issuer is the CAA identity the records authorized, when valid.
+	Issuer string `json:",omitempty"`
+	// Detail is the problem detail an ACME client would be given, when not
+	// valid.
+	Detail string `json:",omitempty"`
+	// AllowedMethods are the validation methods the records permit, when
+	// they name the issuer but not for ChallengeType.
+	AllowedMethods []string `json:",omitempty"`
+}
+
+// CAAIssuerPolicy is a single issue or issuewild property.
+type CAAIssuerPolicy struct {
+	// Issuer is the issuer domain, or empty for ";", which authorizes no one.
+	Issuer string
+	// ValidationMethods are the methods the property permits. It is nil when
+	// the property doesn't restrict them.
+	ValidationMethods []string `json:",omitempty"`
+	// Parameters holds every parameter, including validationmethods.
+	Parameters map[string]string `json:",omitempty"`
+}
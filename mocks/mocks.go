@@ -322,10 +322,11 @@ func (*Publisher) SubmitToCT([]byte) error {
 }
 
 // Statter is a stat counter that is a no-op except for locally handling Inc
-// calls (which are most of what we use).
+// and Timing calls (which are most of what we use).
 type Statter struct {
 	statsd.NoopClient
 	Counters map[string]int64
+	Timings  map[string][]int64
 }
 
 // Inc increments the indicated metric by the indicated value, in the Counters
@@ -335,9 +336,16 @@ func (s *Statter) Inc(metric string, value int64, rate float32) error {
 	return nil
 }
 
+// Timing appends the indicated value to the indicated metric's observations,
+// in the Timings map maintained by the statter
+func (s *Statter) Timing(metric string, value int64, rate float32) error {
+	s.Timings[metric] = append(s.Timings[metric], value)
+	return nil
+}
+
 // NewStatter returns an empty statter with all counters zero
 func NewStatter() Statter {
-	return Statter{statsd.NoopClient{}, map[string]int64{}}
+	return Statter{statsd.NoopClient{}, map[string]int64{}, map[string][]int64{}}
 }
 
 // Mailer is a mock
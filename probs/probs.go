@@ -16,6 +16,7 @@ const (
 	RateLimitedProblem    = ProblemType("urn:acme:error:rateLimited")
 	BadNonceProblem       = ProblemType("urn:acme:error:badNonce")
 	InvalidEmailProblem   = ProblemType("urn:acme:error:invalidEmail")
+	CAAProblem            = ProblemType("urn:acme:error:caa")
 )
 
 // ProblemType defines the error types in the ACME protocol
@@ -51,7 +52,7 @@ func ProblemDetailsToStatusCode(prob *ProblemDetails) int {
 		return http.StatusBadRequest
 	case ServerInternalProblem:
 		return http.StatusInternalServerError
-	case UnauthorizedProblem:
+	case UnauthorizedProblem, CAAProblem:
 		return http.StatusForbidden
 	case RateLimitedProblem:
 		return statusTooManyRequests
@@ -123,6 +124,16 @@ func Unauthorized(detail string) *ProblemDetails {
 	}
 }
 
+// CAA returns a ProblemDetails with a CAAProblem and a 403 Forbidden status
+// code, for when CAA records prevent issuance.
+func CAA(detail string) *ProblemDetails {
+	return &ProblemDetails{
+		Type:       CAAProblem,
+		Detail:     detail,
+		HTTPStatus: http.StatusForbidden,
+	}
+}
+
 // MethodNotAllowed returns a ProblemDetails representing a disallowed HTTP
 // method error.
 func MethodNotAllowed() *ProblemDetails {
@@ -30,6 +30,7 @@ func TestProblemDetailsToStatusCode(t *testing.T) {
 		{&ProblemDetails{Type: RateLimitedProblem}, statusTooManyRequests},
 		{&ProblemDetails{Type: BadNonceProblem}, http.StatusBadRequest},
 		{&ProblemDetails{Type: InvalidEmailProblem}, http.StatusBadRequest},
+		{&ProblemDetails{Type: CAAProblem}, http.StatusForbidden},
 		{&ProblemDetails{Type: "foo"}, http.StatusInternalServerError},
 		{&ProblemDetails{Type: "foo", HTTPStatus: 200}, 200},
 		{&ProblemDetails{Type: ConnectionProblem, HTTPStatus: 200}, 200},
@@ -60,6 +60,14 @@ func (dva *DummyValidationAuthority) IsSafeDomain(req *core.IsSafeDomainRequest)
 	return &core.IsSafeDomainResponse{IsSafe: !dva.IsNotSafe}, nil
 }
 
+func (dva *DummyValidationAuthority) CAAPolicySummary(req *core.CAAPolicySummaryRequest) (*core.CAAPolicySummary, error) {
+	return &core.CAAPolicySummary{Domain: req.Domain}, nil
+}
+
+func (dva *DummyValidationAuthority) EvaluateCAARecords(req *core.CAARecordsEvaluationRequest) (*core.CAARecordsEvaluation, error) {
+	return &core.CAARecordsEvaluation{Valid: true}, nil
+}
+
 var (
 	SupportedChallenges = map[string]bool{
 		core.ChallengeTypeHTTP01:   true,
@@ -49,6 +49,8 @@ const (
 	MethodUpdateValidations                 = "UpdateValidations"                 // VA
 	MethodPerformValidation                 = "PerformValidation"                 // VA
 	MethodIsSafeDomain                      = "IsSafeDomain"                      // VA
+	MethodCAAPolicySummary                  = "CAAPolicySummary"                  // VA
+	MethodEvaluateCAARecords                = "EvaluateCAARecords"                // VA
 	MethodIssueCertificate                  = "IssueCertificate"                  // CA
 	MethodGenerateOCSP                      = "GenerateOCSP"                      // CA
 	MethodGetRegistration                   = "GetRegistration"                   // SA
@@ -607,6 +609,34 @@ func NewValidationAuthorityServer(rpc Server, impl core.ValidationAuthority) (er
 		return json.Marshal(resp)
 	})
 
+	rpc.Handle(MethodCAAPolicySummary, func(req []byte) ([]byte, error) {
+		r := &core.CAAPolicySummaryRequest{}
+		if err := json.Unmarshal(req, r); err != nil {
+			// AUDIT[ Improper Messages ] 0786b6f2-91ca-4f48-9883-842a19084c64
+			improperMessage(MethodCAAPolicySummary, err, req)
+			return nil, err
+		}
+		resp, err := impl.CAAPolicySummary(r)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	})
+
+	rpc.Handle(MethodEvaluateCAARecords, func(req []byte) ([]byte, error) {
+		r := &core.CAARecordsEvaluationRequest{}
+		if err := json.Unmarshal(req, r); err != nil {
+			// AUDIT[ Improper Messages ] 0786b6f2-91ca-4f48-9883-842a19084c64
+			improperMessage(MethodEvaluateCAARecords, err, req)
+			return nil, err
+		}
+		resp, err := impl.EvaluateCAARecords(r)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	})
+
 	return nil
 }
 
@@ -679,6 +709,44 @@ func (vac ValidationAuthorityClient) IsSafeDomain(req *core.IsSafeDomainRequest)
 	return resp, nil
 }
 
+// CAAPolicySummary returns a description of the CAA policy in effect for the
+// domain given.
+func (vac ValidationAuthorityClient) CAAPolicySummary(req *core.CAAPolicySummaryRequest) (*core.CAAPolicySummary, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	jsonResp, err := vac.rpc.DispatchSync(MethodCAAPolicySummary, data)
+	if err != nil {
+		return nil, err
+	}
+	resp := &core.CAAPolicySummary{}
+	err = json.Unmarshal(jsonResp, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// EvaluateCAARecords returns the decision the VA would reach on the proposed
+// CAA records given, without looking any up.
+func (vac ValidationAuthorityClient) EvaluateCAARecords(req *core.CAARecordsEvaluationRequest) (*core.CAARecordsEvaluation, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	jsonResp, err := vac.rpc.DispatchSync(MethodEvaluateCAARecords, data)
+	if err != nil {
+		return nil, err
+	}
+	resp := &core.CAARecordsEvaluation{}
+	err = json.Unmarshal(jsonResp, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
 // NewPublisherServer creates a new server that wraps a CT publisher
 func NewPublisherServer(rpc Server, impl core.Publisher) (err error) {
 	rpc.Handle(MethodSubmitToCT, func(req []byte) (response []byte, err error) {
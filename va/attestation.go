@@ -0,0 +1,119 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// CAAAttestation is a signed statement of the outcome of a CAA check, for
+// operators who retain their decisions as evidence of due diligence.
+type CAAAttestation struct {
+	Domain    string
+	Issuer    string
+	Valid     bool
+	CheckedAt time.Time
+	// Signature is over the JSON encoding of the attestation without it,
+	// hashed with SHA-256: PKCS #1 v1.5 for RSA keys, and ASN.1 encoded
+	// for ECDSA keys.
+	Signature []byte `json:",omitempty"`
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// errBadAttestationSignature is returned when an attestation's signature
+// doesn't verify.
+var errBadAttestationSignature = errors.New("CAA attestation signature doesn't verify")
+
+// digest returns the SHA-256 hash of what the attestation's signature is
+// over.
+func (a CAAAttestation) digest() ([]byte, error) {
+	a.Signature = nil
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(payload)
+	return sum[:], nil
+}
+
+// attestCAA signs a statement of decision for domain with
+// CAAAttestationSigner.
+func (va *ValidationAuthorityImpl) attestCAA(domain string, decision caaDecision) (*CAAAttestation, error) {
+	issuer := decision.issuer
+	if issuer == "" {
+		issuer = va.IssuerDomain
+	}
+	a := &CAAAttestation{
+		Domain:    domain,
+		Issuer:    issuer,
+		Valid:     decision.valid,
+		CheckedAt: va.clk.Now().UTC(),
+	}
+	digest, err := a.digest()
+	if err != nil {
+		return nil, err
+	}
+	a.Signature, err = va.CAAAttestationSigner.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// logCAAAttestation writes a signed attestation of decision for domain to
+// the audit log. A failure to sign is logged, but doesn't affect the check.
+func (va *ValidationAuthorityImpl) logCAAAttestation(domain string, decision caaDecision) {
+	a, err := va.attestCAA(domain, decision)
+	if err != nil {
+		va.stats.Inc("VA.CAA.AttestationErrors", 1, 1.0)
+		va.log.Err(fmt.Sprintf("Failed to sign CAA attestation for %s: %s", domain, err))
+		return
+	}
+	// An attestation always encodes.
+	encoded, _ := json.Marshal(a)
+	va.log.AuditNotice(fmt.Sprintf("CAA attestation for %s: %s", domain, encoded))
+}
+
+// VerifyCAAAttestation checks that a was signed by the private key matching
+// pub, which must be an RSA or ECDSA public key.
+func VerifyCAAAttestation(pub crypto.PublicKey, a *CAAAttestation) error {
+	digest, err := a.digest()
+	if err != nil {
+		return err
+	}
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, a.Signature) != nil {
+			return errBadAttestationSignature
+		}
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		rest, err := asn1.Unmarshal(a.Signature, &sig)
+		if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+			return errBadAttestationSignature
+		}
+		if !ecdsa.Verify(key, digest, sig.R, sig.S) {
+			return errBadAttestationSignature
+		}
+	default:
+		return fmt.Errorf("unsupported attestation key type %T", pub)
+	}
+	return nil
+}
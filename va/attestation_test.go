@@ -0,0 +1,85 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/test"
+)
+
+func TestCAAAttestation(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.AssertNotError(t, err, "Failed to generate ECDSA key")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	test.AssertNotError(t, err, "Failed to generate RSA key")
+
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	va.IssuerDomain = "letsencrypt.org"
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		va.CAAAttestationSigner = key
+		a, err := va.attestCAA("example.com", caaDecision{valid: false})
+		test.AssertNotError(t, err, "Failed to sign attestation")
+		test.AssertEquals(t, a.Domain, "example.com")
+		test.AssertEquals(t, a.Issuer, "letsencrypt.org")
+		test.AssertEquals(t, a.CheckedAt, va.clk.Now().UTC())
+		test.AssertNotError(t, VerifyCAAAttestation(key.Public(), a), "Attestation should verify")
+
+		// Tampering with the decision breaks the signature.
+		a.Valid = true
+		test.AssertEquals(t, VerifyCAAAttestation(key.Public(), a), errBadAttestationSignature)
+	}
+
+	// Another key's signature doesn't verify.
+	va.CAAAttestationSigner = ecKey
+	a, err := va.attestCAA("example.com", caaDecision{valid: true})
+	test.AssertNotError(t, err, "Failed to sign attestation")
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.AssertNotError(t, err, "Failed to generate ECDSA key")
+	test.AssertEquals(t, VerifyCAAAttestation(otherKey.Public(), a), errBadAttestationSignature)
+
+	// Nor does one that isn't an ASN.1 signature at all.
+	a.Signature = []byte("not a signature")
+	test.AssertEquals(t, VerifyCAAAttestation(ecKey.Public(), a), errBadAttestationSignature)
+}
+
+func TestCAAAttestationLogged(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.AssertNotError(t, err, "Failed to generate ECDSA key")
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAAttestationSigner = key
+	log.Clear()
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "reserved.com"}
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "reserved.com should be refused")
+
+	prefix := "CAA attestation for reserved.com: "
+	lines := log.GetAllMatching(prefix)
+	test.AssertEquals(t, len(lines), 1)
+	encoded := lines[0].Message[strings.Index(lines[0].Message, prefix)+len(prefix):]
+	var a CAAAttestation
+	test.AssertNotError(t, json.Unmarshal([]byte(encoded), &a), "Failed to decode attestation")
+	test.Assert(t, !a.Valid, "Attestation should record the refusal")
+	test.AssertNotError(t, VerifyCAAAttestation(key.Public(), &a), "Logged attestation should verify")
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"fmt"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type caaAccountURIKey struct{}
+
+// withCAAAccountURI returns a context whose CAA checks are made on behalf
+// of the account with the given URI, so that issue properties bound to
+// another account with an accounturi parameter (RFC 8657) don't authorize
+// them. An empty URI leaves ctx as it is.
+func withCAAAccountURI(ctx context.Context, uri string) context.Context {
+	if uri == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, caaAccountURIKey{}, uri)
+}
+
+// caaAccountURIFrom returns the account URI attached to ctx by
+// withCAAAccountURI, or "" if there is none.
+func caaAccountURIFrom(ctx context.Context) string {
+	uri, _ := ctx.Value(caaAccountURIKey{}).(string)
+	return uri
+}
+
+// caaAccountURI returns the URI of the account with the given registration
+// ID, as it would appear in an accounturi parameter, or "" if
+// CAAAccountURIPrefix isn't set.
+func (va *ValidationAuthorityImpl) caaAccountURI(regID int64) string {
+	if va.CAAAccountURIPrefix == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%d", va.CAAAccountURIPrefix, regID)
+}
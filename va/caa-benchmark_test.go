@@ -0,0 +1,137 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/core"
+	blog "github.com/letsencrypt/boulder/log"
+	"github.com/letsencrypt/boulder/mocks"
+)
+
+// memoryResolver answers CAA lookups from a map, without any of the mock's
+// logic, so that benchmarks measure the VA rather than the resolver.
+type memoryResolver struct {
+	bdns.MockDNSResolver
+	records map[string][]*dns.CAA
+}
+
+func (mr *memoryResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	return mr.records[domain], nil, nil
+}
+
+// benchmarkVA returns a VA using resolver, logging to the returned writer
+// rather than stdout. Call clearLog every so often, as the writer keeps
+// every message.
+func benchmarkVA(b *testing.B, resolver bdns.DNSResolver) (*ValidationAuthorityImpl, *mocks.SyslogWriter) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	writer := mocks.NewSyslogWriter()
+	logger, err := blog.NewAuditLogger(writer, stats, -1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	va.log = logger
+	return va, writer
+}
+
+// clearLog empties writer every 1000 iterations, outside the timer.
+func clearLog(b *testing.B, writer *mocks.SyslogWriter, i int) {
+	if i%1000 == 999 {
+		b.StopTimer()
+		writer.Clear()
+		b.StartTimer()
+	}
+}
+
+// benchmarkGetCAASet climbs a name of the given depth to size records at
+// example.com.
+func benchmarkGetCAASet(b *testing.B, depth, size int) {
+	records := make([]*dns.CAA, size)
+	for i := range records {
+		records[i] = &dns.CAA{Tag: "issue", Value: fmt.Sprintf("ca%d.example.net", i)}
+	}
+	va, writer := benchmarkVA(b, &memoryResolver{records: map[string][]*dns.CAA{"example.com": records}})
+	name := strings.Repeat("a.", depth-2) + "example.com"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := va.getCAASet(context.Background(), name); err != nil {
+			b.Fatal(err)
+		}
+		clearLog(b, writer, i)
+	}
+}
+
+func BenchmarkGetCAASetDepth2Records0(b *testing.B)  { benchmarkGetCAASet(b, 2, 0) }
+func BenchmarkGetCAASetDepth2Records1(b *testing.B)  { benchmarkGetCAASet(b, 2, 1) }
+func BenchmarkGetCAASetDepth2Records50(b *testing.B) { benchmarkGetCAASet(b, 2, 50) }
+func BenchmarkGetCAASetDepth5Records1(b *testing.B)  { benchmarkGetCAASet(b, 5, 1) }
+func BenchmarkGetCAASetDepth10Records1(b *testing.B) { benchmarkGetCAASet(b, 10, 1) }
+func BenchmarkGetCAASetDepth20Records0(b *testing.B) { benchmarkGetCAASet(b, 20, 0) }
+func BenchmarkGetCAASetDepth20Records1(b *testing.B) { benchmarkGetCAASet(b, 20, 1) }
+
+// benchmarkCheckCAA runs whole checks, without the result cache, against
+// records at example.com.
+func benchmarkCheckCAA(b *testing.B, records []*dns.CAA) {
+	va, writer := benchmarkVA(b, &memoryResolver{records: map[string][]*dns.CAA{"example.com": records}})
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "www.example.com"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+		clearLog(b, writer, i)
+	}
+}
+
+func BenchmarkCheckCAAAbsent(b *testing.B) { benchmarkCheckCAA(b, nil) }
+
+func BenchmarkCheckCAAAllowed(b *testing.B) {
+	benchmarkCheckCAA(b, []*dns.CAA{
+		{Tag: "issue", Value: "letsencrypt.org"},
+	})
+}
+
+func BenchmarkCheckCAAOtherCA(b *testing.B) {
+	benchmarkCheckCAA(b, []*dns.CAA{
+		{Tag: "issue", Value: "example.net"},
+	})
+}
+
+func BenchmarkCheckCAAManyIssuers(b *testing.B) {
+	benchmarkCheckCAA(b, []*dns.CAA{
+		{Tag: "issue", Value: "example.net"},
+		{Tag: "issue", Value: "example.org"},
+		{Tag: "issue", Value: "example.info"},
+		{Tag: "issue", Value: "letsencrypt.org"},
+		{Tag: "issuewild", Value: ";"},
+		{Tag: "iodef", Value: "mailto:security@example.com"},
+	})
+}
+
+func BenchmarkCheckCAAParameters(b *testing.B) {
+	benchmarkCheckCAA(b, []*dns.CAA{
+		{Tag: "issue", Value: "letsencrypt.org; validationmethods=http-01,dns-01"},
+	})
+}
+
+func BenchmarkCheckCAACriticalUnknown(b *testing.B) {
+	benchmarkCheckCAA(b, []*dns.CAA{
+		{Flag: 128, Tag: "tbs", Value: "x"},
+		{Tag: "issue", Value: "letsencrypt.org"},
+	})
+}
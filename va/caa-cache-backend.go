@@ -0,0 +1,164 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+)
+
+// CAACache stores encoded CAA decisions for the CAA result cache. The default
+// is held in memory by each VA; an external one, such as a memcached
+// cluster, lets VA replicas share their decisions. Implementations must be
+// safe for concurrent use.
+type CAACache interface {
+	// Get returns the value stored under key, unless it has expired.
+	Get(key string) ([]byte, bool)
+	// Set stores value under key until ttl has passed. It may drop the
+	// value, or expire it early, but must never keep it for longer.
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// CAACacheConfig holds the settings passed to a CAACacheFactory.
+type CAACacheConfig struct {
+	Servers []string
+	Clock   clock.Clock
+}
+
+// CAACacheFactory constructs a CAACache from config.
+type CAACacheFactory func(config CAACacheConfig) (CAACache, error)
+
+var (
+	caaCachesMu sync.Mutex
+	caaCaches   = make(map[string]CAACacheFactory)
+)
+
+// RegisterCAACache makes a CAA cache implementation available by name to
+// NewRegisteredCAACache. It is intended to be called from an init function,
+// and panics if name is already registered or factory is nil.
+func RegisterCAACache(name string, factory CAACacheFactory) {
+	caaCachesMu.Lock()
+	defer caaCachesMu.Unlock()
+	if factory == nil {
+		panic("va: RegisterCAACache factory is nil")
+	}
+	if _, dup := caaCaches[name]; dup {
+		panic("va: RegisterCAACache called twice for " + name)
+	}
+	caaCaches[name] = factory
+}
+
+// NewRegisteredCAACache constructs the CAA cache registered under name.
+func NewRegisteredCAACache(name string, config CAACacheConfig) (CAACache, error) {
+	caaCachesMu.Lock()
+	factory, ok := caaCaches[name]
+	caaCachesMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown CAA cache implementation %q (registered: %v)", name, RegisteredCAACaches())
+	}
+	return factory(config)
+}
+
+// RegisteredCAACaches returns the sorted names of the registered CAA cache
+// implementations.
+func RegisteredCAACaches() []string {
+	caaCachesMu.Lock()
+	defer caaCachesMu.Unlock()
+	var names []string
+	for name := range caaCaches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UseCAACache replaces the in-memory CAA result cache with cache.
+func (va *ValidationAuthorityImpl) UseCAACache(cache CAACache) {
+	va.caaResults = cache
+}
+
+// caaDecisionJSON is the encoding of a caaDecision in a CAACache.
+type caaDecisionJSON struct {
+	Present        bool          `json:"present,omitempty"`
+	Valid          bool          `json:"valid,omitempty"`
+	Relevant       bool          `json:"relevant,omitempty"`
+	Owner          string        `json:"owner,omitempty"`
+	RecordTTL      time.Duration `json:"recordTTL,omitempty"`
+	Synthesized    bool          `json:"synthesized,omitempty"`
+	Reason         caaReason     `json:"reason,omitempty"`
+	Method         string        `json:"method,omitempty"`
+	AllowedMethods []string      `json:"allowedMethods,omitempty"`
+	Iodefs         []IodefTarget `json:"iodefs,omitempty"`
+	Issuer         string        `json:"issuer,omitempty"`
+}
+
+func encodeCAADecision(d caaDecision) ([]byte, error) {
+	return json.Marshal(caaDecisionJSON{
+		Present:        d.present,
+		Valid:          d.valid,
+		Relevant:       d.relevant,
+		Owner:          d.owner,
+		RecordTTL:      d.recordTTL,
+		Synthesized:    d.synthesized,
+		Reason:         d.reason,
+		Method:         d.method,
+		AllowedMethods: d.allowedMethods,
+		Iodefs:         d.iodefs,
+		Issuer:         d.issuer,
+	})
+}
+
+func decodeCAADecision(b []byte) (caaDecision, error) {
+	var d caaDecisionJSON
+	if err := json.Unmarshal(b, &d); err != nil {
+		return caaDecision{}, err
+	}
+	return caaDecision{
+		present:        d.Present,
+		valid:          d.Valid,
+		relevant:       d.Relevant,
+		owner:          d.Owner,
+		recordTTL:      d.RecordTTL,
+		synthesized:    d.Synthesized,
+		reason:         d.Reason,
+		method:         d.Method,
+		allowedMethods: d.AllowedMethods,
+		iodefs:         d.Iodefs,
+		issuer:         d.Issuer,
+	}, nil
+}
+
+// loadCAADecision returns the decision cached under key, if any. A value
+// that can't be decoded, e.g. one written by a different version to a
+// shared cache, is treated as a miss.
+func (va *ValidationAuthorityImpl) loadCAADecision(key caaResultKey) (caaDecision, bool) {
+	b, ok := va.caaResults.Get(key.String())
+	if !ok {
+		return caaDecision{}, false
+	}
+	decision, err := decodeCAADecision(b)
+	if err != nil {
+		va.log.Warning(fmt.Sprintf("Undecodable CAA cache entry for %s: %s", key, err))
+		va.stats.Inc("VA.CAA.ResultCache.DecodeErrors", 1, 1.0)
+		return caaDecision{}, false
+	}
+	return decision, true
+}
+
+// storeCAADecision caches decision under key for ttl.
+func (va *ValidationAuthorityImpl) storeCAADecision(key caaResultKey, decision caaDecision, ttl time.Duration) {
+	b, err := encodeCAADecision(decision)
+	if err != nil {
+		va.log.Warning(fmt.Sprintf("Couldn't encode CAA decision for %s: %s", key, err))
+		return
+	}
+	va.caaResults.Set(key.String(), b, ttl)
+}
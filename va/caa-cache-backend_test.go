@@ -0,0 +1,159 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// externalCAACache stands in for a cache shared between VAs. Like one, it
+// only ever sees encoded values, and copies them in and out.
+type externalCAACache struct {
+	sync.Mutex
+	clk     clock.Clock
+	values  map[string][]byte
+	expires map[string]time.Time
+}
+
+func (ec *externalCAACache) Get(key string) ([]byte, bool) {
+	ec.Lock()
+	defer ec.Unlock()
+	if !ec.clk.Now().Before(ec.expires[key]) {
+		return nil, false
+	}
+	return append([]byte(nil), ec.values[key]...), true
+}
+
+func (ec *externalCAACache) Set(key string, value []byte, ttl time.Duration) {
+	ec.Lock()
+	defer ec.Unlock()
+	ec.values[key] = append([]byte(nil), value...)
+	ec.expires[key] = ec.clk.Now().Add(ttl)
+}
+
+func init() {
+	RegisterCAACache("test-external", func(config CAACacheConfig) (CAACache, error) {
+		return &externalCAACache{
+			clk:     config.Clock,
+			values:  make(map[string][]byte),
+			expires: make(map[string]time.Time),
+		}, nil
+	})
+}
+
+// testCAACacheContract checks the behaviour every CAACache must have.
+func testCAACacheContract(t *testing.T, cache CAACache, fc clock.FakeClock) {
+	_, ok := cache.Get("caa example.com letsencrypt.org http-01 ")
+	test.Assert(t, !ok, "Empty cache returned a value")
+
+	cache.Set("caa example.com letsencrypt.org http-01 ", []byte("one"), time.Minute)
+	cache.Set("caa example.net letsencrypt.org http-01 ", []byte("two"), 2*time.Minute)
+	value, ok := cache.Get("caa example.com letsencrypt.org http-01 ")
+	test.Assert(t, ok, "Stored value not returned")
+	test.AssertEquals(t, string(value), "one")
+
+	// Values are never returned once their TTL has passed.
+	fc.Add(time.Minute)
+	_, ok = cache.Get("caa example.com letsencrypt.org http-01 ")
+	test.Assert(t, !ok, "Expired value returned")
+}
+
+func TestCAACacheContract(t *testing.T) {
+	fc := clock.NewFake()
+	testCAACacheContract(t, newCAAResultCache(fc), fc)
+
+	fc = clock.NewFake()
+	external, err := NewRegisteredCAACache("test-external", CAACacheConfig{Clock: fc})
+	test.AssertNotError(t, err, "Couldn't construct registered CAA cache")
+	testCAACacheContract(t, external, fc)
+
+	_, err = NewRegisteredCAACache("no-such-cache", CAACacheConfig{Clock: fc})
+	test.AssertError(t, err, "Unregistered CAA cache constructed")
+}
+
+func TestCAADecisionEncoding(t *testing.T) {
+	decision := caaDecision{
+		present:        true,
+		relevant:       true,
+		owner:          "example.com",
+		recordTTL:      time.Hour,
+		reason:         caaMethodNotAllowed,
+		method:         core.ChallengeTypeHTTP01,
+		allowedMethods: []string{core.ChallengeTypeDNS01},
+		iodefs:         []IodefTarget{{Scheme: "mailto", Target: "security@example.com"}},
+	}
+	b, err := encodeCAADecision(decision)
+	test.AssertNotError(t, err, "Couldn't encode decision")
+	decoded, err := decodeCAADecision(b)
+	test.AssertNotError(t, err, "Couldn't decode decision")
+	test.AssertDeepEquals(t, decoded, decision)
+}
+
+func TestExternalCAACache(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	fc := clock.NewFake()
+	external, err := NewRegisteredCAACache("test-external", CAACacheConfig{Clock: fc})
+	test.AssertNotError(t, err, "Couldn't construct registered CAA cache")
+
+	// Two VAs sharing the cache only look the records up once.
+	resolver := &countingResolver{}
+	newVA := func() *ValidationAuthorityImpl {
+		va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, fc)
+		va.DNSResolver = resolver
+		va.IssuerDomain = "letsencrypt.org"
+		va.CAAResultCacheTTL = time.Minute
+		va.CAACacheMinTTL = time.Minute
+		va.UseCAACache(external)
+		return va
+	}
+	a, b := newVA(), newVA()
+	present := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+	reserved := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "reserved.com"}
+	prob := a.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "present.com should be allowed")
+	lookups := resolver.count()
+	prob = b.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "present.com should be allowed from the shared cache")
+	test.AssertEquals(t, resolver.count(), lookups)
+
+	// Denials are cached just the same.
+	a.checkCAA(context.Background(), reserved, core.ChallengeTypeHTTP01)
+	lookups = resolver.count()
+	prob = b.checkCAA(context.Background(), reserved, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "reserved.com should be denied from the shared cache")
+	test.AssertEquals(t, resolver.count(), lookups)
+
+	// An undecodable value is a miss.
+	external.Set(b.caaResultKeyFor(context.Background(), present, "letsencrypt.org", core.ChallengeTypeHTTP01).String(), []byte("garbage"), time.Minute)
+	prob = b.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "present.com should be allowed after a bad cache entry")
+	test.Assert(t, resolver.count() > lookups, "Bad cache entry should have been looked up again")
+	test.AssertEquals(t, b.CAACacheStats(), CAACacheStats{})
+
+	// A VA whose CAA settings differ doesn't reuse the others' decisions.
+	c := newVA()
+	c.CAAIssuewildFallback = true
+	lookups = resolver.count()
+	prob = c.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "present.com should be allowed")
+	test.Assert(t, resolver.count() > lookups, "Differently configured VA used a shared decision")
+
+	// Reloading one VA's CAA identities leaves the shared cache alone.
+	test.AssertNotError(t, a.loadCAAIdentities([]byte(`{"Identities": []}`), nil), "Couldn't load CAA identities")
+	lookups = resolver.count()
+	prob = b.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "present.com should be allowed from the shared cache")
+	test.AssertEquals(t, resolver.count(), lookups)
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/core"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+// MaxCAAResultCacheTTL bounds how long a CAA decision may be reused. It is
+// kept well under the window in which CAA must be rechecked before issuance.
+const MaxCAAResultCacheTTL = 15 * time.Minute
+
+// caaRecheckWindow is the longest a CAA decision may be relied upon before
+// the records have to be checked again.
+const caaRecheckWindow = 8 * time.Hour
+
+// caaCacheJitter is the largest fraction by which a cache entry's lifetime
+// is randomly shortened, so that entries stored together don't all expire,
+// and get re-queried, at the same moment. Entries are only ever shortened,
+// so they stay within the recheck window.
+const caaCacheJitter = 0.1
+
+// caaResultKey holds every input that can change the outcome of a CAA check.
+type caaResultKey struct {
+	// policy is a hash of the VA's CAA settings, from caaPolicyHash.
+	policy   string
+	domain   string
+	wildcard bool
+	issuer   string
+	method   string
+	// account is the URI of the account the check was made for, if
+	// accounturi parameters are enforced.
+	account string
+}
+
+func newCAAResultKey(domain, issuer, method string) caaResultKey {
+	domain = strings.TrimRight(strings.ToLower(domain), ".")
+	wildcard := strings.HasPrefix(domain, "*.")
+	return caaResultKey{
+		domain:   strings.TrimPrefix(domain, "*."),
+		wildcard: wildcard,
+		issuer:   issuer,
+		method:   method,
+	}
+}
+
+// caaResultKeyFor returns the key for a check of identifier made with ctx,
+// which carries the account the check is for, if any.
+func (va *ValidationAuthorityImpl) caaResultKeyFor(ctx context.Context, identifier core.AcmeIdentifier, issuer, method string) caaResultKey {
+	key := newCAAResultKey(identifier.Value, issuer, method)
+	key.policy = va.caaPolicyHash()
+	key.account = caaAccountURIFrom(ctx)
+	return key
+}
+
+// caaPolicyHash returns a short hash of the VA's settings, other than the
+// issuer and account already in the key, that can change a CAA decision.
+// VAs sharing an external cache only reuse each other's decisions when
+// they are configured alike, and a change to the CAA identities file
+// leaves the decisions made under the old flags behind.
+func (va *ValidationAuthorityImpl) caaPolicyHash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "fallback=%q ruleset=%q issuewildFallback=%t\n",
+		va.CAAFallbackIssuerDomain, va.CAARuleset, va.CAAIssuewildFallback)
+	fmt.Fprintf(h, "delegation=%q %q\n", va.CAADelegationParameter, va.CAADelegationValues)
+	fmt.Fprintf(h, "skipLabels=%q registeredShortcut=%t requireRegistered=%t\n",
+		va.CAASkipLabelPrefixes, va.CAARegisteredDomainShortcut, va.CAARequireRegisteredDomainAnswer)
+	fmt.Fprintf(h, "blankErrors=%t lameErrors=%t strictAncestors=%t\n",
+		va.CAABlankRecordsAreErrors, va.CAALameDelegationsAreErrors, va.CAAStrictAncestorErrors)
+	// Map entries are written in a fixed order.
+	var lines []string
+	for identity, methods := range va.CAAIssuerMethodPolicies {
+		lines = append(lines, fmt.Sprintf("methodPolicy %q=%q\n", identity, methods))
+	}
+	if va.caaIdentities != nil {
+		va.caaIdentities.RLock()
+		for identity, enabled := range va.caaIdentities.enabled {
+			lines = append(lines, fmt.Sprintf("identity %q=%t\n", identity, enabled))
+		}
+		va.caaIdentities.RUnlock()
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		io.WriteString(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// String renders the key for a CAACache. Policy hashes, domains, issuers
+// and challenge types never contain spaces, and neither do account URIs.
+func (k caaResultKey) String() string {
+	domain := k.domain
+	if k.wildcard {
+		domain = "*." + domain
+	}
+	return fmt.Sprintf("caa %s %s %s %s %s", k.policy, domain, k.issuer, k.method, k.account)
+}
+
+type caaCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// caaResultCache is the default, in-memory CAACache. It remembers recent CAA
+// decisions so that identical checks repeated in a burst (e.g. a retried
+// order) don't redo the DNS work. Only successful decisions are stored;
+// errors are always retried.
+type caaResultCache struct {
+	sync.Mutex
+	clk       clock.Clock
+	entries   map[string]caaCacheEntry
+	nextSweep time.Time
+
+	hits, misses, evictions int64
+}
+
+// CAACacheStats describes the CAA result cache's effectiveness since startup.
+type CAACacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Entries   int   `json:"entries"`
+	Evictions int64 `json:"evictions"`
+}
+
+func newCAAResultCache(clk clock.Clock) *caaResultCache {
+	return &caaResultCache{
+		clk:     clk,
+		entries: make(map[string]caaCacheEntry),
+	}
+}
+
+// Get returns the unexpired value stored for key, if any.
+func (c *caaResultCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	if !c.clk.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		c.evictions++
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.value, true
+}
+
+// Set stores value under key for ttl, less a random jitter of up to
+// caaCacheJitter of ttl. Expired entries are swept out at
+// most once per ttl so that keys which are never looked up again don't pile
+// up.
+func (c *caaResultCache) Set(key string, value []byte, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.clk.Now()
+	if !now.Before(c.nextSweep) {
+		for k, v := range c.entries {
+			if !now.Before(v.expires) {
+				delete(c.entries, k)
+				c.evictions++
+			}
+		}
+		c.nextSweep = now.Add(ttl)
+	}
+	jitter := time.Duration(rand.Int63n(int64(float64(ttl)*caaCacheJitter) + 1))
+	c.entries[key] = caaCacheEntry{value: value, expires: now.Add(ttl - jitter)}
+}
+
+// Clear drops every stored value.
+func (c *caaResultCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.evictions += int64(len(c.entries))
+	c.entries = make(map[string]caaCacheEntry)
+}
+
+func (c *caaResultCache) stats() CAACacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return CAACacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Entries:   len(c.entries),
+		Evictions: c.evictions,
+	}
+}
+
+// CAACacheStats returns the CAA result cache's counters, for operators
+// tuning CAAResultCacheTTL. They are all zero when an external cache is used,
+// which is expected to keep its own.
+func (va *ValidationAuthorityImpl) CAACacheStats() CAACacheStats {
+	if c, ok := va.caaResults.(*caaResultCache); ok {
+		return c.stats()
+	}
+	return CAACacheStats{}
+}
+
+// caaChallengeTypes are the challenge types a CAA decision is cached for
+// when warming the cache.
+var caaChallengeTypes = []string{core.ChallengeTypeHTTP01, core.ChallengeTypeTLSSNI01, core.ChallengeTypeDNS01}
+
+// WarmCAACache looks up the CAA records for each of domains and stores the
+// resulting decisions for every challenge type in the CAA result cache, so
+// that an expected wave of validations for them is served without DNS
+// queries. The records are looked up and decided exactly as for a live
+// check. Each entry is a domain, optionally followed by whitespace and the
+// registration ID of the account that will validate it. When
+// CAAAccountURIPrefix is set, decisions are cached per account, so entries
+// without a registration ID are skipped. The lookups are spread evenly over
+// the given duration, which should be short compared to CAAResultCacheTTL.
+// It returns early if ctx is done.
+func (va *ValidationAuthorityImpl) WarmCAACache(ctx context.Context, domains []string, over time.Duration) {
+	if va.CAAResultCacheTTL <= 0 || len(domains) == 0 {
+		return
+	}
+	interval := over / time.Duration(len(domains))
+	quiet := va.quietCAAEvaluator()
+	for i, entry := range domains {
+		if i > 0 {
+			va.clk.Sleep(interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || len(fields) > 2 {
+			va.log.Warning(fmt.Sprintf("Skipping malformed CAA cache warming entry %q", entry))
+			continue
+		}
+		domain := fields[0]
+		checkCtx := ctx
+		if len(fields) == 2 {
+			regID, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				va.log.Warning(fmt.Sprintf("Skipping CAA cache warming entry %q with invalid registration ID", entry))
+				continue
+			}
+			checkCtx = withCAAAccountURI(ctx, va.caaAccountURI(regID))
+		} else if va.CAAAccountURIPrefix != "" {
+			va.log.Warning(fmt.Sprintf("Skipping CAA cache warming for %s, which has no registration ID", domain))
+			continue
+		}
+		identifier := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: domain}
+		lookup, err := va.lookupCAA(checkCtx, identifier)
+		if err != nil {
+			va.log.Warning(fmt.Sprintf("Problem warming CAA cache for %s: %s", domain, err))
+			continue
+		}
+		// The first challenge type is decided as a live check would be,
+		// logging and counting it once. The others reuse the lookup and are
+		// evaluated without side effects.
+		for i, challengeType := range caaChallengeTypes {
+			var decision caaDecision
+			if i == 0 {
+				decision = va.decideCAA(checkCtx, identifier, lookup, challengeType)
+			} else {
+				decision = quiet.evaluateCAASet(identifier, lookup.caaSet, challengeType, caaAccountURIFrom(checkCtx))
+			}
+			if ttl := va.caaCacheTTL(decision); ttl > 0 {
+				va.storeCAADecision(va.caaResultKeyFor(checkCtx, identifier, va.IssuerDomain, challengeType), decision, ttl)
+			}
+		}
+		va.stats.Inc("VA.CAA.ResultCache.Warmed", 1, 1.0)
+	}
+}
+
+// quietCAAEvaluator returns a copy of the VA that evaluates CAA record sets
+// without logging or counting anything.
+func (va *ValidationAuthorityImpl) quietCAAEvaluator() *ValidationAuthorityImpl {
+	quiet := *va
+	quiet.stats, _ = statsd.NewNoopClient()
+	quiet.log, _ = blog.NewAuditLogger(discardSyslog{}, quiet.stats, -1)
+	return &quiet
+}
+
+// discardSyslog is a blog.SyslogWriter that drops every message.
+type discardSyslog struct{}
+
+func (discardSyslog) Close() error         { return nil }
+func (discardSyslog) Alert(string) error   { return nil }
+func (discardSyslog) Crit(string) error    { return nil }
+func (discardSyslog) Debug(string) error   { return nil }
+func (discardSyslog) Emerg(string) error   { return nil }
+func (discardSyslog) Err(string) error     { return nil }
+func (discardSyslog) Info(string) error    { return nil }
+func (discardSyslog) Notice(string) error  { return nil }
+func (discardSyslog) Warning(string) error { return nil }
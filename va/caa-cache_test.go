@@ -0,0 +1,372 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// countingResolver wraps the mock resolver and counts CAA lookups.
+type countingResolver struct {
+	bdns.MockDNSResolver
+	sync.Mutex
+	caaLookups int
+}
+
+func (cr *countingResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	cr.Lock()
+	cr.caaLookups++
+	cr.Unlock()
+	return cr.MockDNSResolver.LookupCAA(ctx, domain)
+}
+
+func (cr *countingResolver) count() int {
+	cr.Lock()
+	defer cr.Unlock()
+	return cr.caaLookups
+}
+
+func TestCAAResultCache(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	fc := clock.NewFake()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, fc)
+	resolver := &countingResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = time.Minute
+	// The mock's records all have a TTL of zero.
+	va.CAACacheMinTTL = time.Minute
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "CAA check should have passed")
+	lookups := resolver.count()
+	test.Assert(t, lookups > 0, "First check should have performed lookups")
+
+	// A repeat of the identical check is served from the cache.
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "Cached CAA check should have passed")
+	test.AssertEquals(t, resolver.count(), lookups)
+
+	// A different challenge type is a different key and bypasses the cache.
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeDNS01)
+	test.Assert(t, prob == nil, "CAA check should have passed")
+	test.AssertEquals(t, resolver.count(), 2*lookups)
+
+	// Once the TTL has passed the check is performed again.
+	fc.Add(time.Minute)
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "CAA check should have passed")
+	test.AssertEquals(t, resolver.count(), 3*lookups)
+}
+
+func TestCAAResultCacheDisabled(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	resolver := &countingResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	lookups := resolver.count()
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, resolver.count(), 2*lookups)
+}
+
+func TestCAAResultCacheErrorsNotCached(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	resolver := &countingResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = time.Minute
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "servfail.com"}
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "CAA check should have failed")
+	lookups := resolver.count()
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "CAA check should have failed")
+	test.AssertEquals(t, resolver.count(), 2*lookups)
+}
+
+// ttlResolver serves a single authorizing record with the given TTL for
+// every name.
+type ttlResolver struct {
+	bdns.MockDNSResolver
+	ttl uint32
+}
+
+func (tr *ttlResolver) LookupCAA(_ context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	return []*dns.CAA{{
+		Hdr:   dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: tr.ttl},
+		Tag:   "issue",
+		Value: "letsencrypt.org",
+	}}, nil, nil
+}
+
+func TestCAACacheTTL(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	va.DNSResolver = &ttlResolver{ttl: 1}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = 10 * time.Minute
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "low-ttl.com"}
+	decision, err := va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.AssertEquals(t, decision.recordTTL, time.Second)
+
+	// Without a floor the record's own TTL applies.
+	test.AssertEquals(t, va.caaCacheTTL(decision), time.Second)
+
+	// A 1 second TTL is raised to the floor.
+	va.CAACacheMinTTL = 5 * time.Minute
+	test.AssertEquals(t, va.caaCacheTTL(decision), 5*time.Minute)
+
+	// The configured cache TTL still bounds the result.
+	va.CAACacheMinTTL = time.Hour
+	test.AssertEquals(t, va.caaCacheTTL(decision), 10*time.Minute)
+
+	// The floor itself is clamped to the recheck window.
+	va.CAAResultCacheTTL = 24 * time.Hour
+	va.CAACacheMinTTL = 48 * time.Hour
+	test.AssertEquals(t, va.caaCacheTTL(decision), caaRecheckWindow)
+
+	// Decisions without records use the configured cache TTL, which is
+	// also bounded by the recheck window.
+	test.AssertEquals(t, va.caaCacheTTL(caaDecision{valid: true}), caaRecheckWindow)
+	va.CAAResultCacheTTL = 10 * time.Minute
+	test.AssertEquals(t, va.caaCacheTTL(caaDecision{valid: true}), 10*time.Minute)
+}
+
+func TestCAAClockSkew(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	fc := clock.NewFake()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, fc)
+	resolver := &countingResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = 24 * time.Hour
+	va.CAACacheMinTTL = 24 * time.Hour
+	va.CAAClockSkew = time.Hour
+
+	decision := caaDecision{present: true, valid: true}
+	test.AssertEquals(t, va.caaCacheTTL(decision), caaRecheckWindow-time.Hour)
+
+	// A decision is rechecked by the time the window less the skew has
+	// passed, before the full window has. Until jitter may have shortened
+	// its lifetime it is served from the cache.
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	lookups := resolver.count()
+	window := caaRecheckWindow - time.Hour
+	earliest := window - time.Duration(float64(window)*caaCacheJitter)
+	fc.Add(earliest - time.Second)
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, resolver.count(), lookups)
+	fc.Add(window - earliest + time.Second)
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, resolver.count(), 2*lookups)
+
+	// Skew larger than the window disables caching entirely.
+	va.CAAClockSkew = 2 * caaRecheckWindow
+	test.AssertEquals(t, va.caaCacheTTL(decision), time.Duration(0))
+}
+
+func TestCAARecheckDeadline(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	fc := clock.NewFake()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, fc)
+	withTTL := func(ttl time.Duration) *CAASet {
+		return &CAASet{Issue: []*dns.CAA{{
+			Hdr:   dns.RR_Header{Ttl: uint32(ttl / time.Second)},
+			Tag:   "issue",
+			Value: "letsencrypt.org",
+		}}}
+	}
+
+	// A short TTL sets the deadline.
+	test.AssertEquals(t, va.CAARecheckDeadline(withTTL(5*time.Minute), true), fc.Now().Add(5*time.Minute))
+
+	// A long one is clamped to the recheck window, as is a decision made
+	// without any records.
+	test.AssertEquals(t, va.CAARecheckDeadline(withTTL(24*time.Hour), true), fc.Now().Add(caaRecheckWindow))
+	test.AssertEquals(t, va.CAARecheckDeadline(nil, true), fc.Now().Add(caaRecheckWindow))
+
+	// Clock skew shortens the window.
+	va.CAAClockSkew = time.Hour
+	test.AssertEquals(t, va.CAARecheckDeadline(withTTL(24*time.Hour), true), fc.Now().Add(caaRecheckWindow-time.Hour))
+
+	// A denial must be rechecked before it could ever allow issuance,
+	// however long its records live.
+	fc.Add(time.Hour)
+	test.AssertEquals(t, va.CAARecheckDeadline(withTTL(5*time.Minute), false), fc.Now())
+}
+
+func TestCAAResultCacheFlooredTTL(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	fc := clock.NewFake()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, fc)
+	resolver := &countingResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = 10 * time.Minute
+
+	// With zero-TTL records and no floor nothing is cached.
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	lookups := resolver.count()
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, resolver.count(), 2*lookups)
+
+	// With a floor the decision is cached until the floor passes.
+	va.CAACacheMinTTL = time.Minute
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, resolver.count(), 3*lookups)
+	fc.Add(time.Minute)
+	va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, resolver.count(), 4*lookups)
+}
+
+func TestCAAResultKey(t *testing.T) {
+	a := newCAAResultKey("Example.COM.", "letsencrypt.org", core.ChallengeTypeHTTP01)
+	b := newCAAResultKey("example.com", "letsencrypt.org", core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, a, b)
+
+	wild := newCAAResultKey("*.example.com", "letsencrypt.org", core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, wild.domain, "example.com")
+	test.Assert(t, wild.wildcard, "Wildcard flag should be set")
+	test.Assert(t, wild != b, "Wildcard key should differ from non-wildcard key")
+}
+
+func TestWarmCAACache(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	fc := clock.NewFake()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, fc)
+	resolver := &countingResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = 10 * time.Minute
+	va.CAACacheMinTTL = 10 * time.Minute
+
+	start := fc.Now()
+	va.WarmCAACache(context.Background(), []string{"present.com", "reserved.com", "absent.com"}, 3*time.Minute)
+	// The lookups were spread over the requested duration.
+	test.AssertEquals(t, fc.Now().Sub(start), 2*time.Minute)
+	lookups := resolver.count()
+	test.Assert(t, lookups > 0, "Warming should have performed lookups")
+
+	for _, challengeType := range caaChallengeTypes {
+		prob := va.checkCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}, challengeType)
+		test.Assert(t, prob == nil, "present.com should be allowed")
+		prob = va.checkCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "reserved.com"}, challengeType)
+		test.Assert(t, prob != nil, "reserved.com should be denied")
+		prob = va.checkCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "absent.com"}, challengeType)
+		test.Assert(t, prob == nil, "absent.com should be allowed")
+	}
+	test.AssertEquals(t, resolver.count(), lookups)
+}
+
+func TestWarmCAACacheLikeLiveChecks(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.NewFake())
+	resolver := &countingResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = 10 * time.Minute
+	va.CAACacheMinTTL = 10 * time.Minute
+	va.CAAMaxLabels = 3
+	va.CAAAccountURIPrefix = "https://acme.example/acct/"
+
+	// Names live checks would refuse aren't cached, and neither are entries
+	// without the account that live checks are keyed by.
+	va.WarmCAACache(context.Background(), []string{"a.b.present.com 7", "present.com", "present.com x"}, 0)
+	test.AssertEquals(t, va.CAACacheStats().Entries, 0)
+
+	va.WarmCAACache(context.Background(), []string{"present.com 7", "*.present.com 7"}, 0)
+	test.AssertEquals(t, va.CAACacheStats().Entries, 2*len(caaChallengeTypes))
+	// Each domain is looked up, and its decision counted, once however many
+	// challenge types it is cached for.
+	test.AssertEquals(t, len(stats.Timings["VA.CAA.LookupsPerCheck"]), 2)
+	test.AssertEquals(t, stats.Counters["VA.CAA.Authorized"], int64(2))
+	lookups := resolver.count()
+	ctx := withCAAAccountURI(context.Background(), va.caaAccountURI(7))
+	for _, name := range []string{"present.com", "*.present.com"} {
+		prob := va.checkCAA(ctx, core.AcmeIdentifier{Type: core.IdentifierDNS, Value: name}, core.ChallengeTypeHTTP01)
+		test.Assert(t, prob == nil, name+" should be allowed")
+	}
+	test.AssertEquals(t, resolver.count(), lookups)
+}
+
+func TestCAACacheStats(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	fc := clock.NewFake()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, fc)
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAResultCacheTTL = time.Minute
+	va.CAACacheMinTTL = time.Minute
+
+	present := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+	absent := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "absent.com"}
+	va.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	va.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	va.checkCAA(context.Background(), absent, core.ChallengeTypeHTTP01)
+	va.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, va.CAACacheStats(), CAACacheStats{Hits: 2, Misses: 2, Entries: 2})
+
+	// Once the entries expire, looking one up evicts it and the next store
+	// sweeps out the other.
+	fc.Add(time.Minute)
+	va.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, va.CAACacheStats(), CAACacheStats{Hits: 2, Misses: 3, Entries: 1, Evictions: 2})
+}
+
+func TestCAAResultCacheJitter(t *testing.T) {
+	fc := clock.NewFake()
+	cache := newCAAResultCache(fc)
+	ttl := 10 * time.Minute
+	earliest := ttl - time.Duration(float64(ttl)*caaCacheJitter)
+
+	min, max := ttl, time.Duration(0)
+	buckets := make(map[time.Duration]int)
+	for i := 0; i < 1000; i++ {
+		key := newCAAResultKey(fmt.Sprintf("%d.example.com", i), "letsencrypt.org", core.ChallengeTypeHTTP01)
+		cache.Set(key.String(), []byte("{}"), ttl)
+		lifetime := cache.entries[key.String()].expires.Sub(fc.Now())
+		test.Assert(t, lifetime >= earliest && lifetime <= ttl,
+			fmt.Sprintf("Lifetime %s outside [%s, %s]", lifetime, earliest, ttl))
+		if lifetime < min {
+			min = lifetime
+		}
+		if lifetime > max {
+			max = lifetime
+		}
+		buckets[(lifetime-earliest)*10/(ttl-earliest)]++
+	}
+	// The lifetimes cover the jitter range, spread roughly evenly across it.
+	test.Assert(t, min < earliest+10*time.Second, fmt.Sprintf("Shortest lifetime %s is too long", min))
+	test.Assert(t, max > ttl-10*time.Second, fmt.Sprintf("Longest lifetime %s is too short", max))
+	for i := time.Duration(0); i < 10; i++ {
+		test.Assert(t, buckets[i] > 50, fmt.Sprintf("Only %d of 1000 lifetimes fell in tenth %d of the range", buckets[i], i))
+	}
+}
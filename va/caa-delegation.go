@@ -0,0 +1,59 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"strings"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// delegatesToUs returns true if caa names an issuer, and its
+// CAADelegationParameter lists one of CAADelegationValues. The parameter's
+// value is a comma-separated list, compared case-insensitively.
+func (va *ValidationAuthorityImpl) delegatesToUs(caa *dns.CAA) bool {
+	if va.CAADelegationParameter == "" {
+		return false
+	}
+	issuer, params, _ := parseCAAIssueValue(caa.Value)
+	if issuer == "" {
+		return false
+	}
+	value, ok := params[strings.ToLower(va.CAADelegationParameter)]
+	if !ok {
+		return false
+	}
+	for _, delegate := range strings.Split(value, ",") {
+		delegate = strings.Trim(delegate, whitespaceCutset)
+		for _, accepted := range va.CAADelegationValues {
+			if strings.EqualFold(delegate, accepted) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// delegationAuthorized is authorizesIssuer for the records that delegate
+// issuance to us, each under the issuer it names. It also returns the
+// issuer of the record that authorized issuance, if any.
+func (va *ValidationAuthorityImpl) delegationAuthorized(records []*dns.CAA, challengeType, accountURI string) (bool, string, []string, bool) {
+	var allowedMethods []string
+	var otherAccount bool
+	for _, caa := range records {
+		if !va.delegatesToUs(caa) {
+			continue
+		}
+		issuer := extractIssuerDomain(caa)
+		authorized, methods, other := authorizesIssuer([]*dns.CAA{caa}, issuer, challengeType, accountURI)
+		if authorized {
+			return true, issuer, nil, false
+		}
+		allowedMethods = append(allowedMethods, methods...)
+		otherAccount = otherAccount || other
+	}
+	return false, "", allowedMethods, otherAccount
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"testing"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+func TestCAADelegation(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	ident := core.AcmeIdentifier{Type: "dns", Value: "example.com"}
+	evaluate := func(value string) caaDecision {
+		caaSet := &CAASet{Name: "example.com", Issue: []*dns.CAA{{Tag: "issue", Value: value}}}
+		return va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	}
+
+	// Without a parameter configured, delegations are ignored.
+	decision := evaluate("partner.example; delegate=letsencrypt")
+	test.Assert(t, !decision.valid, "Unconfigured delegation authorized issuance")
+
+	va.CAADelegationParameter = "Delegate"
+	va.CAADelegationValues = []string{"letsencrypt", "isrg"}
+	log.Clear()
+	decision = evaluate("partner.example; delegate=ISRG")
+	test.Assert(t, decision.valid, "Matching delegation should authorize issuance")
+	test.AssertEquals(t, decision.issuer, "letsencrypt.org")
+	test.AssertEquals(t, stats.Counters["VA.CAA.AuthorizedByDelegation"], int64(1))
+	test.AssertEquals(t, len(log.GetAllMatching("by delegation from partner.example")), 1)
+
+	decision = evaluate("partner.example; delegate=other-ca, letsencrypt")
+	test.Assert(t, decision.valid, "Delegation listing us among others should authorize issuance")
+
+	for _, value := range []string{
+		"partner.example; delegate=other-ca",
+		"partner.example; delegated=letsencrypt",
+		"; delegate=letsencrypt",
+	} {
+		decision = evaluate(value)
+		test.Assert(t, !decision.valid, "Issuance authorized by "+value)
+		test.AssertEquals(t, decision.reason, caaUnauthorized)
+	}
+
+	// Delegating records are still subject to validationmethods.
+	decision = evaluate("partner.example; delegate=letsencrypt; validationmethods=dns-01")
+	test.Assert(t, !decision.valid, "Delegation for another method authorized issuance")
+	test.AssertEquals(t, decision.reason, caaMethodNotAllowed)
+	test.AssertDeepEquals(t, decision.allowedMethods, []string{"dns-01"})
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/core"
+)
+
+// EvaluateCAARecords decides whether a proposed set of CAA records would
+// permit issuance, as checkCAA would if they were the records found for the
+// domain, without looking anything up. It is meant for domain owners trying
+// out records before publishing them. The evaluation isn't counted in the
+// VA's stats.
+func (va *ValidationAuthorityImpl) EvaluateCAARecords(req *core.CAARecordsEvaluationRequest) (*core.CAARecordsEvaluation, error) {
+	domain := strings.ToLower(req.Domain)
+	if domain == "" {
+		return nil, core.MalformedRequestError("No domain given")
+	}
+	caaSet, err := parseCAARecords(req.Records, strings.TrimPrefix(domain, "*."))
+	if err != nil {
+		return nil, err
+	}
+
+	// The records are evaluated by a copy of the VA, so that its stats and,
+	// if an issuer is given, its identities can be replaced.
+	evaluator := *va
+	evaluator.stats, _ = statsd.NewNoopClient()
+	if req.Issuer != "" {
+		evaluator.IssuerDomain = req.Issuer
+		evaluator.CAAFallbackIssuerDomain = ""
+	}
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: domain}
+	decision := evaluator.evaluateCAASet(ident, caaSet, req.ChallengeType, req.AccountURI)
+	evaluation := &core.CAARecordsEvaluation{
+		Valid:    decision.valid,
+		Relevant: decision.relevant,
+		Issuer:   decision.issuer,
+	}
+	if !decision.valid {
+		evaluation.Detail = caaProblem(domain, decision).Detail
+		evaluation.AllowedMethods = decision.allowedMethods
+	}
+	return evaluation, nil
+}
+
+// parseCAARecords parses records in zone file format, relative to origin,
+// into a CAA set. Every record must be a CAA record, and all must be owned
+// by the same name. It returns nil when there are no records.
+func parseCAARecords(records, origin string) (*CAASet, error) {
+	var caas []*dns.CAA
+	var owner string
+	var err error
+	for token := range dns.ParseZone(strings.NewReader(records), dns.Fqdn(origin), "") {
+		if err != nil {
+			// Drain the parser so that it can exit.
+			continue
+		}
+		if token.Error != nil {
+			err = core.MalformedRequestError(fmt.Sprintf("Invalid CAA records: %s", token.Error))
+			continue
+		}
+		caa, ok := token.RR.(*dns.CAA)
+		if !ok {
+			err = core.MalformedRequestError(fmt.Sprintf("Record %q is not a CAA record", token.RR.String()))
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(caa.Hdr.Name, "."))
+		if owner != "" && name != owner {
+			err = core.MalformedRequestError(fmt.Sprintf("CAA records are owned by both %s and %s", owner, name))
+			continue
+		}
+		owner = name
+		caas = append(caas, caa)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(caas) == 0 {
+		return nil, nil
+	}
+	caaSet := newCAASet(caas)
+	caaSet.Name = owner
+	return caaSet, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"testing"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+func TestEvaluateCAARecords(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	// Lookups would fail the test.
+	va.DNSResolver = nil
+
+	testCases := []struct {
+		name           string
+		domain         string
+		records        string
+		issuer         string
+		challengeType  string
+		valid          bool
+		relevant       bool
+		detail         string
+		allowedMethods []string
+	}{
+		{
+			name:     "no records",
+			domain:   "example.com",
+			valid:    true,
+			relevant: false,
+		},
+		{
+			name:     "authorized",
+			domain:   "example.com",
+			records:  "example.com. 300 IN CAA 0 issue \"letsencrypt.org\"",
+			valid:    true,
+			relevant: true,
+		},
+		{
+			name:     "relative names, comments and blank lines",
+			domain:   "www.example.com",
+			records:  "; proposed\n\n@ 300 IN CAA 0 issue \"other-ca.example\"\n@ 300 IN CAA 0 issue \"letsencrypt.org\" ; ours\n",
+			valid:    true,
+			relevant: true,
+		},
+		{
+			name:     "other CA",
+			domain:   "example.com",
+			records:  "example.com. 300 IN CAA 0 issue \"other-ca.example\"",
+			relevant: true,
+			detail:   "CAA record for example.com prevents issuance",
+		},
+		{
+			name:     "other issuer given",
+			domain:   "example.com",
+			records:  "example.com. 300 IN CAA 0 issue \"other-ca.example\"",
+			issuer:   "other-ca.example",
+			valid:    true,
+			relevant: true,
+		},
+		{
+			name:           "method not allowed",
+			domain:         "example.com",
+			records:        "example.com. 300 IN CAA 0 issue \"letsencrypt.org; validationmethods=dns-01\"",
+			challengeType:  core.ChallengeTypeHTTP01,
+			relevant:       true,
+			detail:         "CAA record for example.com prevents issuance using validation method \"http-01\"; allowed methods: dns-01",
+			allowedMethods: []string{"dns-01"},
+		},
+		{
+			name:     "issuewild for a wildcard",
+			domain:   "*.example.com",
+			records:  "example.com. 300 IN CAA 0 issue \"letsencrypt.org\"\nexample.com. 300 IN CAA 0 issuewild \";\"",
+			relevant: true,
+			detail:   "CAA record for *.example.com prevents issuance",
+		},
+		{
+			name:     "critical unknown",
+			domain:   "example.com",
+			records:  "example.com. 300 IN CAA 128 tbs \"x\"\nexample.com. 300 IN CAA 0 issue \"letsencrypt.org\"",
+			relevant: true,
+			detail:   "CAA record for example.com has an unrecognized critical property and prevents issuance",
+		},
+	}
+	for _, tc := range testCases {
+		challengeType := tc.challengeType
+		if challengeType == "" {
+			challengeType = core.ChallengeTypeDNS01
+		}
+		evaluation, err := va.EvaluateCAARecords(&core.CAARecordsEvaluationRequest{
+			Domain:        tc.domain,
+			Records:       tc.records,
+			Issuer:        tc.issuer,
+			ChallengeType: challengeType,
+		})
+		test.AssertNotError(t, err, tc.name)
+		test.AssertEquals(t, evaluation.Valid, tc.valid)
+		test.AssertEquals(t, evaluation.Relevant, tc.relevant)
+		test.AssertEquals(t, evaluation.Detail, tc.detail)
+		test.AssertDeepEquals(t, evaluation.AllowedMethods, tc.allowedMethods)
+		if tc.valid && tc.relevant {
+			issuer := tc.issuer
+			if issuer == "" {
+				issuer = va.IssuerDomain
+			}
+			test.AssertEquals(t, evaluation.Issuer, issuer)
+		}
+	}
+	test.AssertEquals(t, va.IssuerDomain, "letsencrypt.org")
+	test.AssertEquals(t, len(stats.Counters), 0)
+
+	for _, records := range []string{
+		"example.com. 300 IN CAA issue \"letsencrypt.org\"",
+		"example.com. 300 IN TXT \"letsencrypt.org\"",
+		"example.com. 300 IN CAA 0 issue \"letsencrypt.org\"\nwww.example.com. 300 IN CAA 0 issue \"letsencrypt.org\"",
+	} {
+		_, err := va.EvaluateCAARecords(&core.CAARecordsEvaluationRequest{Domain: "example.com", Records: records})
+		test.AssertError(t, err, "Accepted "+records)
+		_, ok := err.(core.MalformedRequestError)
+		test.Assert(t, ok, "Wrong error type for "+records)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/letsencrypt/boulder/reloader"
+)
+
+// CAAIdentity is an entry in the CAA identities file. An identity that is
+// listed but not enabled never authorizes issuance, even when a record
+// names it.
+type CAAIdentity struct {
+	Domain  string
+	Enabled bool
+}
+
+// caaIdentityFlags holds the enabled flags loaded by SetCAAIdentitiesFile.
+type caaIdentityFlags struct {
+	sync.RWMutex
+	enabled map[string]bool
+}
+
+type caaIdentitiesJSON struct {
+	Identities []CAAIdentity
+}
+
+// SetCAAIdentitiesFile loads the enabled flags of our CAA identities,
+// IssuerDomain and CAAFallbackIssuerDomain, from the given JSON file,
+// returning an error if that fails. It also starts a reloader so that
+// identities can be enabled and disabled by editing the file. Identities
+// the file doesn't list are enabled.
+func (va *ValidationAuthorityImpl) SetCAAIdentitiesFile(f string) error {
+	_, err := reloader.New(f, va.loadCAAIdentities)
+	return err
+}
+
+func (va *ValidationAuthorityImpl) loadCAAIdentities(b []byte, err error) error {
+	if err != nil {
+		va.log.Err(fmt.Sprintf("loading CAA identities: %s", err))
+		return err
+	}
+	hash := sha256.Sum256(b)
+	va.log.Info(fmt.Sprintf("loading CAA identities, sha256: %s",
+		hex.EncodeToString(hash[:])))
+	var ids caaIdentitiesJSON
+	err = json.Unmarshal(b, &ids)
+	if err != nil {
+		return err
+	}
+	enabled := make(map[string]bool)
+	for _, id := range ids.Identities {
+		if id.Domain == "" {
+			return fmt.Errorf("CAA identity with no domain")
+		}
+		enabled[strings.ToLower(id.Domain)] = id.Enabled
+	}
+	va.caaIdentities.Lock()
+	va.caaIdentities.enabled = enabled
+	va.caaIdentities.Unlock()
+	// Cached decisions may have been made with an identity whose flag just
+	// changed. Their keys no longer match, so only the in-memory cache is
+	// cleared to free them; a shared cache is left to the other VAs using it.
+	if c, ok := va.caaResults.(*caaResultCache); ok {
+		c.Clear()
+	}
+	return nil
+}
+
+// caaIdentityEnabled returns false if identity is disabled in the CAA
+// identities file.
+func (va *ValidationAuthorityImpl) caaIdentityEnabled(identity string) bool {
+	if va.caaIdentities == nil {
+		return true
+	}
+	va.caaIdentities.RLock()
+	defer va.caaIdentities.RUnlock()
+	enabled, ok := va.caaIdentities.enabled[strings.ToLower(identity)]
+	return !ok || enabled
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/mocks"
+	"github.com/letsencrypt/boulder/test"
+)
+
+func TestCAAIdentities(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.NewFake())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAFallbackIssuerDomain = "symantec.com"
+	va.CAAResultCacheTTL = time.Minute
+	present := core.AcmeIdentifier{Type: "dns", Value: "present.com"}
+	reserved := core.AcmeIdentifier{Type: "dns", Value: "reserved.com"}
+
+	f, err := ioutil.TempFile("", "caa-identities.json")
+	test.AssertNotError(t, err, "Couldn't create identities file")
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"Identities": [{"Domain": "letsencrypt.org", "Enabled": true}, {"Domain": "symantec.com", "Enabled": false}]}`)
+	test.AssertNotError(t, err, "Couldn't write identities file")
+	f.Close()
+	err = va.SetCAAIdentitiesFile(f.Name())
+	test.AssertNotError(t, err, "Couldn't load identities file")
+
+	// An enabled identity authorizes as usual, and a disabled one doesn't
+	// even though reserved.com's records name it.
+	decision, err := va.checkCAAWithCache(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Enabled identity should authorize")
+	decision, err = va.checkCAAWithCache(context.Background(), reserved, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Disabled identity shouldn't authorize")
+	test.AssertEquals(t, stats.Counters["VA.CAA.IdentityDisabled"], int64(1))
+
+	// Flipping the flags takes effect at once, rather than after cached
+	// decisions expire.
+	err = va.loadCAAIdentities([]byte(`{"Identities": [{"Domain": "LetsEncrypt.org", "Enabled": false}, {"Domain": "symantec.com", "Enabled": true}]}`), nil)
+	test.AssertNotError(t, err, "Couldn't reload identities")
+	decision, err = va.checkCAAWithCache(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Disabled primary identity shouldn't authorize")
+	decision, err = va.checkCAAWithCache(context.Background(), reserved, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Enabled fallback identity should authorize")
+	test.AssertEquals(t, decision.issuer, "symantec.com")
+
+	// Unlisted identities are enabled, and a bad file is rejected.
+	err = va.loadCAAIdentities([]byte(`{"Identities": []}`), nil)
+	test.AssertNotError(t, err, "Couldn't reload identities")
+	test.Assert(t, va.caaIdentityEnabled("letsencrypt.org"), "Unlisted identity should be enabled")
+	err = va.loadCAAIdentities([]byte(`{"Identities": [{"Enabled": true}]}`), nil)
+	test.AssertError(t, err, "Identity without a domain should be rejected")
+}
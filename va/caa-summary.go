@@ -0,0 +1,123 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/core"
+)
+
+// caaSummaryTimeout bounds the lookups made for a policy summary.
+var caaSummaryTimeout = validationTimeout
+
+// CAAPolicySummary looks up the CAA records in effect for a domain and
+// describes them, without deciding whether they permit issuance. It is meant
+// for diagnosing why a domain's CAA checks turn out the way they do. The
+// records are found as for a CAA check, so a wildcard's are those of the
+// name it is rooted at, and CAAMaxLabels applies.
+func (va *ValidationAuthorityImpl) CAAPolicySummary(req *core.CAAPolicySummaryRequest) (*core.CAAPolicySummary, error) {
+	domain := strings.ToLower(req.Domain)
+	hostname, err := va.caaHostname(domain)
+	if err == errTooManyLabels {
+		return nil, core.MalformedRequestError(fmt.Sprintf("%s has too many labels to check CAA records", req.Domain))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), caaSummaryTimeout)
+	defer cancel()
+	var path *caaClimbPath
+	if req.Verbose {
+		ctx, path = withCAAClimbPath(ctx)
+	}
+	caaSet, err := va.getCAASet(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	summary := &core.CAAPolicySummary{Domain: domain}
+	if path != nil {
+		summary.Path = path.steps
+	}
+	if caaSet == nil {
+		return summary, nil
+	}
+	summary.Owner = caaSet.Name
+	summary.Issuers = issuerPolicies(caaSet.Issue)
+	summary.IssuewildPresent = len(caaSet.Issuewild) > 0
+	if summary.IssuewildPresent {
+		summary.WildcardIssuers = issuerPolicies(caaSet.Issuewild)
+	} else {
+		summary.WildcardIssuers = summary.Issuers
+	}
+	summary.AuthorizedIssuers = authorizedIssuers(caaSet)
+	for _, caa := range caaSet.Iodef {
+		summary.Iodef = append(summary.Iodef, strings.Trim(caa.Value, whitespaceCutset))
+	}
+	summary.UnknownCritical = caaSet.criticalUnknown(va.stats)
+	return summary, nil
+}
+
+// issuerPolicies describes each of a set of issue or issuewild records.
+func issuerPolicies(records []*dns.CAA) []core.CAAIssuerPolicy {
+	var policies []core.CAAIssuerPolicy
+	for _, caa := range records {
+		issuer, params, _ := parseCAAIssueValue(caa.Value)
+		policy := core.CAAIssuerPolicy{Issuer: issuer}
+		if len(params) > 0 {
+			policy.Parameters = params
+		}
+		if methods, ok := params["validationmethods"]; ok {
+			policy.ValidationMethods = []string{}
+			for _, method := range strings.Split(methods, ",") {
+				method = strings.ToLower(strings.Trim(method, whitespaceCutset))
+				if method != "" {
+					policy.ValidationMethods = append(policy.ValidationMethods, method)
+				}
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// authorizedIssuers returns the issuer domains named by caaSet's issue and
+// issuewild properties, lowercased and without duplicates, in the order
+// they are first named. Properties that authorize no one are skipped.
+func authorizedIssuers(caaSet *CAASet) []string {
+	var issuers []string
+	seen := make(map[string]bool)
+	for _, records := range [][]*dns.CAA{caaSet.Issue, caaSet.Issuewild} {
+		for _, caa := range records {
+			issuer := strings.ToLower(extractIssuerDomain(caa))
+			if issuer == "" || seen[issuer] {
+				continue
+			}
+			seen[issuer] = true
+			issuers = append(issuers, issuer)
+		}
+	}
+	return issuers
+}
+
+// caaClimbPath collects the names climbCAATree queries, in climbing order.
+type caaClimbPath struct {
+	steps []core.CAAClimbStep
+}
+
+type caaClimbPathKey struct{}
+
+// withCAAClimbPath returns a context whose CAA climb records the names it
+// queries into the returned path.
+func withCAAClimbPath(ctx context.Context) (context.Context, *caaClimbPath) {
+	path := &caaClimbPath{}
+	return context.WithValue(ctx, caaClimbPathKey{}, path), path
+}
+
+func caaClimbPathFrom(ctx context.Context) *caaClimbPath {
+	path, _ := ctx.Value(caaClimbPathKey{}).(*caaClimbPath)
+	return path
+}
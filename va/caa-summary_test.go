@@ -0,0 +1,197 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// richResolver serves a varied CAA record set at rich.com.
+type richResolver struct {
+	bdns.MockDNSResolver
+}
+
+func (rr *richResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	if domain != "rich.com" {
+		return nil, nil, nil
+	}
+	hdr := dns.RR_Header{Name: "rich.com.", Rrtype: dns.TypeCAA, Class: dns.ClassINET}
+	return []*dns.CAA{
+		{Hdr: hdr, Tag: "issue", Value: "letsencrypt.org; validationmethods=dns-01, HTTP-01; accounturi=https://acme.example/acct/1"},
+		{Hdr: hdr, Tag: "issue", Value: "example.net"},
+		{Hdr: hdr, Tag: "issuewild", Value: ";"},
+		{Hdr: hdr, Tag: "iodef", Value: "mailto:security@rich.com"},
+		{Hdr: hdr, Tag: "foo", Value: "bar"},
+	}, nil, nil
+}
+
+func TestCAAPolicySummary(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	va.DNSResolver = &richResolver{}
+
+	summary, err := va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "WWW.rich.com"})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.AssertDeepEquals(t, summary, &core.CAAPolicySummary{
+		Domain: "www.rich.com",
+		Owner:  "rich.com",
+		Issuers: []core.CAAIssuerPolicy{
+			{
+				Issuer:            "letsencrypt.org",
+				ValidationMethods: []string{"dns-01", "http-01"},
+				Parameters: map[string]string{
+					"validationmethods": "dns-01, HTTP-01",
+					"accounturi":        "https://acme.example/acct/1",
+				},
+			},
+			{Issuer: "example.net"},
+		},
+		WildcardIssuers:   []core.CAAIssuerPolicy{{Issuer: ""}},
+		IssuewildPresent:  true,
+		AuthorizedIssuers: []string{"letsencrypt.org", "example.net"},
+		Iodef:             []string{"mailto:security@rich.com"},
+	})
+
+	// Without issuewild properties, the issue properties govern wildcards.
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	summary, err = va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "present.com"})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.Assert(t, !summary.IssuewildPresent, "present.com has no issuewild properties")
+	test.AssertDeepEquals(t, summary.WildcardIssuers, summary.Issuers)
+
+	summary, err = va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "unknown-critical.com"})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.Assert(t, summary.UnknownCritical, "unknown-critical.com has a critical unknown property")
+
+	// A domain without CAA records has an empty summary.
+	summary, err = va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "com"})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.AssertDeepEquals(t, summary, &core.CAAPolicySummary{Domain: "com"})
+}
+
+func TestAuthorizedIssuers(t *testing.T) {
+	caaSet := &CAASet{
+		Issue: []*dns.CAA{
+			{Tag: "issue", Value: "letsencrypt.org; validationmethods=dns-01"},
+			{Tag: "issue", Value: ";"},
+			{Tag: "issue", Value: "Example.NET"},
+			{Tag: "issue", Value: "letsencrypt.org; accounturi=https://acme.example/acct/1"},
+		},
+		Issuewild: []*dns.CAA{
+			{Tag: "issuewild", Value: "example.net"},
+			{Tag: "issuewild", Value: "wild.example"},
+		},
+	}
+	test.AssertDeepEquals(t, authorizedIssuers(caaSet), []string{"letsencrypt.org", "example.net", "wild.example"})
+
+	// A set that only denies issuance names no issuers.
+	caaSet = &CAASet{Issue: []*dns.CAA{{Tag: "issue", Value: ";"}}}
+	test.Assert(t, authorizedIssuers(caaSet) == nil, "No issuers should be authorized")
+}
+
+func TestCAAPolicySummaryPath(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+
+	// The path is only given when asked for.
+	summary, err := va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "a.b.present.com"})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.Assert(t, summary.Path == nil, "Path returned for a request that isn't verbose")
+
+	// Every name is queried, including those above the deciding one.
+	summary, err = va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "a.b.present.com", Verbose: true})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.AssertDeepEquals(t, summary.Path, []core.CAAClimbStep{
+		{Name: "a.b.present.com"},
+		{Name: "b.present.com"},
+		{Name: "present.com", RecordsFound: true},
+		{Name: "com"},
+	})
+
+	// A DNAME redirection continues the path in the target's tree.
+	va.CAARuleset = CAARulesetRFC6844
+	summary, err = va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "www.dname.com", Verbose: true})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.AssertEquals(t, summary.Owner, "dname-target.com")
+	test.AssertDeepEquals(t, summary.Path, []core.CAAClimbStep{
+		{Name: "www.dname.com"},
+		{Name: "dname.com", RecordsFound: true},
+		{Name: "com"},
+		{Name: "www.dname-target.com"},
+		{Name: "dname-target.com", RecordsFound: true},
+		{Name: "com"},
+	})
+
+	// With minimized queries, only the names actually queried appear.
+	va.CAARuleset = ""
+	va.CAAMinimizeQueries = true
+	summary, err = va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "a.b.nxdomain.com", Verbose: true})
+	test.AssertNotError(t, err, "CAAPolicySummary failed")
+	test.AssertDeepEquals(t, summary.Path, []core.CAAClimbStep{
+		{Name: "nxdomain.com"},
+		{Name: "com"},
+	})
+}
+
+// deadlineResolver is richResolver, noting whether each lookup's context
+// had a deadline.
+type deadlineResolver struct {
+	richResolver
+	sync.Mutex
+	lookups, withDeadline int
+}
+
+func (dr *deadlineResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	dr.Lock()
+	dr.lookups++
+	if _, ok := ctx.Deadline(); ok {
+		dr.withDeadline++
+	}
+	dr.Unlock()
+	return dr.richResolver.LookupCAA(ctx, domain)
+}
+
+// counts returns the number of lookups made, and how many of them had a
+// deadline.
+func (dr *deadlineResolver) counts() (lookups, withDeadline int) {
+	dr.Lock()
+	defer dr.Unlock()
+	return dr.lookups, dr.withDeadline
+}
+
+func TestCAAPolicySummaryLikeChecks(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	resolver := &deadlineResolver{}
+	va.DNSResolver = resolver
+	va.CAAMaxLabels = 3
+
+	// A wildcard's records are those of the name it is rooted at.
+	summary, err := va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "*.rich.com", Verbose: true})
+	test.AssertNotError(t, err, "Summary failed")
+	test.AssertEquals(t, summary.Owner, "rich.com")
+	test.AssertEquals(t, summary.Path[0].Name, "rich.com")
+	lookups, withDeadline := resolver.counts()
+	test.Assert(t, lookups > 0, "No lookups made")
+	test.AssertEquals(t, withDeadline, lookups)
+
+	_, err = va.CAAPolicySummary(&core.CAAPolicySummaryRequest{Domain: "a.b.c.rich.com"})
+	test.AssertError(t, err, "Summary of a name with too many labels succeeded")
+	_, ok := err.(core.MalformedRequestError)
+	test.Assert(t, ok, "Wrong error type")
+	after, _ := resolver.counts()
+	test.AssertEquals(t, after, lookups)
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/core"
+)
+
+// DefaultCAAMonitorMaxDomains bounds the domains a CAAMonitor watches when
+// CAAMonitorMaxDomains is unset.
+const DefaultCAAMonitorMaxDomains = 1000
+
+// A monitored domain is re-checked when its decision must be rechecked, as
+// given by CAARecheckDeadline, but no more often than caaMonitorMinInterval.
+// Failed checks are retried after caaMonitorRetryInterval.
+const (
+	caaMonitorMinInterval   = time.Minute
+	caaMonitorRetryInterval = 5 * time.Minute
+)
+
+// CAAChange reports the CAA decision for a monitored domain, the first time
+// it is checked and whenever it changes afterwards.
+type CAAChange struct {
+	Domain    string
+	Present   bool
+	Valid     bool
+	Owner     string
+	CheckedAt time.Time
+}
+
+// CAAMonitor re-checks the CAA records of a set of domains as their TTLs
+// expire and reports changes in the decision for each.
+type CAAMonitor struct {
+	va            *ValidationAuthorityImpl
+	challengeType string
+
+	sync.Mutex
+	domains map[string]*monitoredDomain
+}
+
+type monitoredDomain struct {
+	checked  bool
+	decision caaDecision
+	next     time.Time
+}
+
+// NewCAAMonitor returns a monitor for domains, checked for issuance using
+// challengeType. It fails if there are more domains than
+// CAAMonitorMaxDomains allows.
+func (va *ValidationAuthorityImpl) NewCAAMonitor(domains []string, challengeType string) (*CAAMonitor, error) {
+	max := va.CAAMonitorMaxDomains
+	if max <= 0 {
+		max = DefaultCAAMonitorMaxDomains
+	}
+	if len(domains) > max {
+		return nil, fmt.Errorf("can't monitor %d domains, the maximum is %d", len(domains), max)
+	}
+	m := &CAAMonitor{
+		va:            va,
+		challengeType: challengeType,
+		domains:       make(map[string]*monitoredDomain),
+	}
+	for _, domain := range domains {
+		m.domains[strings.ToLower(domain)] = &monitoredDomain{}
+	}
+	return m, nil
+}
+
+// Poll checks every domain that is due and returns the changes found, in
+// order of domain. The lookups are made without holding the monitor's lock,
+// and a domain being checked by one call isn't also checked by another.
+func (m *CAAMonitor) Poll(ctx context.Context) []CAAChange {
+	now := m.va.clk.Now()
+	m.Lock()
+	var due []string
+	for domain, md := range m.domains {
+		if !md.next.After(now) {
+			due = append(due, domain)
+			// Until this check finishes, other polls treat it as a failure
+			// to be retried.
+			md.next = now.Add(caaMonitorRetryInterval)
+		}
+	}
+	m.Unlock()
+	sort.Strings(due)
+
+	var changes []CAAChange
+	for _, domain := range due {
+		ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: domain}
+		decision, err := m.va.checkCAARecords(ctx, ident, m.challengeType)
+		if err != nil {
+			m.va.stats.Inc("VA.CAA.Monitor.Errors", 1, 1.0)
+			m.va.log.Warning(fmt.Sprintf("Monitoring CAA for %s: %s", domain, err))
+			continue
+		}
+		if change, changed := m.update(domain, decision, now); changed {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// update records decision, made at now, for domain and schedules its next
+// check. It returns the change to report, if the decision is new.
+func (m *CAAMonitor) update(domain string, decision caaDecision, now time.Time) (CAAChange, bool) {
+	m.Lock()
+	defer m.Unlock()
+	md := m.domains[domain]
+	md.next = m.va.caaRecheckDeadline(decision)
+	if earliest := now.Add(caaMonitorMinInterval); md.next.Before(earliest) {
+		md.next = earliest
+	}
+	if md.checked && !decisionChanged(md.decision, decision) {
+		return CAAChange{}, false
+	}
+	if md.checked {
+		m.va.stats.Inc("VA.CAA.Monitor.Changes", 1, 1.0)
+	}
+	md.checked = true
+	md.decision = decision
+	return CAAChange{
+		Domain:    domain,
+		Present:   decision.present,
+		Valid:     decision.valid,
+		Owner:     decision.owner,
+		CheckedAt: now,
+	}, true
+}
+
+// Run polls every interval, as measured by the VA's clock, until ctx is
+// done, sending each change to out.
+func (m *CAAMonitor) Run(ctx context.Context, interval time.Duration, out chan<- CAAChange) {
+	for {
+		for _, change := range m.Poll(ctx) {
+			select {
+			case out <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+		m.va.clk.Sleep(interval)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// decisionChanged reports whether b decides issuance differently from a.
+func decisionChanged(a, b caaDecision) bool {
+	return a.present != b.present || a.valid != b.valid || a.owner != b.owner || a.reason != b.reason
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// changingResolver serves an issue record for each name in issuers, whose
+// values can be changed between lookups, and counts the lookups per name.
+type changingResolver struct {
+	bdns.MockDNSResolver
+	sync.Mutex
+	issuers map[string]string
+	ttl     uint32
+	lookups map[string]int
+}
+
+func (cr *changingResolver) LookupCAA(_ context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	cr.Lock()
+	defer cr.Unlock()
+	cr.lookups[domain]++
+	issuer, ok := cr.issuers[domain]
+	if !ok {
+		return nil, nil, nil
+	}
+	return []*dns.CAA{{
+		Hdr:   dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: cr.ttl},
+		Tag:   "issue",
+		Value: issuer,
+	}}, nil, nil
+}
+
+func (cr *changingResolver) setIssuer(domain, issuer string) {
+	cr.Lock()
+	defer cr.Unlock()
+	cr.issuers[domain] = issuer
+}
+
+func (cr *changingResolver) lookupsFor(domain string) int {
+	cr.Lock()
+	defer cr.Unlock()
+	return cr.lookups[domain]
+}
+
+func TestCAAMonitor(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	clk := clock.NewFake()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clk)
+	resolver := &changingResolver{
+		issuers: map[string]string{"monitored.com": "letsencrypt.org"},
+		ttl:     600,
+		lookups: make(map[string]int),
+	}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+
+	m, err := va.NewCAAMonitor([]string{"monitored.com", "no-caa.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "Failed to create monitor")
+
+	// The first poll reports the initial decision for every domain.
+	changes := m.Poll(context.Background())
+	test.AssertEquals(t, len(changes), 2)
+	test.AssertEquals(t, changes[0].Domain, "monitored.com")
+	test.Assert(t, changes[0].Present && changes[0].Valid, "monitored.com should be authorized")
+	test.AssertEquals(t, changes[1].Domain, "no-caa.com")
+	test.Assert(t, !changes[1].Present && changes[1].Valid, "no-caa.com should have no records")
+
+	// Nothing is due again before the TTL expires.
+	resolver.setIssuer("monitored.com", "example.net")
+	clk.Add(5 * time.Minute)
+	changes = m.Poll(context.Background())
+	test.AssertEquals(t, len(changes), 0)
+	test.AssertEquals(t, resolver.lookupsFor("monitored.com"), 1)
+	// Without records, no-caa.com isn't due until the recheck window ends.
+	test.AssertEquals(t, resolver.lookupsFor("no-caa.com"), 1)
+
+	// Once it expires, the changed records are reported.
+	clk.Add(5 * time.Minute)
+	changes = m.Poll(context.Background())
+	test.AssertEquals(t, len(changes), 1)
+	test.AssertEquals(t, changes[0].Domain, "monitored.com")
+	test.Assert(t, changes[0].Present && !changes[0].Valid, "monitored.com should no longer be authorized")
+	test.AssertEquals(t, changes[0].CheckedAt, clk.Now())
+
+	// Unchanged records aren't reported again.
+	clk.Add(10 * time.Minute)
+	changes = m.Poll(context.Background())
+	test.AssertEquals(t, len(changes), 0)
+	test.AssertEquals(t, resolver.lookupsFor("monitored.com"), 3)
+}
+
+// timedResolver authorizes letsencrypt.org until the clock reaches switchAt,
+// and example.net after.
+type timedResolver struct {
+	bdns.MockDNSResolver
+	clk      clock.Clock
+	switchAt time.Time
+}
+
+func (tr *timedResolver) LookupCAA(_ context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	issuer := "letsencrypt.org"
+	if !tr.clk.Now().Before(tr.switchAt) {
+		issuer = "example.net"
+	}
+	return []*dns.CAA{{
+		Hdr:   dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 600},
+		Tag:   "issue",
+		Value: issuer,
+	}}, nil, nil
+}
+
+func TestCAAMonitorRun(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	clk := clock.NewFake()
+	start := clk.Now()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clk)
+	va.DNSResolver = &timedResolver{clk: clk, switchAt: start.Add(7 * time.Minute)}
+	va.IssuerDomain = "letsencrypt.org"
+	m, err := va.NewCAAMonitor([]string{"monitored.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "Failed to create monitor")
+
+	// Run sleeps on the fake clock, so it advances a minute per poll. The
+	// change at seven minutes is found once the records' TTL expires.
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan CAAChange)
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx, time.Minute, out)
+		close(done)
+	}()
+	change := <-out
+	test.AssertEquals(t, change.Domain, "monitored.com")
+	test.Assert(t, change.Valid, "monitored.com should be authorized at first")
+	test.AssertEquals(t, change.CheckedAt, start)
+	change = <-out
+	test.Assert(t, !change.Valid, "monitored.com should no longer be authorized")
+	test.AssertEquals(t, change.CheckedAt, start.Add(10*time.Minute))
+	cancel()
+	<-done
+}
+
+// slowDomainResolver blocks lookups of slow.com until release is closed.
+type slowDomainResolver struct {
+	bdns.MockDNSResolver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (br *slowDomainResolver) LookupCAA(_ context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	if domain == "slow.com" {
+		close(br.started)
+		<-br.release
+	}
+	return nil, nil, nil
+}
+
+func TestCAAMonitorPollConcurrency(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	resolver := &slowDomainResolver{started: make(chan struct{}), release: make(chan struct{})}
+	va.DNSResolver = resolver
+	m, err := va.NewCAAMonitor([]string{"slow.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "Failed to create monitor")
+
+	polled := make(chan []CAAChange)
+	go func() {
+		polled <- m.Poll(context.Background())
+	}()
+	<-resolver.started
+	// A slow lookup doesn't hold up other polls, which skip the domain
+	// being checked.
+	test.AssertEquals(t, len(m.Poll(context.Background())), 0)
+	close(resolver.release)
+	test.AssertEquals(t, len(<-polled), 1)
+}
+
+func TestCAAMonitorMaxDomains(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.NewFake())
+	va.CAAMonitorMaxDomains = 2
+	_, err := va.NewCAAMonitor([]string{"a.com", "b.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "Two domains should be allowed")
+	_, err = va.NewCAAMonitor([]string{"a.com", "b.com", "c.com"}, core.ChallengeTypeHTTP01)
+	test.AssertError(t, err, "Three domains should be refused")
+}
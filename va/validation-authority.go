@@ -6,23 +6,29 @@
 package va
 
 import (
+	"crypto"
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/letsencrypt/net/publicsuffix"
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/letsencrypt/boulder/probs"
@@ -50,6 +56,130 @@ type ValidationAuthorityImpl struct {
 	UserAgent    string
 	stats        statsd.Statter
 	clk          clock.Clock
+
+	// CAAResultCacheTTL is how long a CAA decision is reused for identical
+	// checks. Zero disables the cache.
+	CAAResultCacheTTL time.Duration
+	// CAACacheMinTTL raises the TTL of the records behind a cached decision to
+	// at least this value, so that records with tiny TTLs can still be
+	// cached. It is never allowed to exceed the CAA recheck window.
+	CAACacheMinTTL time.Duration
+	// CAAMaxConcurrentLookups bounds how many names are looked up at once
+	// while climbing the tree for a single CAA check. Zero means no limit.
+	CAAMaxConcurrentLookups int
+	// CAAClockSkew is subtracted from the CAA recheck window to allow for
+	// clocks that disagree with ours, so that we recheck early rather than
+	// late.
+	CAAClockSkew time.Duration
+	// CAASkipLabelPrefixes lists label prefixes, such as "_acme-challenge",
+	// that never anchor CAA policy. Leading labels of a checked name that
+	// start with one of them are skipped, so the climb begins at the first
+	// ancestor without one.
+	CAASkipLabelPrefixes []string
+	// CAAMaxLabels rejects names with more labels than this before any CAA
+	// lookups are made, bounding the work a single name can cause. Zero
+	// means no limit.
+	CAAMaxLabels int
+	// CAAMaxRecords fails a check whose lookups return more CAA records than
+	// this in all, bounding the memory a single check can use. Zero means no
+	// limit.
+	CAAMaxRecords int
+	// CAALargeResponseSize is the size, in bytes of wire-format records,
+	// above which the CAA records returned by a single lookup are logged
+	// with a warning, as they suggest a misconfiguration or an attack. They
+	// are processed normally. Zero disables the warning.
+	CAALargeResponseSize int
+	// CAABlankRecordsAreErrors makes a CAA record set in which every record
+	// is blank (see CAASet.blank) fail the check. Otherwise such a set is
+	// treated as if no records were present.
+	CAABlankRecordsAreErrors bool
+	// CAARuleset selects the CAA processing rules: CAARulesetRFC8659, the
+	// default when empty, or CAARulesetRFC6844.
+	CAARuleset string
+	// CAARequireRegisteredDomainAnswer makes a check that finds no CAA
+	// records fail unless the resolver answered, with NOERROR or NXDOMAIN,
+	// the lookup for the registered domain. A server failure there is
+	// otherwise indistinguishable from an absence of records.
+	CAARequireRegisteredDomainAnswer bool
+	// CAARegisteredDomainShortcut skips the lookups for the labels between
+	// the name being checked and its registered domain, for operators whose
+	// CAA policy never lives on intermediate labels. It departs from the
+	// RFC's tree climbing and is off by default.
+	CAARegisteredDomainShortcut bool
+	// CAAQueryLogSampleRate is the fraction, from 0 to 1, of CAA checks
+	// whose lookups are logged in detail. Denials are always logged.
+	CAAQueryLogSampleRate float64
+	// CAAIssuerMethodPolicies maps CAA issuer identities to the validation
+	// methods the CA permits under them when a domain's CAA records
+	// restrict issuance. It is enforced on top of any validationmethods
+	// parameter; an identity with no entry is not restricted further.
+	CAAIssuerMethodPolicies map[string][]string
+	// CAADelegationParameter, if set, is an issue parameter through which
+	// a record naming another issuer delegates issuance to us, when its
+	// value lists one of CAADelegationValues. Such a record is otherwise
+	// treated as if it named IssuerDomain.
+	CAADelegationParameter string
+	CAADelegationValues    []string
+	// CAAMonitorMaxDomains bounds the domains a CAAMonitor may watch. When
+	// zero, DefaultCAAMonitorMaxDomains applies.
+	CAAMonitorMaxDomains int
+	// CAAMinimizeQueries looks up the names in a CAA climb one at a time,
+	// from the top of the tree down, stopping at a name that doesn't exist,
+	// so that intermediate resolvers only see a name once its parent is
+	// known to exist. It serializes the lookups, so is off by default.
+	CAAMinimizeQueries bool
+	// CAAAttestationSigner, if set, signs a CAAAttestation of each CAA
+	// decision, which is written to the audit log.
+	CAAAttestationSigner crypto.Signer
+	// CAAIssuewildFallback makes a wildcard name whose issuewild properties
+	// only name other issuers fall back to the issue properties. An
+	// issuewild ";" still forbids wildcard issuance. RFC 8659 gives
+	// issuewild precedence with no fallback, which is the default.
+	CAAIssuewildFallback bool
+	// CAAFallbackIssuerDomain, if set, is a legacy CAA identity that is
+	// checked, and logged as such, when the records don't authorize
+	// IssuerDomain.
+	CAAFallbackIssuerDomain string
+	// CAALameDelegationsAreErrors fails a check when the lookup for an
+	// ancestor of the name, below where any records were found, wasn't
+	// answered, as happens when that zone is lamely delegated. Otherwise
+	// the check carries on as if the ancestor had no records, and the
+	// failure is only logged.
+	CAALameDelegationsAreErrors bool
+	// CAAStrictAncestorErrors fails a check when the lookup for any name the
+	// climb queried failed, even an ancestor above the name whose records
+	// decided it. Otherwise such failures are disregarded once a more
+	// specific name has answered with records.
+	CAAStrictAncestorErrors bool
+	// CAAResolverDiagnostics adds the server, rcode, round-trip time and
+	// tries of each failed query to the problem returned when a CAA lookup
+	// fails. The details reach subscribers, so it is meant for debugging.
+	CAAResolverDiagnostics bool
+	// CAAReportReservedFlags logs and counts CAA records that set flag bits
+	// RFC 8659 reserves, other than bit 1. It doesn't change the decision.
+	CAAReportReservedFlags bool
+	// CAAReportUnflaggedUnknown logs and counts records with unknown tags
+	// and no flags set, which may have been critical before a middlebox
+	// zeroed their flags. It doesn't change the decision.
+	CAAReportUnflaggedUnknown bool
+	// CAAReportShadowedAncestors, when a critical unknown property at the
+	// exact name being checked denies issuance, also looks up the records
+	// above it, and logs and counts the denial separately if they would
+	// have authorized us. The denial stands either way.
+	CAAReportShadowedAncestors bool
+	// CAAAccountURIPrefix, followed by a registration ID, forms the URI
+	// that identifies an account in the accounturi parameter of issue
+	// properties (RFC 8657). When it is set, a property bound to another
+	// account doesn't authorize issuance for a validation, whatever methods
+	// it permits. Otherwise accounturi parameters are ignored.
+	CAAAccountURIPrefix string
+	// sample returns a random number in [0, 1) for log sampling.
+	sample func() float64
+	// PurposeResolvers replaces DNSResolver for the queries of a given
+	// purpose, ResolverPurposeCAA or ResolverPurposeDNS01.
+	PurposeResolvers map[string]bdns.DNSResolver
+	caaResults       CAACache
+	caaIdentities    *caaIdentityFlags
 }
 
 // PortConfig specifies what ports the VA should call to on the remote
@@ -65,14 +195,40 @@ func NewValidationAuthorityImpl(pc *PortConfig, sbc SafeBrowsing, stats statsd.S
 	logger := blog.GetAuditLogger()
 	logger.Notice("Validation Authority Starting")
 	return &ValidationAuthorityImpl{
-		SafeBrowsing: sbc,
-		log:          logger,
-		httpPort:     pc.HTTPPort,
-		httpsPort:    pc.HTTPSPort,
-		tlsPort:      pc.TLSPort,
-		stats:        stats,
-		clk:          clk,
+		SafeBrowsing:  sbc,
+		log:           logger,
+		httpPort:      pc.HTTPPort,
+		httpsPort:     pc.HTTPSPort,
+		tlsPort:       pc.TLSPort,
+		stats:         stats,
+		clk:           clk,
+		caaResults:    newCAAResultCache(clk),
+		caaIdentities: &caaIdentityFlags{},
+		sample:        rand.Float64,
+	}
+}
+
+// Query purposes that can be given their own resolver in PurposeResolvers.
+const (
+	// ResolverPurposeCAA covers CAA lookups.
+	ResolverPurposeCAA = "caa"
+	// ResolverPurposeDNS01 covers the TXT lookups of dns-01 validation.
+	ResolverPurposeDNS01 = core.ChallengeTypeDNS01
+)
+
+// ValidResolverPurpose returns true if purpose is one PurposeResolvers
+// accepts.
+func ValidResolverPurpose(purpose string) bool {
+	return purpose == ResolverPurposeCAA || purpose == ResolverPurposeDNS01
+}
+
+// resolverFor returns the resolver for queries of the given purpose,
+// DNSResolver unless PurposeResolvers overrides it.
+func (va *ValidationAuthorityImpl) resolverFor(purpose string) bdns.DNSResolver {
+	if resolver, ok := va.PurposeResolvers[purpose]; ok {
+		return resolver
 	}
+	return va.DNSResolver
 }
 
 // Used for audit logging
@@ -436,7 +592,7 @@ func (va *ValidationAuthorityImpl) validateDNS01(ctx context.Context, identifier
 
 	// Look for the required record in the DNS
 	challengeSubdomain := fmt.Sprintf("%s.%s", core.DNSPrefix, identifier.Value)
-	txts, authorities, err := va.DNSResolver.LookupTXT(ctx, challengeSubdomain)
+	txts, authorities, err := va.resolverFor(ResolverPurposeDNS01).LookupTXT(ctx, challengeSubdomain)
 
 	if err != nil {
 		va.log.Info(fmt.Sprintf("Failed to lookup txt records for %s. err=[%#v] errStr=[%s]", identifier, err, err))
@@ -460,24 +616,165 @@ func (va *ValidationAuthorityImpl) validateDNS01(ctx context.Context, identifier
 	}
 }
 
-func (va *ValidationAuthorityImpl) checkCAA(ctx context.Context, identifier core.AcmeIdentifier) *probs.ProblemDetails {
-	// Check CAA records for the requested identifier
-	present, valid, err := va.checkCAARecords(ctx, identifier)
-	if err != nil {
-		va.log.Warning(fmt.Sprintf("Problem checking CAA: %s", err))
+func (va *ValidationAuthorityImpl) checkCAA(ctx context.Context, identifier core.AcmeIdentifier, challengeType string) *probs.ProblemDetails {
+	if err := ctx.Err(); err != nil {
+		va.stats.Inc("VA.CAA.ContextDone", 1, 1.0)
 		return bdns.ProblemDetailsFromDNSError(err)
 	}
-	// AUDIT[ Certificate Requests ] 11917fa4-10ef-4e0d-9105-bacbe7836a3c
-	va.log.AuditNotice(fmt.Sprintf("Checked CAA records for %s, [Present: %t, Valid for issuance: %t]", identifier.Value, present, valid))
-	if !valid {
+	var diagnostics *bdns.DiagnosticsRecorder
+	if va.CAAResolverDiagnostics {
+		ctx, diagnostics = bdns.WithDiagnostics(ctx)
+	}
+	// Check CAA records for the requested identifier
+	decision, err := va.checkCAAWithCache(ctx, identifier, challengeType)
+	if err == errTooManyCAARecords {
+		va.stats.Inc("VA.CAA.TooManyRecords", 1, 1.0)
+		return &probs.ProblemDetails{
+			Type:   probs.ConnectionProblem,
+			Detail: fmt.Sprintf("Too many CAA records found checking %s", identifier.Value),
+		}
+	}
+	if err == errIPAddress {
+		va.stats.Inc("VA.CAA.IPAddress", 1, 1.0)
+		return probs.Malformed("%s is an IP address, which has no CAA records to check", identifier.Value)
+	}
+	if err == errTooManyLabels {
+		va.stats.Inc("VA.CAA.TooManyLabels", 1, 1.0)
+		return probs.Malformed("%s has too many labels to check CAA records", identifier.Value)
+	}
+	if err == errRegisteredDomainUnanswered {
 		return &probs.ProblemDetails{
 			Type:   probs.ConnectionProblem,
-			Detail: fmt.Sprintf("CAA record for %s prevents issuance", identifier.Value),
+			Detail: fmt.Sprintf("No answer for the CAA records of %s's registered domain", identifier.Value),
 		}
 	}
+	if err == errLameDelegation {
+		return &probs.ProblemDetails{
+			Type:   probs.ConnectionProblem,
+			Detail: fmt.Sprintf("No answer for the CAA records of an ancestor of %s", identifier.Value),
+		}
+	}
+	if err == errBlankCAARecords {
+		return &probs.ProblemDetails{
+			Type:   probs.ConnectionProblem,
+			Detail: fmt.Sprintf("CAA records for %s are all blank", identifier.Value),
+		}
+	}
+	if err != nil {
+		prob := bdns.ProblemDetailsFromDNSError(err)
+		var detail string
+		if diagnostics != nil {
+			detail = diagnosticDetail(diagnostics.Failures())
+			prob.Detail += detail
+		}
+		va.log.Warning(fmt.Sprintf("Problem checking CAA: %s%s", err, detail))
+		return prob
+	}
+	// AUDIT[ Certificate Requests ] 11917fa4-10ef-4e0d-9105-bacbe7836a3c
+	va.log.AuditNotice(fmt.Sprintf("Checked CAA records for %s, [Present: %t, Relevant: %t, Valid for issuance: %t, Found at: %q]", identifier.Value, decision.present, decision.relevant, decision.valid, decision.owner))
+	if va.CAAAttestationSigner != nil {
+		va.logCAAAttestation(identifier.Value, decision)
+	}
+	if decision.synthesized {
+		va.log.Notice(fmt.Sprintf("CAA decision for %s rests on records synthesized from a wildcard at %s", identifier.Value, decision.owner))
+	}
+	if !decision.valid {
+		return caaProblem(identifier.Value, decision)
+	}
 	return nil
 }
 
+// diagnosticDetail describes failed queries for a problem's detail.
+func diagnosticDetail(failures []bdns.QueryDiagnostic) string {
+	if len(failures) == 0 {
+		return ""
+	}
+	queries := make([]string, len(failures))
+	for i, d := range failures {
+		queries[i] = d.String()
+	}
+	return " (" + strings.Join(queries, "; ") + ")"
+}
+
+// checkCAAWithCache serves a recent decision for the same domain, issuer and
+// challenge type from the CAA result cache, falling back to checkCAARecords.
+func (va *ValidationAuthorityImpl) checkCAAWithCache(ctx context.Context, identifier core.AcmeIdentifier, challengeType string) (caaDecision, error) {
+	if va.CAAResultCacheTTL <= 0 {
+		return va.checkCAARecords(ctx, identifier, challengeType)
+	}
+	key := va.caaResultKeyFor(ctx, identifier, va.IssuerDomain, challengeType)
+	if decision, ok := va.loadCAADecision(key); ok {
+		va.stats.Inc("VA.CAA.ResultCache.Hit", 1, 1.0)
+		return decision, nil
+	}
+	va.stats.Inc("VA.CAA.ResultCache.Miss", 1, 1.0)
+	decision, err := va.checkCAARecords(ctx, identifier, challengeType)
+	if err != nil {
+		return caaDecision{}, err
+	}
+	if ttl := va.caaCacheTTL(decision); ttl > 0 {
+		va.storeCAADecision(key, decision, ttl)
+	}
+	return decision, nil
+}
+
+// caaCacheTTL returns how long decision may be cached: the configured cache
+// TTL, shortened to the TTL of the records it was based on. Record TTLs are
+// first raised to CAACacheMinTTL. Nothing is cached for longer than the CAA
+// recheck window less CAAClockSkew.
+func (va *ValidationAuthorityImpl) caaCacheTTL(decision caaDecision) time.Duration {
+	ttl := va.CAAResultCacheTTL
+	if decision.present {
+		ttl = decision.recordTTL
+		if ttl < va.CAACacheMinTTL {
+			ttl = va.CAACacheMinTTL
+		}
+		if ttl > va.CAAResultCacheTTL {
+			ttl = va.CAAResultCacheTTL
+		}
+	}
+	if window := va.caaRecheckWindow(); ttl > window {
+		ttl = window
+	}
+	return ttl
+}
+
+// caaRecheckWindow returns how long a CAA decision may be relied upon, after
+// allowing for clock skew.
+func (va *ValidationAuthorityImpl) caaRecheckWindow() time.Duration {
+	window := caaRecheckWindow - va.CAAClockSkew
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+// CAARecheckDeadline returns the time by which the CAA decision for a domain,
+// made now from caaSet (nil if no records were found), must be rechecked
+// before it is relied upon again: when the records' TTL expires, and no
+// later than the recheck window allows. It is now for a decision that
+// denies issuance, as that can never be relied upon to issue.
+func (va *ValidationAuthorityImpl) CAARecheckDeadline(caaSet *CAASet, valid bool) time.Time {
+	decision := caaDecision{present: caaSet != nil, valid: valid}
+	if caaSet != nil {
+		decision.recordTTL = caaSet.minTTL()
+	}
+	return va.caaRecheckDeadline(decision)
+}
+
+// caaRecheckDeadline is CAARecheckDeadline for a decision.
+func (va *ValidationAuthorityImpl) caaRecheckDeadline(decision caaDecision) time.Time {
+	now := va.clk.Now()
+	if !decision.valid {
+		return now
+	}
+	window := va.caaRecheckWindow()
+	if decision.present && decision.recordTTL < window {
+		window = decision.recordTTL
+	}
+	return now.Add(window)
+}
+
 // Overall validation process
 
 func (va *ValidationAuthorityImpl) validate(ctx context.Context, authz core.Authorization, challengeIndex int) {
@@ -488,6 +785,7 @@ func (va *ValidationAuthorityImpl) validate(ctx context.Context, authz core.Auth
 	}
 	challenge := &authz.Challenges[challengeIndex]
 	vStart := va.clk.Now()
+	ctx = withCAAAccountURI(ctx, va.caaAccountURI(authz.RegistrationID))
 	validationRecords, prob := va.validateChallengeAndCAA(ctx, authz.Identifier, *challenge)
 
 	challenge.ValidationRecord = validationRecords
@@ -518,7 +816,7 @@ func (va *ValidationAuthorityImpl) validate(ctx context.Context, authz core.Auth
 func (va *ValidationAuthorityImpl) validateChallengeAndCAA(ctx context.Context, identifier core.AcmeIdentifier, challenge core.Challenge) ([]core.ValidationRecord, *probs.ProblemDetails) {
 	ch := make(chan *probs.ProblemDetails, 1)
 	go func() {
-		ch <- va.checkCAA(ctx, identifier)
+		ch <- va.checkCAA(ctx, identifier, challenge.Type)
 	}()
 
 	// TODO(#1292): send into another goroutine
@@ -578,7 +876,8 @@ func (va *ValidationAuthorityImpl) PerformValidation(domain string, challenge co
 	}
 	vStart := va.clk.Now()
 
-	records, prob := va.validateChallengeAndCAA(context.TODO(), core.AcmeIdentifier{Type: "dns", Value: domain}, challenge)
+	ctx := withCAAAccountURI(context.TODO(), va.caaAccountURI(authz.RegistrationID))
+	records, prob := va.validateChallengeAndCAA(ctx, core.AcmeIdentifier{Type: "dns", Value: domain}, challenge)
 
 	logEvent.ValidationRecords = records
 	resultStatus := core.StatusInvalid
@@ -602,37 +901,198 @@ func (va *ValidationAuthorityImpl) PerformValidation(domain string, challenge co
 
 // CAASet consists of filtered CAA records
 type CAASet struct {
+	// Name is the owner name at which the records were found, which may be
+	// an ancestor of the name being checked.
+	Name      string
 	Issue     []*dns.CAA
 	Issuewild []*dns.CAA
 	Iodef     []*dns.CAA
 	Unknown   []*dns.CAA
 }
 
+// IodefTarget is a parsed iodef property: a URL to which a CA may report
+// requests that violate the domain's CAA policy.
+type IodefTarget struct {
+	// Scheme is "mailto" or "https".
+	Scheme string
+	// Target is the email address for mailto, or the whole URL for https.
+	Target string
+}
+
+// iodefTargets parses the set's iodef properties. Only mailto and https URLs
+// are accepted (RFC 8659 section 4.4); the values of other records are
+// returned as invalid.
+func (caaSet CAASet) iodefTargets() ([]IodefTarget, []string) {
+	var targets []IodefTarget
+	var invalid []string
+	for _, caaRecord := range caaSet.Iodef {
+		target, ok := parseIodef(caaRecord.Value)
+		if !ok {
+			invalid = append(invalid, caaRecord.Value)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets, invalid
+}
+
+// parseIodef parses the value of an iodef property, returning false if it
+// isn't a usable mailto or https URL.
+func parseIodef(value string) (IodefTarget, bool) {
+	u, err := url.Parse(strings.Trim(value, whitespaceCutset))
+	if err != nil {
+		return IodefTarget{}, false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "mailto":
+		at := strings.LastIndex(u.Opaque, "@")
+		if at <= 0 || at == len(u.Opaque)-1 {
+			return IodefTarget{}, false
+		}
+		return IodefTarget{Scheme: "mailto", Target: u.Opaque}, true
+	case "https":
+		if u.Host == "" {
+			return IodefTarget{}, false
+		}
+		return IodefTarget{Scheme: "https", Target: u.String()}, true
+	}
+	return IodefTarget{}, false
+}
+
 // returns true if any CAA records have unknown tag properties and are flagged critical.
-func (caaSet CAASet) criticalUnknown() bool {
-	if len(caaSet.Unknown) > 0 {
-		for _, caaRecord := range caaSet.Unknown {
-			// The critical flag is the bit with significance 128. However, many CAA
-			// record users have misinterpreted the RFC and concluded that the bit
-			// with significance 1 is the critical bit. This is sufficiently
-			// widespread that that bit must reasonably be considered an alias for
-			// the critical bit. The remaining bits are 0/ignore as proscribed by the
-			// RFC.
-			if (caaRecord.Flag & (128 | 1)) != 0 {
-				return true
+// Which flag bit made a record critical is counted, to track how widespread
+// the misinterpreted bit-1 flag is.
+func (caaSet CAASet) criticalUnknown(stats statsd.Statter) bool {
+	bit128, bit1Only := caaSet.criticalFlags()
+	if bit128 {
+		stats.Inc("VA.CAA.CriticalFlag.Bit128", 1, 1.0)
+	}
+	if bit1Only {
+		stats.Inc("VA.CAA.CriticalFlag.Bit1", 1, 1.0)
+	}
+	return bit128 || bit1Only
+}
+
+// criticalFlags reports whether any unknown property is flagged critical by
+// the bit with significance 128, and whether any is flagged only by the bit
+// with significance 1.
+func (caaSet CAASet) criticalFlags() (bit128, bit1Only bool) {
+	for _, caaRecord := range caaSet.Unknown {
+		// The critical flag is the bit with significance 128. However, many CAA
+		// record users have misinterpreted the RFC and concluded that the bit
+		// with significance 1 is the critical bit. This is sufficiently
+		// widespread that that bit must reasonably be considered an alias for
+		// the critical bit. The remaining bits are 0/ignore as proscribed by the
+		// RFC.
+		if caaRecord.Flag&128 != 0 {
+			bit128 = true
+		} else if caaRecord.Flag&1 != 0 {
+			bit1Only = true
+		}
+	}
+	return bit128, bit1Only
+}
+
+// blank returns true if no record in the set carries any information: each
+// has an empty tag, or is an iodef or unknown property with an empty or
+// whitespace-only value. Blank issue and issuewild values are meaningful,
+// forbidding issuance, so they never make a set blank.
+func (caaSet CAASet) blank() bool {
+	if len(caaSet.Issue) > 0 || len(caaSet.Issuewild) > 0 {
+		return false
+	}
+	for _, records := range [][]*dns.CAA{caaSet.Iodef, caaSet.Unknown} {
+		for _, caa := range records {
+			if caa.Tag != "" && strings.TrimSpace(caa.Value) != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// conflicts returns the tags, "issue" or "issuewild", for which the set has
+// both a deny-all record (";") and one naming an issuer. Issuance still
+// follows the records naming issuers, but the deny-all record suggests the
+// zone isn't configured as intended.
+func (caaSet CAASet) conflicts() []string {
+	var tags []string
+	for _, property := range []struct {
+		tag     string
+		records []*dns.CAA
+	}{
+		{"issue", caaSet.Issue},
+		{"issuewild", caaSet.Issuewild},
+	} {
+		var denyAll, named bool
+		for _, caa := range property.records {
+			if extractIssuerDomain(caa) == "" {
+				denyAll = true
+			} else {
+				named = true
 			}
 		}
+		if denyAll && named {
+			tags = append(tags, property.tag)
+		}
 	}
+	return tags
+}
 
+// caaReservedFlags are the flag bits RFC 8659 reserves: every bit but the
+// critical bit, 128, and bit 1, which is accepted as an alias for it.
+const caaReservedFlags = ^uint8(128 | 1)
+
+// reservedFlags returns the records in the set with any reserved flag bit
+// set. They are treated like any other records, but suggest the zone was
+// misconfigured.
+func (caaSet CAASet) reservedFlags() []*dns.CAA {
+	var records []*dns.CAA
+	for _, property := range [][]*dns.CAA{caaSet.Issue, caaSet.Issuewild, caaSet.Iodef, caaSet.Unknown} {
+		for _, caa := range property {
+			if caa.Flag&caaReservedFlags != 0 {
+				records = append(records, caa)
+			}
+		}
+	}
+	return records
+}
+
+// synthesized returns true if any record in the set was synthesized from a
+// wildcard, which the resolver marks by giving it a wildcard owner name.
+func (caaSet CAASet) synthesized() bool {
+	for _, records := range [][]*dns.CAA{caaSet.Issue, caaSet.Issuewild, caaSet.Iodef, caaSet.Unknown} {
+		for _, caa := range records {
+			if strings.HasPrefix(caa.Hdr.Name, "*.") {
+				return true
+			}
+		}
+	}
 	return false
 }
 
+// minTTL returns the smallest TTL of any record in the set.
+func (caaSet CAASet) minTTL() time.Duration {
+	var min uint32
+	first := true
+	for _, records := range [][]*dns.CAA{caaSet.Issue, caaSet.Issuewild, caaSet.Iodef, caaSet.Unknown} {
+		for _, caaRecord := range records {
+			if first || caaRecord.Hdr.Ttl < min {
+				min = caaRecord.Hdr.Ttl
+				first = false
+			}
+		}
+	}
+	return time.Duration(min) * time.Second
+}
+
 // Filter CAA records by property
 func newCAASet(CAAs []*dns.CAA) *CAASet {
 	var filtered CAASet
 
 	for _, caaRecord := range CAAs {
-		switch caaRecord.Tag {
+		// Property tags are case-insensitive (RFC 6844 section 5.1).
+		switch strings.ToLower(caaRecord.Tag) {
 		case "issue":
 			filtered.Issue = append(filtered.Issue, caaRecord)
 		case "issuewild":
@@ -648,118 +1108,887 @@ func newCAASet(CAAs []*dns.CAA) *CAASet {
 }
 
 func (va *ValidationAuthorityImpl) getCAASet(ctx context.Context, hostname string) (*CAASet, error) {
+	if net.ParseIP(strings.Trim(hostname, "[]")) != nil {
+		return nil, errIPAddress
+	}
+	// Don't start any lookups for a request that has already been given up
+	// on.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	caaSet, lookups, err := va.climbCAATree(ctx, hostname, 0, new(int64))
+	// Statsd timers double as histograms.
+	va.stats.Timing("VA.CAA.LookupsPerCheck", int64(lookups), 1.0)
+	return caaSet, err
+}
+
+// climbCAATree looks for the closest CAA record set to hostname, and also
+// returns how many names it looked up. Under RFC 6844 it follows DNAME
+// redirections into the target's tree. redirects counts the DNAME
+// redirections already followed to reach hostname, and records the CAA
+// records already returned by lookups for the check.
+func (va *ValidationAuthorityImpl) climbCAATree(ctx context.Context, hostname string, redirects int, records *int64) (*CAASet, int, error) {
 	hostname = strings.TrimRight(hostname, ".")
 	labels := strings.Split(hostname, ".")
+	for len(labels) > 1 && va.skipCAALabel(labels[0]) {
+		labels = labels[1:]
+	}
+	names := make([]string, len(labels))
+	for i := range labels {
+		names[i] = strings.Join(labels[i:], ".")
+	}
+	if va.CAARegisteredDomainShortcut {
+		names = registeredDomainShortcut(names)
+	}
 
 	// See RFC 6844 "Certification Authority Processing" for pseudocode.
 	// Essentially: check CAA records for the FDQN to be issued, and all
 	// parent domains.
 	//
 	// The lookups are performed in parallel in order to avoid timing out
-	// the RPC call.
+	// the RPC call. Retries of temporary errors happen inside each lookup, so
+	// a transient failure for one name never repeats the queries for others.
+	// At most CAAMaxConcurrentLookups are in flight at once, most specific
+	// names first, so that very deep names don't flood the resolver.
 	//
-	// We depend on our resolver to snap CNAME and DNAME records.
+	// We depend on our resolver to snap CNAME and DNAME records. Under RFC
+	// 6844 a DNAME also changes the tree being climbed: a name under a
+	// DNAME'd subtree is covered by the CAA records above the redirected
+	// name, not those above the original one, so we restart the climb there.
 
 	type result struct {
 		records []*dns.CAA
+		dnames  []*dns.DNAME
 		err     error
 	}
-	results := make([]result, len(labels))
+	results := make([]result, len(names))
+	// Every lookup's records count towards CAAMaxRecords for the whole
+	// check, including the climbs DNAMEs lead to. Once the limit is passed
+	// the records are dropped rather than held on to.
+	overLimit := func(r *result) bool {
+		if va.CAAMaxRecords <= 0 {
+			return false
+		}
+		if atomic.AddInt64(records, int64(len(r.records))) > int64(va.CAAMaxRecords) {
+			r.records, r.dnames = nil, nil
+			return true
+		}
+		return false
+	}
+
+	resolver := va.resolverFor(ResolverPurposeCAA)
+	lookups := len(names)
+	queried := make([]bool, len(names))
+	if va.CAAMinimizeQueries {
+		// Query from the top of the tree down, one label at a time, so
+		// that the full name is only revealed when every ancestor exists.
+		// Once a name is known not to exist, neither does anything below
+		// it (RFC 8020), so it has no records and isn't looked up.
+		answers := bdns.CAAAnswersFrom(ctx)
+		if answers == nil {
+			ctx, answers = bdns.WithCAAAnswers(ctx)
+		}
+		lookups = 0
+		for i := len(names) - 1; i >= 0; i-- {
+			r := &results[i]
+			r.records, r.dnames, r.err = resolver.LookupCAA(ctx, names[i])
+			queried[i] = true
+			lookups++
+			if r.err != nil {
+				return nil, lookups, r.err
+			}
+			va.warnLargeCAAResponse(names[i], r.records)
+			if overLimit(r) {
+				return nil, lookups, errTooManyCAARecords
+			}
+			if answers.NameError(names[i]) {
+				va.stats.Inc("VA.CAA.MinimizedNameError", 1, 1.0)
+				break
+			}
+		}
+	} else {
+		var wg sync.WaitGroup
+		var sem chan struct{}
+		if va.CAAMaxConcurrentLookups > 0 {
+			sem = make(chan struct{}, va.CAAMaxConcurrentLookups)
+		}
 
-	var wg sync.WaitGroup
+		for i := range names {
+			queried[i] = true
+			if sem != nil {
+				sem <- struct{}{}
+			}
+			// Start the concurrent DNS lookup.
+			wg.Add(1)
+			go func(name string, r *result) {
+				r.records, r.dnames, r.err = resolver.LookupCAA(ctx, name)
+				va.warnLargeCAAResponse(name, r.records)
+				overLimit(r)
+				if sem != nil {
+					<-sem
+				}
+				wg.Done()
+			}(names[i], &results[i])
+		}
 
-	for i := 0; i < len(labels); i++ {
-		// Start the concurrent DNS lookup.
-		wg.Add(1)
-		go func(name string, r *result) {
-			r.records, r.err = va.DNSResolver.LookupCAA(ctx, name)
-			wg.Done()
-		}(strings.Join(labels[i:], "."), &results[i])
+		wg.Wait()
+		if va.CAAMaxRecords > 0 && atomic.LoadInt64(records) > int64(va.CAAMaxRecords) {
+			return nil, lookups, errTooManyCAARecords
+		}
 	}
 
-	wg.Wait()
+	if path := caaClimbPathFrom(ctx); path != nil {
+		for i, res := range results {
+			if queried[i] {
+				path.steps = append(path.steps, core.CAAClimbStep{Name: names[i], RecordsFound: len(res.records) > 0})
+			}
+		}
+	}
 
 	// Return the first result
-	for _, res := range results {
+	for i, res := range results {
 		if res.err != nil {
-			return nil, res.err
+			return nil, lookups, res.err
 		}
+		name := names[i]
+		target := dnameTarget(name, res.dnames)
 		if len(res.records) > 0 {
-			return newCAASet(res.records), nil
+			if va.CAAStrictAncestorErrors {
+				for _, ancestor := range results[i+1:] {
+					if ancestor.err != nil {
+						va.stats.Inc("VA.CAA.StrictAncestorError", 1, 1.0)
+						return nil, lookups, ancestor.err
+					}
+				}
+			}
+			caaSet := newCAASet(res.records)
+			caaSet.Name = target
+			return caaSet, lookups, nil
+		}
+		if target != name && va.CAARuleset == CAARulesetRFC6844 {
+			if redirects >= maxCAADNAMERedirects {
+				return nil, lookups, errTooManyDNAMERedirects
+			}
+			va.stats.Inc("VA.CAA.DNAMERedirect", 1, 1.0)
+			caaSet, redirectedLookups, err := va.climbCAATree(ctx, target, redirects+1, records)
+			return caaSet, lookups + redirectedLookups, err
 		}
 	}
 
 	// no CAA records found
-	return nil, nil
+	return nil, lookups, nil
+}
+
+// warnLargeCAAResponse logs a warning if the CAA records a lookup for name
+// returned are larger than CAALargeResponseSize.
+func (va *ValidationAuthorityImpl) warnLargeCAAResponse(name string, records []*dns.CAA) {
+	if va.CAALargeResponseSize <= 0 {
+		return
+	}
+	size := caaResponseSize(records)
+	if size <= va.CAALargeResponseSize {
+		return
+	}
+	va.stats.Inc("VA.CAA.LargeResponse", 1, 1.0)
+	va.log.Warning(fmt.Sprintf("Large CAA response for %s: %d records, %d bytes", name, len(records), size))
+}
+
+// caaResponseSize returns the uncompressed wire-format size of records.
+func caaResponseSize(records []*dns.CAA) int {
+	var size int
+	buf := make([]byte, dns.MaxMsgSize)
+	for _, caa := range records {
+		n, err := dns.PackRR(caa, buf, 0, nil, false)
+		if err != nil {
+			continue
+		}
+		size += n
+	}
+	return size
+}
+
+// registeredDomainShortcut drops the names strictly between the first of
+// names, the name being checked, and its registered domain, keeping the
+// registered domain and its ancestors. names runs from most to least
+// specific.
+func registeredDomainShortcut(names []string) []string {
+	registered, err := publicsuffix.EffectiveTLDPlusOne(names[0])
+	if err != nil {
+		return names
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i] == registered {
+			return append(names[:1:1], names[i:]...)
+		}
+	}
+	return names
+}
+
+// CAA processing rulesets. RFC 8659 obsoletes RFC 6844, and the two differ
+// in how aliases affect the tree climb. RFC 6844 section 4 climbs the tree
+// of an alias's target: for a name under a DNAME'd subtree, the records
+// above the redirected name apply. RFC 8659 section 3 only ever climbs the
+// ancestors of the name being checked; the resolver still follows aliases
+// for each query, so records at the redirected name itself are found, but
+// its parents are never consulted. The definitions of the properties and
+// of the critical flag are the same under both.
+const (
+	CAARulesetRFC8659 = "rfc8659"
+	CAARulesetRFC6844 = "rfc6844"
+)
+
+// ValidCAARuleset returns true if ruleset names a supported CAA ruleset, or
+// is empty to select the default.
+func ValidCAARuleset(ruleset string) bool {
+	return ruleset == "" || ruleset == CAARulesetRFC8659 || ruleset == CAARulesetRFC6844
 }
 
-func (va *ValidationAuthorityImpl) checkCAARecords(ctx context.Context, identifier core.AcmeIdentifier) (present, valid bool, err error) {
-	hostname := strings.ToLower(identifier.Value)
+// maxCAADNAMERedirects bounds the DNAME redirections followed for a single
+// CAA check, so that a DNAME loop can't keep us climbing forever.
+const maxCAADNAMERedirects = 8
+
+// errTooManyDNAMERedirects is returned when a CAA check is redirected more
+// than maxCAADNAMERedirects times.
+var errTooManyDNAMERedirects = errors.New("too many DNAME redirections")
+
+// dnameTarget applies the DNAME substitutions in dnames to name, in order,
+// and returns the name the query was finally redirected to (RFC 6672). A
+// DNAME only redirects names strictly below its owner.
+func dnameTarget(name string, dnames []*dns.DNAME) string {
+	target := strings.ToLower(dns.Fqdn(name))
+	for _, dname := range dnames {
+		owner := strings.ToLower(dns.Fqdn(dname.Hdr.Name))
+		if owner == "." || !strings.HasSuffix(target, "."+owner) {
+			continue
+		}
+		target = strings.TrimSuffix(target, owner) + strings.ToLower(dns.Fqdn(dname.Target))
+	}
+	if len(dnames) == 0 || target == strings.ToLower(dns.Fqdn(name)) {
+		return name
+	}
+	return strings.TrimRight(target, ".")
+}
+
+// skipCAALabel returns true if label starts with one of
+// CAASkipLabelPrefixes.
+func (va *ValidationAuthorityImpl) skipCAALabel(label string) bool {
+	for _, prefix := range va.CAASkipLabelPrefixes {
+		if strings.HasPrefix(label, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// errBlankCAARecords is returned for blank CAA record sets when
+// CAABlankRecordsAreErrors is set.
+var errBlankCAARecords = errors.New("CAA records are all blank")
+
+// errRegisteredDomainUnanswered is returned when no CAA records were found,
+// but the lookup for the registered domain wasn't answered, when
+// CAARequireRegisteredDomainAnswer is set.
+var errRegisteredDomainUnanswered = errors.New("no answer for the registered domain's CAA records")
+
+// errLameDelegation is returned when the lookup for an ancestor of the name
+// being checked wasn't answered, when CAALameDelegationsAreErrors is set.
+var errLameDelegation = errors.New("no answer for an ancestor's CAA records")
+
+// errTooManyLabels is returned for names with more than CAAMaxLabels labels.
+var errTooManyLabels = errors.New("name has too many labels")
+
+// errTooManyCAARecords is returned when the lookups for a check return more
+// than CAAMaxRecords records in all.
+var errTooManyCAARecords = errors.New("too many CAA records")
+
+// errIPAddress is returned for IP address literals, which have no CAA
+// records to look up.
+var errIPAddress = errors.New("name is an IP address")
+
+// caaDecision is the outcome of checking an identifier's CAA records.
+type caaDecision struct {
+	present bool
+	valid   bool
+	// relevant is false when records were present but none of them bear on
+	// issuance, e.g. only iodef or non-critical unknown properties.
+	relevant bool
+	// owner is the name at which the deciding CAA records were found. It is
+	// empty when no records were present.
+	owner string
+	// recordTTL is the smallest TTL among the deciding CAA records.
+	recordTTL time.Duration
+	// synthesized is true when the records were synthesized from a wildcard
+	// CAA record. They are otherwise treated like any other records.
+	synthesized bool
+	// reason says why issuance is prevented. It is caaAllowed when valid.
+	reason caaReason
+	// method is the challenge type that was checked, and allowedMethods the
+	// ones our records permit instead, for caaMethodNotAllowed.
+	method         string
+	allowedMethods []string
+	// iodefs are the well-formed reporting targets among the records.
+	iodefs []IodefTarget
+	// issuer is the CAA identity the records authorized, either IssuerDomain
+	// or CAAFallbackIssuerDomain. It is empty unless they authorized one.
+	issuer string
+}
+
+// caaReason classifies why a CAA check prevented issuance.
+type caaReason int
+
+const (
+	caaAllowed caaReason = iota
+	// caaUnauthorized: issue records exist, but none name us.
+	caaUnauthorized
+	// caaCriticalUnknown: a record has a critical property we don't know.
+	caaCriticalUnknown
+	// caaMethodNotAllowed: we are named, but not for the challenge type used,
+	// whether by a validationmethods parameter or by our own method policy.
+	caaMethodNotAllowed
+	// caaAccountURIMismatch: we are named, but only by records whose
+	// accounturi parameter binds them to other accounts.
+	caaAccountURIMismatch
+)
+
+// caaProblem converts a CAA denial for domain into the problem document
+// returned to ACME clients.
+func caaProblem(domain string, decision caaDecision) *probs.ProblemDetails {
+	var detail string
+	switch decision.reason {
+	case caaCriticalUnknown:
+		detail = fmt.Sprintf("CAA record for %s has an unrecognized critical property and prevents issuance", domain)
+	case caaMethodNotAllowed:
+		detail = fmt.Sprintf("CAA record for %s prevents issuance using validation method %q; allowed methods: %s",
+			domain, decision.method, truncateCAAValue(strings.Join(decision.allowedMethods, ", ")))
+	case caaAccountURIMismatch:
+		detail = fmt.Sprintf("CAA record for %s prevents issuance to this account; accounturi names other accounts", domain)
+	default:
+		detail = fmt.Sprintf("CAA record for %s prevents issuance", domain)
+	}
+	return probs.CAA(detail)
+}
+
+func (va *ValidationAuthorityImpl) checkCAARecords(ctx context.Context, identifier core.AcmeIdentifier, challengeType string) (caaDecision, error) {
+	lookup, err := va.lookupCAA(ctx, identifier)
+	if err != nil {
+		return caaDecision{}, err
+	}
+	return va.decideCAA(ctx, identifier, lookup, challengeType), nil
+}
+
+// caaHostname returns the name to climb from for the CAA records of name,
+// or errTooManyLabels if it has more than CAAMaxLabels.
+func (va *ValidationAuthorityImpl) caaHostname(name string) (string, error) {
+	// A wildcard's records are found at the name it is rooted at.
+	hostname := strings.TrimPrefix(strings.ToLower(name), "*.")
+	if va.CAAMaxLabels > 0 && len(strings.Split(strings.TrimRight(hostname, "."), ".")) > va.CAAMaxLabels {
+		return "", errTooManyLabels
+	}
+	return hostname, nil
+}
+
+// caaLookup is the CAA record set found for a check, along with the queries
+// made to find it.
+type caaLookup struct {
+	hostname string
+	caaSet   *CAASet
+	lookups  map[string]bool
+	rtts     bdns.RTTSummary
+}
+
+// lookupCAA finds the CAA records that govern identifier, applying every
+// policy about which lookups can be relied upon. The records don't depend on
+// the challenge type, so one lookup can be decided for several.
+func (va *ValidationAuthorityImpl) lookupCAA(ctx context.Context, identifier core.AcmeIdentifier) (caaLookup, error) {
+	hostname, err := va.caaHostname(identifier.Value)
+	if err != nil {
+		return caaLookup{}, err
+	}
+	ctx, rtts := bdns.WithRTTRecorder(ctx)
+	ctx, answers := bdns.WithCAAAnswers(ctx)
 	caaSet, err := va.getCAASet(ctx, hostname)
+	va.recordCAARTTs(hostname, rtts.Summary())
 	if err != nil {
-		return false, false, err
+		return caaLookup{}, err
 	}
+	if lame := unansweredAncestors(hostname, caaSet, answers); len(lame) > 0 {
+		va.stats.Inc("VA.CAA.LameDelegation", 1, 1.0)
+		va.log.Warning(fmt.Sprintf("No answer checking CAA for %s at %s, which may be lamely delegated",
+			hostname, strings.Join(lame, ", ")))
+		if va.CAALameDelegationsAreErrors {
+			return caaLookup{}, errLameDelegation
+		}
+	}
+	if caaSet == nil && va.CAARequireRegisteredDomainAnswer {
+		// Only trust an absence of records if the zone answered for itself.
+		registered, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+		if err != nil {
+			registered = hostname
+		}
+		if !answers.Answered(registered) {
+			va.stats.Inc("VA.CAA.RegisteredDomainUnanswered", 1, 1.0)
+			return caaLookup{}, errRegisteredDomainUnanswered
+		}
+	}
+	if caaSet != nil && caaSet.blank() {
+		va.stats.Inc("VA.CAA.Blank", 1, 1.0)
+		if va.CAABlankRecordsAreErrors {
+			return caaLookup{}, errBlankCAARecords
+		}
+		caaSet = nil
+	}
+	return caaLookup{hostname: hostname, caaSet: caaSet, lookups: answers.Lookups(), rtts: rtts.Summary()}, nil
+}
+
+// decideCAA evaluates the records found by lookupCAA for challengeType.
+func (va *ValidationAuthorityImpl) decideCAA(ctx context.Context, identifier core.AcmeIdentifier, lookup caaLookup, challengeType string) caaDecision {
+	caaSet := lookup.caaSet
+	decision := va.evaluateCAASet(identifier, caaSet, challengeType, caaAccountURIFrom(ctx))
+	va.logCAAQueries(lookup.hostname, decision, lookup.lookups, lookup.rtts)
+	if va.CAAReportShadowedAncestors && decision.reason == caaCriticalUnknown && caaSet.Name == strings.TrimRight(lookup.hostname, ".") {
+		va.reportShadowedAncestor(ctx, identifier, caaSet.Name, challengeType)
+	}
+	return decision
+}
+
+// reportShadowedAncestor is called when a critical unknown property at
+// hostname, the exact name being checked, has denied issuance. The tree
+// climb stopped there, as RFC 8659 requires, but operators may expect the
+// policy of a parent domain to apply, so we look up the records above
+// hostname and log when they would have authorized us.
+func (va *ValidationAuthorityImpl) reportShadowedAncestor(ctx context.Context, identifier core.AcmeIdentifier, hostname, challengeType string) {
+	dot := strings.Index(hostname, ".")
+	if dot < 0 {
+		return
+	}
+	// The ancestor lookup is made outside getCAASet and criticalUnknown, so
+	// that it isn't counted as a second check in their stats.
+	ancestorSet, _, err := va.climbCAATree(ctx, hostname[dot+1:], 0, new(int64))
+	if err != nil || ancestorSet == nil {
+		return
+	}
+	if bit128, bit1Only := ancestorSet.criticalFlags(); bit128 || bit1Only {
+		return
+	}
+	issueSet := ancestorSet.Issue
+	if strings.HasPrefix(identifier.Value, "*.") && len(ancestorSet.Issuewild) > 0 {
+		issueSet = ancestorSet.Issuewild
+	}
+	if authorized, _, _ := va.enabledIdentityAuthorized(issueSet, va.IssuerDomain, challengeType, caaAccountURIFrom(ctx)); !authorized {
+		return
+	}
+	va.stats.Inc("VA.CAA.CriticalUnknownShadowsAncestor", 1, 1.0)
+	va.log.Warning(fmt.Sprintf("CAA issuance for %s blocked at exact name despite ancestor policy: critical unknown property at %s, while records at %s authorize %s",
+		identifier.Value, hostname, ancestorSet.Name, va.IssuerDomain))
+}
+
+// unansweredAncestors returns the ancestors of hostname whose CAA lookups
+// weren't answered, up to the name caaSet was found at, or all of them if it
+// is nil. Records found at a lower name make the ones above irrelevant.
+func unansweredAncestors(hostname string, caaSet *CAASet, answers *bdns.CAAAnswers) []string {
+	lookups := answers.Lookups()
+	var unanswered []string
+	name := strings.TrimRight(hostname, ".")
+	for {
+		if caaSet != nil && name == caaSet.Name {
+			break
+		}
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+		if answered, ok := lookups[name]; ok && !answered {
+			unanswered = append(unanswered, name)
+		}
+	}
+	return unanswered
+}
+
+// logCAAQueries logs the lookups made for a CAA check, and whether each was
+// answered. Denials are always logged, and other checks sampled at
+// CAAQueryLogSampleRate.
+func (va *ValidationAuthorityImpl) logCAAQueries(hostname string, decision caaDecision, lookups map[string]bool, rtts bdns.RTTSummary) {
+	if decision.valid && (va.CAAQueryLogSampleRate <= 0 || va.sampleCAAQueryLog() >= va.CAAQueryLogSampleRate) {
+		return
+	}
+	var queries []string
+	for name, answered := range lookups {
+		if answered {
+			queries = append(queries, name)
+		} else {
+			queries = append(queries, name+" (unanswered)")
+		}
+	}
+	sort.Strings(queries)
+	va.log.Info(fmt.Sprintf("CAA queries for %s: [%s], resolver RTT total %s, Valid for issuance: %t, Found at: %q",
+		hostname, strings.Join(queries, ", "), rtts.Total, decision.valid, decision.owner))
+}
+
+// sampleCAAQueryLog returns a random number in [0, 1) from va.sample, or
+// from math/rand for a VA not built by NewValidationAuthorityImpl.
+func (va *ValidationAuthorityImpl) sampleCAAQueryLog() float64 {
+	if va.sample == nil {
+		return rand.Float64()
+	}
+	return va.sample()
+}
+
+// recordCAARTTs reports the resolver round-trip times of the queries made
+// for one CAA check, separating network latency from our own overhead.
+func (va *ValidationAuthorityImpl) recordCAARTTs(hostname string, rtts bdns.RTTSummary) {
+	if rtts.Queries == 0 {
+		return
+	}
+	va.stats.TimingDuration("VA.CAA.ResolverRTT.Min", rtts.Min, 1.0)
+	va.stats.TimingDuration("VA.CAA.ResolverRTT.Max", rtts.Max, 1.0)
+	va.stats.TimingDuration("VA.CAA.ResolverRTT.Total", rtts.Total, 1.0)
+	va.log.Debug(fmt.Sprintf("CAA queries for %s: %d, resolver RTT min %s, max %s, total %s",
+		hostname, rtts.Queries, rtts.Min, rtts.Max, rtts.Total))
+}
 
+// evaluateCAASet decides whether caaSet, the CAA records found for
+// identifier (nil if there were none), permit us to issue using the given
+// challenge type, for the account with the given URI. Without an account
+// URI, accounturi parameters are ignored.
+func (va *ValidationAuthorityImpl) evaluateCAASet(identifier core.AcmeIdentifier, caaSet *CAASet, challengeType, accountURI string) caaDecision {
 	if caaSet == nil {
 		// No CAA records found, can issue
 		va.stats.Inc("VA.CAA.None", 1, 1.0)
-		return false, true, nil
+		return caaDecision{present: false, valid: true}
 	}
 
-	// Record stats on directives not currently processed.
+	synthesized := caaSet.synthesized()
+	allowed := caaDecision{present: true, valid: true, relevant: true, owner: caaSet.Name, recordTTL: caaSet.minTTL(), synthesized: synthesized}
+	denied := caaDecision{
+		present:     true,
+		valid:       false,
+		relevant:    true,
+		owner:       caaSet.Name,
+		recordTTL:   caaSet.minTTL(),
+		synthesized: synthesized,
+		reason:      caaUnauthorized,
+		method:      challengeType,
+	}
+	if synthesized {
+		va.stats.Inc("VA.CAA.WildcardSynthesized", 1, 1.0)
+	}
+
+	// Reporting targets are passed along for whoever acts on them. Invalid
+	// ones are reported, but don't affect issuance.
 	if len(caaSet.Iodef) > 0 {
 		va.stats.Inc("VA.CAA.WithIodef", 1, 1.0)
 	}
+	iodefs, invalidIodefs := caaSet.iodefTargets()
+	for _, value := range invalidIodefs {
+		va.stats.Inc("VA.CAA.InvalidIodef", 1, 1.0)
+		va.log.Info(fmt.Sprintf("Ignoring invalid CAA iodef value %q at %s", truncateCAAValue(value), caaSet.Name))
+	}
+	allowed.iodefs = iodefs
+	denied.iodefs = iodefs
+
+	for _, tag := range caaSet.conflicts() {
+		va.stats.Inc("VA.CAA.Conflict", 1, 1.0)
+		va.log.Warning(fmt.Sprintf("CAA records at %s include both a deny-all %s record and %s records naming issuers", caaSet.Name, tag, tag))
+	}
+
+	if va.CAAReportReservedFlags {
+		for _, caa := range caaSet.reservedFlags() {
+			va.stats.Inc("VA.CAA.ReservedFlags", 1, 1.0)
+			va.log.Warning(fmt.Sprintf("CAA %s record at %s sets reserved flag bits %#x", caa.Tag, caaSet.Name, caa.Flag&caaReservedFlags))
+		}
+	}
 
-	if caaSet.criticalUnknown() {
+	if va.CAAReportUnflaggedUnknown {
+		for _, caa := range caaSet.Unknown {
+			if caa.Flag == 0 {
+				va.stats.Inc("VA.CAA.UnflaggedUnknown", 1, 1.0)
+				va.log.Warning(fmt.Sprintf("CAA %s record at %s has no flags set; it may have been critical before a resolver zeroed them", caa.Tag, caaSet.Name))
+			}
+		}
+	}
+
+	if caaSet.criticalUnknown(va.stats) {
 		// Contains unknown critical directives.
 		va.stats.Inc("VA.CAA.UnknownCritical", 1, 1.0)
-		return true, false, nil
+		denied.reason = caaCriticalUnknown
+		return denied
 	}
 
 	if len(caaSet.Unknown) > 0 {
 		va.stats.Inc("VA.CAA.WithUnknownNoncritical", 1, 1.0)
 	}
 
-	if len(caaSet.Issue) == 0 {
+	// For a wildcard identifier, issuewild records take precedence over issue
+	// records when there are any (RFC 6844 section 5.3), including when they
+	// are only the unsatisfiable ";".
+	issueSet := caaSet.Issue
+	if strings.HasPrefix(identifier.Value, "*.") && len(caaSet.Issuewild) > 0 {
+		issueSet = caaSet.Issuewild
+		// An explicit ";" forbids wildcard issuance outright, so it never
+		// falls back.
+		if va.CAAIssuewildFallback && !namesIssuer(caaSet.Issuewild, va.IssuerDomain) &&
+			(va.CAAFallbackIssuerDomain == "" || !namesIssuer(caaSet.Issuewild, va.CAAFallbackIssuerDomain)) &&
+			!namesIssuer(caaSet.Issuewild, "") {
+			va.stats.Inc("VA.CAA.IssuewildFallback", 1, 1.0)
+			issueSet = caaSet.Issue
+		}
+	}
+
+	if len(issueSet) == 0 {
 		// Although CAA records exist, none of them pertain to issuance in this case.
 		// (e.g. there is only an issuewild directive, but we are checking for a
 		// non-wildcard identifier, or there is only an iodef or non-critical unknown
 		// directive.)
 		va.stats.Inc("VA.CAA.NoneRelevant", 1, 1.0)
-		return true, true, nil
+		allowed.relevant = false
+		return allowed
 	}
 
 	// There are CAA records pertaining to issuance in our case. Note that this
 	// includes the case of the unsatisfiable CAA record value ";", used to
 	// prevent issuance by any CA under any circumstance.
 	//
-	// Our CAA identity must be found in the chosen checkSet.
-	for _, caa := range caaSet.Issue {
-		if extractIssuerDomain(caa) == va.IssuerDomain {
-			va.stats.Inc("VA.CAA.Authorized", 1, 1.0)
-			return true, true, nil
+	// Our CAA identity must be found in the chosen checkSet, on a record that
+	// permits the validation method in use.
+	for _, caa := range issueSet {
+		if _, _, trailing := parseCAAIssueValue(caa.Value); trailing != "" {
+			va.stats.Inc("VA.CAA.TrailingGarbage", 1, 1.0)
+			va.log.Warning(fmt.Sprintf("Ignoring trailing content %q in CAA value %q at %s",
+				truncateCAAValue(trailing), truncateCAAValue(caa.Value), caaSet.Name))
+		}
+	}
+
+	identity := va.IssuerDomain
+	authorized, allowedMethods, otherAccount := va.enabledIdentityAuthorized(issueSet, identity, challengeType, accountURI)
+	if !authorized && va.CAAFallbackIssuerDomain != "" {
+		// Only once the primary identity has failed is the fallback tried.
+		var fallbackMethods []string
+		var fallbackOtherAccount bool
+		authorized, fallbackMethods, fallbackOtherAccount = va.enabledIdentityAuthorized(issueSet, va.CAAFallbackIssuerDomain, challengeType, accountURI)
+		allowedMethods = append(allowedMethods, fallbackMethods...)
+		otherAccount = otherAccount || fallbackOtherAccount
+		if authorized {
+			identity = va.CAAFallbackIssuerDomain
+			va.stats.Inc("VA.CAA.AuthorizedByFallback", 1, 1.0)
+			va.log.Notice(fmt.Sprintf("CAA records at %s don't authorize primary identity %s for %s; fallback identity %s authorizes it",
+				caaSet.Name, va.IssuerDomain, identifier.Value, identity))
+		}
+	} else if authorized && va.CAAFallbackIssuerDomain != "" {
+		va.log.Info(fmt.Sprintf("CAA records at %s authorize primary identity %s for %s", caaSet.Name, identity, identifier.Value))
+	}
+	if !authorized && va.CAADelegationParameter != "" {
+		delegated, delegator, delegatedMethods, delegatedOtherAccount := va.delegationAuthorized(issueSet, challengeType, accountURI)
+		allowedMethods = append(allowedMethods, delegatedMethods...)
+		otherAccount = otherAccount || delegatedOtherAccount
+		if delegated && va.caaIdentityEnabled(va.IssuerDomain) {
+			authorized = true
+			identity = va.IssuerDomain
+			va.stats.Inc("VA.CAA.AuthorizedByDelegation", 1, 1.0)
+			va.log.Notice(fmt.Sprintf("CAA records at %s authorize %s for %s by delegation from %s",
+				caaSet.Name, identity, identifier.Value, delegator))
 		}
 	}
 
+	if authorized {
+		if ok, policyMethods := va.issuerMethodPolicyAllows(identity, challengeType); !ok {
+			// The records authorize us, but our own policy doesn't permit
+			// the validation method in use.
+			va.stats.Inc("VA.CAA.MethodNotAllowedByPolicy", 1, 1.0)
+			denied.reason = caaMethodNotAllowed
+			denied.allowedMethods = policyMethods
+			return denied
+		}
+		va.stats.Inc("VA.CAA.Authorized", 1, 1.0)
+		allowed.issuer = identity
+		return allowed
+	}
+
+	if allowedMethods != nil {
+		// We are an authorized issuer, but not for the validation method in use.
+		va.stats.Inc("VA.CAA.MethodNotAllowed", 1, 1.0)
+		denied.reason = caaMethodNotAllowed
+		denied.allowedMethods = allowedMethods
+		return denied
+	}
+
+	if otherAccount {
+		// We are named, but only for other accounts.
+		va.stats.Inc("VA.CAA.AccountURIMismatch", 1, 1.0)
+		denied.reason = caaAccountURIMismatch
+		return denied
+	}
+
 	// The list of authorized issuers is non-empty, but we are not in it. Fail.
 	va.stats.Inc("VA.CAA.Unauthorized", 1, 1.0)
-	return true, false, nil
+	return denied
+}
+
+// authorizesIssuer returns true if any of records authorizes identity to
+// issue using challengeType, for the account with the given URI. Otherwise
+// it returns the methods that records naming identity permit instead, if
+// any, and whether any records naming identity are bound to other accounts.
+// A record must satisfy both its accounturi and its validationmethods
+// parameters to authorize issuance; a record bound to another account
+// permits no methods at all. Without an account URI, accounturi parameters
+// are ignored.
+func authorizesIssuer(records []*dns.CAA, identity, challengeType, accountURI string) (bool, []string, bool) {
+	var allowedMethods []string
+	var otherAccount bool
+	for _, caa := range records {
+		issuer, params, _ := parseCAAIssueValue(caa.Value)
+		if issuer != identity {
+			continue
+		}
+		if uri, bound := params["accounturi"]; bound && accountURI != "" && uri != accountURI {
+			otherAccount = true
+			continue
+		}
+		methods, restricted := params["validationmethods"]
+		if !restricted {
+			return true, nil, false
+		}
+		for _, method := range strings.Split(methods, ",") {
+			method = strings.ToLower(strings.Trim(method, whitespaceCutset))
+			if method == "" {
+				continue
+			}
+			if method == strings.ToLower(challengeType) {
+				return true, nil, false
+			}
+			allowedMethods = append(allowedMethods, method)
+		}
+	}
+	return false, allowedMethods, otherAccount
+}
+
+// enabledIdentityAuthorized is authorizesIssuer for one of our CAA
+// identities, except that a disabled identity is never authorized.
+func (va *ValidationAuthorityImpl) enabledIdentityAuthorized(records []*dns.CAA, identity, challengeType, accountURI string) (bool, []string, bool) {
+	if !va.caaIdentityEnabled(identity) {
+		if namesIssuer(records, identity) {
+			va.stats.Inc("VA.CAA.IdentityDisabled", 1, 1.0)
+		}
+		return false, nil, false
+	}
+	return authorizesIssuer(records, identity, challengeType, accountURI)
+}
+
+// issuerMethodPolicyAllows reports whether the method policy for the CAA
+// identity that authorized a request permits challengeType, along with the
+// methods the policy permits. Without a policy for the identity, every
+// method is permitted.
+func (va *ValidationAuthorityImpl) issuerMethodPolicyAllows(identity, challengeType string) (bool, []string) {
+	methods, ok := va.CAAIssuerMethodPolicies[identity]
+	if !ok {
+		return true, nil
+	}
+	for _, method := range methods {
+		if strings.EqualFold(method, challengeType) {
+			return true, methods
+		}
+	}
+	return false, methods
+}
+
+// namesIssuer returns true if any of records names issuer.
+func namesIssuer(records []*dns.CAA, issuer string) bool {
+	for _, caa := range records {
+		if extractIssuerDomain(caa) == issuer {
+			return true
+		}
+	}
+	return false
 }
 
 // Given a CAA record, assume that the Value is in the issue/issuewild format,
 // that is, a domain name with zero or more additional key-value parameters.
 // Returns the domain name, which may be "" (unsatisfiable).
 func extractIssuerDomain(caa *dns.CAA) string {
-	v := caa.Value
-	v = strings.Trim(v, " \t") // Value can start and end with whitespace.
-	idx := strings.IndexByte(v, ';')
-	if idx < 0 {
-		return v // no parameters; domain only
+	issuer, _, _ := parseCAAIssueValue(caa.Value)
+	return issuer
+}
+
+// parseCAAIssueValue splits the value of an issue or issuewild property into
+// the issuer domain and its key-value parameters (RFC 6844 section 5.2).
+// Parameter tags are lowercased and surrounding whitespace is removed from
+// both tags and values. Unfortunately, the RFC makes no statement on whether
+// any parameters are critical, so parameters we don't understand are ignored.
+//
+// Content that doesn't fit the grammar, such as a comment after the domain
+// or a parameter without a value, is returned as trailing, from the first
+// such content to the end of the value, rather than being read into the
+// domain or a parameter. Well-formed parameters after it are still read, so
+// that garbage can't hide an accounturi or validationmethods restriction.
+func parseCAAIssueValue(value string) (string, map[string]string, string) {
+	parts := strings.Split(value, ";")
+	params := make(map[string]string)
+	// Value can start and end with whitespace.
+	first := strings.Trim(parts[0], " \t")
+	issuer := first
+	var trailing string
+	end := strings.IndexFunc(first, func(r rune) bool {
+		return !isIssuerDomainChar(r)
+	})
+	if end >= 0 {
+		issuer = first[:end]
+		trailing = strings.TrimLeft(strings.Join(append([]string{first[end:]}, parts[1:]...), ";"), " \t")
+	}
+	for i, part := range parts[1:] {
+		idx := strings.IndexByte(part, '=')
+		var tag string
+		if idx >= 0 {
+			tag = strings.ToLower(strings.Trim(part[:idx], " \t"))
+		}
+		if !isCAAParameterTag(tag) {
+			if trailing != "" {
+				continue
+			}
+			rest := strings.Join(parts[i+1:], ";")
+			// A single terminating ";" is allowed.
+			if i == len(parts)-2 && strings.Trim(rest, " \t") == "" {
+				break
+			}
+			trailing = strings.Trim(rest, " \t")
+			continue
+		}
+		params[tag] = strings.Trim(part[idx+1:], " \t")
+	}
+	return issuer, params, trailing
+}
+
+// maxCAAValueOutput bounds how much of a CAA value, or anything derived from
+// one, is written to logs and problem details. Values can be tens of
+// kilobytes long.
+const maxCAAValueOutput = 256
+
+// truncateCAAValue shortens value to maxCAAValueOutput bytes for output,
+// noting how much was cut.
+func truncateCAAValue(value string) string {
+	if len(value) <= maxCAAValueOutput {
+		return value
 	}
+	return fmt.Sprintf("%s... (%d more bytes)", value[:maxCAAValueOutput], len(value)-maxCAAValueOutput)
+}
+
+// isIssuerDomainChar reports whether r may appear in an issuer domain name.
+func isIssuerDomainChar(r rune) bool {
+	return r == '.' || r == '-' || isASCIIAlphanumeric(r)
+}
+
+// isCAAParameterTag reports whether tag is a non-empty run of ASCII letters
+// and digits, as a parameter tag must be.
+func isCAAParameterTag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, r := range tag {
+		if !isASCIIAlphanumeric(r) {
+			return false
+		}
+	}
+	return true
+}
 
-	// Currently, ignore parameters. Unfortunately, the RFC makes no statement on
-	// whether any parameters are critical. Treat unknown parameters as
-	// non-critical.
-	return strings.Trim(v[0:idx], " \t")
+func isASCIIAlphanumeric(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
 }
@@ -14,19 +14,24 @@ import (
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
+	mrand "math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/square/go-jose"
 	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
 
@@ -648,12 +653,359 @@ func TestUpdateValidations(t *testing.T) {
 	test.Assert(t, (took < (time.Second * 3)), "UpdateValidations blocked")
 }
 
+// inflightResolver records the most CAA lookups it has had in flight at once.
+type inflightResolver struct {
+	bdns.MockDNSResolver
+	sync.Mutex
+	inflight, max, total int
+}
+
+func (ir *inflightResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	ir.Lock()
+	ir.inflight++
+	ir.total++
+	if ir.inflight > ir.max {
+		ir.max = ir.inflight
+	}
+	ir.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	ir.Lock()
+	ir.inflight--
+	ir.Unlock()
+	return nil, nil, nil
+}
+
+func TestCAACanceledContext(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	resolver := &inflightResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := va.getCAASet(ctx, "a.b.example.com")
+	test.AssertEquals(t, err, context.Canceled)
+	prob := va.checkCAA(ctx, core.AcmeIdentifier{Type: "dns", Value: "a.b.example.com"}, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "CAA check with a canceled context should fail")
+	test.AssertEquals(t, stats.Counters["VA.CAA.ContextDone"], int64(1))
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = va.getCAASet(ctx, "a.b.example.com")
+	test.AssertEquals(t, err, context.DeadlineExceeded)
+	test.AssertEquals(t, resolver.total, 0)
+}
+
+func TestCAAConcurrencyLimit(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	resolver := &inflightResolver{}
+	va.DNSResolver = resolver
+	va.CAAMaxConcurrentLookups = 3
+
+	deep := strings.Repeat("a.", 20) + "example.com"
+	caaSet, err := va.getCAASet(context.Background(), deep)
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.Assert(t, caaSet == nil, "No records should have been found")
+	test.AssertEquals(t, resolver.total, 22)
+	test.Assert(t, resolver.max <= 3, fmt.Sprintf("%d lookups were in flight at once", resolver.max))
+}
+
+// namesResolver records the names it is asked for CAA records, answering
+// with the mock's records.
+type namesResolver struct {
+	bdns.MockDNSResolver
+	sync.Mutex
+	names []string
+}
+
+func (nr *namesResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	nr.Lock()
+	nr.names = append(nr.names, domain)
+	nr.Unlock()
+	return nr.MockDNSResolver.LookupCAA(ctx, domain)
+}
+
+func TestCAASkipLabelPrefixes(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	resolver := &namesResolver{}
+	va.DNSResolver = resolver
+	va.CAASkipLabelPrefixes = []string{"_acme-challenge"}
+
+	caaSet, err := va.getCAASet(context.Background(), "_acme-challenge.present.com")
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.AssertEquals(t, caaSet.Name, "present.com")
+	sort.Strings(resolver.names)
+	test.AssertDeepEquals(t, resolver.names, []string{"com", "present.com"})
+
+	// Reserved labels are only skipped at the start of the name.
+	resolver.names = nil
+	_, err = va.getCAASet(context.Background(), "www._acme-challenge.present.com")
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.AssertEquals(t, len(resolver.names), 4)
+
+	// Without the option every label is queried.
+	va.CAASkipLabelPrefixes = nil
+	resolver.names = nil
+	_, err = va.getCAASet(context.Background(), "_acme-challenge.present.com")
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.AssertEquals(t, len(resolver.names), 3)
+}
+
+func TestCAARegisteredDomainShortcut(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	resolver := &namesResolver{}
+	va.DNSResolver = resolver
+
+	deep := "a.b.c.d.present.com"
+	caaSet, err := va.getCAASet(context.Background(), deep)
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.AssertEquals(t, caaSet.Name, "present.com")
+	test.AssertEquals(t, len(resolver.names), 6)
+
+	va.CAARegisteredDomainShortcut = true
+	resolver.names = nil
+	caaSet, err = va.getCAASet(context.Background(), deep)
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.AssertEquals(t, caaSet.Name, "present.com")
+	sort.Strings(resolver.names)
+	test.AssertDeepEquals(t, resolver.names, []string{"a.b.c.d.present.com", "com", "present.com"})
+
+	// Records at the exact name are still found.
+	resolver.names = nil
+	caaSet, err = va.getCAASet(context.Background(), "present.servfail.com")
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.AssertEquals(t, caaSet.Name, "present.servfail.com")
+
+	test.AssertDeepEquals(t, registeredDomainShortcut([]string{"example.com", "com"}), []string{"example.com", "com"})
+	test.AssertDeepEquals(t, registeredDomainShortcut([]string{"a.b.example.co.uk", "b.example.co.uk", "example.co.uk", "co.uk", "uk"}),
+		[]string{"a.b.example.co.uk", "example.co.uk", "co.uk", "uk"})
+}
+
+// ancestorErrorResolver fails CAA lookups for com, answering others with the
+// mock's records.
+type ancestorErrorResolver struct {
+	bdns.MockDNSResolver
+}
+
+func (ar *ancestorErrorResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	if domain == "com" {
+		return nil, nil, errors.New("SERVFAIL")
+	}
+	return ar.MockDNSResolver.LookupCAA(ctx, domain)
+}
+
+func TestCAAStrictAncestorErrors(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &ancestorErrorResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	present := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+
+	// Normally present.com's records decide, whatever happened to com.
+	prob := va.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "present.com should be allowed despite the com failure")
+
+	va.CAAStrictAncestorErrors = true
+	prob = va.checkCAA(context.Background(), present, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "present.com should be denied when com fails in strict mode")
+
+	// Names without records fail either way.
+	va.CAAStrictAncestorErrors = false
+	prob = va.checkCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "absent.com"}, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "absent.com should be denied when com fails")
+}
+
+func TestCAAResolverDiagnostics(t *testing.T) {
+	// A server that hangs up on every query.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	test.AssertNotError(t, err, "Failed to listen")
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = bdns.NewTestDNSResolverImpl(time.Second, []string{l.Addr().String()}, metrics.NewNoopScope(), clock.Default(), 1)
+	va.IssuerDomain = "letsencrypt.org"
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "example.com"}
+
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "Check should fail")
+	test.Assert(t, !strings.Contains(prob.Detail, l.Addr().String()), "Diagnostics included when off: "+prob.Detail)
+
+	va.CAAResolverDiagnostics = true
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob != nil, "Check should fail")
+	test.Assert(t, strings.Contains(prob.Detail, "CAA example.com @"+l.Addr().String()+": "),
+		"Resolver missing from diagnostics: "+prob.Detail)
+	test.Assert(t, strings.Contains(prob.Detail, "after 1 tries"), "Tries missing from diagnostics: "+prob.Detail)
+}
+
+func TestCAAMinimizeQueries(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.CAAMinimizeQueries = true
+
+	testCases := []struct {
+		hostname string
+		owner    string
+		queries  []string
+	}{
+		{"a.b.present.com", "present.com", []string{"com", "present.com", "b.present.com", "a.b.present.com"}},
+		// Nothing under a name that doesn't exist is looked up.
+		{"a.b.nxdomain.com", "", []string{"com", "nxdomain.com"}},
+	}
+	for _, tc := range testCases {
+		resolver := &namesResolver{}
+		va.DNSResolver = resolver
+		caaSet, err := va.getCAASet(context.Background(), tc.hostname)
+		test.AssertNotError(t, err, "getCAASet failed")
+		if tc.owner == "" {
+			test.Assert(t, caaSet == nil, fmt.Sprintf("%s shouldn't have CAA records", tc.hostname))
+		} else {
+			test.AssertEquals(t, caaSet.Name, tc.owner)
+		}
+		test.AssertDeepEquals(t, resolver.names, tc.queries)
+	}
+}
+
+func TestCAAIPAddress(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	resolver := &namesResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1", "[2001:db8::1]"} {
+		ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: ip}
+		prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+		test.Assert(t, prob != nil, fmt.Sprintf("%s should be refused", ip))
+		test.AssertEquals(t, prob.Type, probs.MalformedProblem)
+		test.AssertEquals(t, prob.Detail, ip+" is an IP address, which has no CAA records to check")
+	}
+	test.AssertEquals(t, len(resolver.names), 0)
+}
+
+// floodResolver serves perName issue records for every name.
+type floodResolver struct {
+	bdns.MockDNSResolver
+	perName int
+}
+
+func (fr *floodResolver) LookupCAA(_ context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	records := make([]*dns.CAA, fr.perName)
+	for i := range records {
+		records[i] = &dns.CAA{Tag: "issue", Value: fmt.Sprintf("ca%d.example.net", i)}
+	}
+	return records, nil, nil
+}
+
+func TestCAAMaxRecords(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &floodResolver{perName: 100}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAMaxRecords = 1000
+	deep := strings.Repeat("a.", 20) + "example.com"
+
+	for _, minimize := range []bool{false, true} {
+		va.CAAMinimizeQueries = minimize
+		ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: deep}
+		prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+		test.Assert(t, prob != nil, "Check should fail")
+		test.AssertEquals(t, prob.Detail, "Too many CAA records found checking "+deep)
+	}
+
+	// A shallow name stays within the limit.
+	va.CAAMinimizeQueries = false
+	caaSet, err := va.getCAASet(context.Background(), "a.example.com")
+	test.AssertNotError(t, err, "getCAASet failed")
+	test.AssertEquals(t, len(caaSet.Issue), 100)
+}
+
+func TestCAALargeResponse(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}
+	records, _, err := va.DNSResolver.LookupCAA(context.Background(), "present.com")
+	test.AssertNotError(t, err, "LookupCAA failed")
+	size := caaResponseSize(records)
+	warning := fmt.Sprintf("Large CAA response for present.com: 1 records, %d bytes", size)
+
+	// A response at the threshold passes quietly.
+	log.Clear()
+	va.CAALargeResponseSize = size
+	decision, err := va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, len(log.GetAllMatching(`Large CAA response`)), 0)
+
+	// One just over it is logged, and still decided as usual.
+	va.CAALargeResponseSize = size - 1
+	decision, err = va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, len(log.GetAllMatching(warning)), 1)
+	test.AssertEquals(t, stats.Counters["VA.CAA.LargeResponse"], int64(1))
+}
+
+func TestCAALookupsPerCheck(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	for _, name := range []string{"present.com", "www.present.com", "a.b.c.absent.com", "com"} {
+		_, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: name}, core.ChallengeTypeHTTP01)
+		test.AssertNotError(t, err, "CAA check failed")
+	}
+	// Redirections add the lookups of the target's tree.
+	va.CAARuleset = CAARulesetRFC6844
+	_, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.dname.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.AssertDeepEquals(t, stats.Timings["VA.CAA.LookupsPerCheck"], []int64{2, 3, 5, 1, 6})
+}
+
+func TestCAAMaxLabels(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	resolver := &namesResolver{}
+	va.DNSResolver = resolver
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAMaxLabels = 5
+
+	atLimit := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "a.b.c.present.com"}
+	prob := va.checkCAA(context.Background(), atLimit, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "Name at the label limit should be checked")
+	test.AssertEquals(t, len(resolver.names), 5)
+
+	resolver.names = nil
+	overLimit := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "x.a.b.c.present.com"}
+	prob = va.checkCAA(context.Background(), overLimit, core.ChallengeTypeHTTP01)
+	test.AssertNotNil(t, prob, "Name over the label limit should be rejected")
+	test.AssertEquals(t, prob.Type, probs.MalformedProblem)
+	test.AssertEquals(t, len(resolver.names), 0)
+}
+
 func TestCAATimeout(t *testing.T) {
 	stats, _ := statsd.NewNoopClient()
 	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
 	va.DNSResolver = &bdns.MockDNSResolver{}
 	va.IssuerDomain = "letsencrypt.org"
-	err := va.checkCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "caa-timeout.com"})
+	err := va.checkCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "caa-timeout.com"}, core.ChallengeTypeHTTP01)
 	if err.Type != probs.ConnectionProblem {
 		t.Errorf("Expected timeout error type %s, got %s", probs.ConnectionProblem, err.Type)
 	}
@@ -692,6 +1044,11 @@ func TestCAAChecking(t *testing.T) {
 		{"present-with-parameter.com", true, true},
 		// Bad (unsatisfiable issue record)
 		{"unsatisfiable.com", true, false},
+		// Good (validationmethods permits http-01)
+		{"validationmethods-http.com", true, true},
+		{"validationmethods-spaces.com", true, true},
+		// Bad (validationmethods excludes http-01)
+		{"validationmethods-dns.com", true, false},
 	}
 
 	stats, _ := statsd.NewNoopClient()
@@ -699,39 +1056,1018 @@ func TestCAAChecking(t *testing.T) {
 	va.DNSResolver = &bdns.MockDNSResolver{}
 	va.IssuerDomain = "letsencrypt.org"
 	for _, caaTest := range tests {
-		present, valid, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: caaTest.Domain})
+		decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: caaTest.Domain}, core.ChallengeTypeHTTP01)
 		if err != nil {
 			t.Errorf("CheckCAARecords error for %s: %s", caaTest.Domain, err)
 		}
-		if present != caaTest.Present {
-			t.Errorf("CheckCAARecords presence mismatch for %s: got %t expected %t", caaTest.Domain, present, caaTest.Present)
+		if decision.present != caaTest.Present {
+			t.Errorf("CheckCAARecords presence mismatch for %s: got %t expected %t", caaTest.Domain, decision.present, caaTest.Present)
 		}
-		if valid != caaTest.Valid {
-			t.Errorf("CheckCAARecords presence mismatch for %s: got %t expected %t", caaTest.Domain, valid, caaTest.Valid)
+		if decision.valid != caaTest.Valid {
+			t.Errorf("CheckCAARecords presence mismatch for %s: got %t expected %t", caaTest.Domain, decision.valid, caaTest.Valid)
 		}
 	}
 
-	present, valid, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.com"})
+	decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.com"}, core.ChallengeTypeHTTP01)
 	test.AssertError(t, err, "servfail.com")
-	test.Assert(t, !present, "Present should be false")
-	test.Assert(t, !valid, "Valid should be false")
+	test.Assert(t, !decision.present, "Present should be false")
+	test.Assert(t, !decision.valid, "Valid should be false")
 
-	_, _, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.com"})
+	_, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.com"}, core.ChallengeTypeHTTP01)
 	if err == nil {
 		t.Errorf("Should have returned error on CAA lookup, but did not: %s", "servfail.com")
 	}
 
-	present, valid, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.present.com"})
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.present.com"}, core.ChallengeTypeHTTP01)
 	test.AssertError(t, err, "servfail.present.com")
-	test.Assert(t, !present, "Present should be false")
-	test.Assert(t, !valid, "Valid should be false")
+	test.Assert(t, !decision.present, "Present should be false")
+	test.Assert(t, !decision.valid, "Valid should be false")
 
-	_, _, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.present.com"})
+	_, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "servfail.present.com"}, core.ChallengeTypeHTTP01)
 	if err == nil {
 		t.Errorf("Should have returned error on CAA lookup, but did not: %s", "servfail.present.com")
 	}
 }
 
+func TestCAAValidationMethods(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "validationmethods-http.com"}
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeDNS01)
+	test.Assert(t, prob != nil, "dns-01 should be refused by validationmethods=http-01")
+	test.AssertEquals(t, prob.Detail, `CAA record for validationmethods-http.com prevents issuance using validation method "dns-01"; allowed methods: http-01`)
+
+	// Method names are compared case-insensitively, ignoring whitespace.
+	ident.Value = "validationmethods-spaces.com"
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeTLSSNI01)
+	test.Assert(t, prob == nil, "tls-sni-01 should be allowed")
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeDNS01)
+	test.Assert(t, prob != nil, "dns-01 should be refused")
+	test.AssertEquals(t, prob.Detail, `CAA record for validationmethods-spaces.com prevents issuance using validation method "dns-01"; allowed methods: http-01, tls-sni-01`)
+
+	// A record for another issuer doesn't produce the method-specific detail.
+	ident.Value = "reserved.com"
+	prob = va.checkCAA(context.Background(), ident, core.ChallengeTypeDNS01)
+	test.AssertEquals(t, prob.Detail, "CAA record for reserved.com prevents issuance")
+}
+
+func TestCAAIssuerMethodPolicies(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAIssuerMethodPolicies = map[string][]string{
+		"letsencrypt.org": {core.ChallengeTypeHTTP01, core.ChallengeTypeDNS01},
+		"example.net":     {core.ChallengeTypeTLSSNI01},
+	}
+
+	testCases := []struct {
+		domain string
+		method string
+		valid  bool
+	}{
+		// Permitted by both the record and the policy.
+		{"validationmethods-spaces.com", core.ChallengeTypeHTTP01, true},
+		// Permitted by the record, but not by the policy.
+		{"validationmethods-spaces.com", core.ChallengeTypeTLSSNI01, false},
+		// Permitted by the policy, but not by the record.
+		{"validationmethods-spaces.com", core.ChallengeTypeDNS01, false},
+		// A record without validationmethods leaves only the policy.
+		{"present-with-parameter.com", core.ChallengeTypeDNS01, true},
+		{"present-with-parameter.com", core.ChallengeTypeTLSSNI01, false},
+		// The policy only applies where CAA records restrict issuance.
+		{"com", core.ChallengeTypeTLSSNI01, true},
+	}
+	for _, tc := range testCases {
+		ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: tc.domain}
+		prob := va.checkCAA(context.Background(), ident, tc.method)
+		if (prob == nil) != tc.valid {
+			t.Errorf("%s with %s: expected valid %t, got problem %v", tc.domain, tc.method, tc.valid, prob)
+		}
+	}
+
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present-with-parameter.com"}
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeTLSSNI01)
+	test.AssertEquals(t, prob.Detail, `CAA record for present-with-parameter.com prevents issuance using validation method "tls-sni-01"; allowed methods: http-01, dns-01`)
+}
+
+func TestCAAProblem(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	testCases := []struct {
+		domain string
+		method string
+		reason caaReason
+		detail string
+	}{
+		{"reserved.com", core.ChallengeTypeHTTP01, caaUnauthorized,
+			"CAA record for reserved.com prevents issuance"},
+		{"unknown-critical.com", core.ChallengeTypeHTTP01, caaCriticalUnknown,
+			"CAA record for unknown-critical.com has an unrecognized critical property and prevents issuance"},
+		{"validationmethods-dns.com", core.ChallengeTypeHTTP01, caaMethodNotAllowed,
+			`CAA record for validationmethods-dns.com prevents issuance using validation method "http-01"; allowed methods: dns-01`},
+	}
+	for _, tc := range testCases {
+		ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: tc.domain}
+		decision, err := va.checkCAARecords(context.Background(), ident, tc.method)
+		test.AssertNotError(t, err, "CAA check failed")
+		test.AssertEquals(t, decision.reason, tc.reason)
+
+		prob := va.checkCAA(context.Background(), ident, tc.method)
+		test.AssertNotNil(t, prob, "CAA check should have failed")
+		test.AssertEquals(t, prob.Type, probs.CAAProblem)
+		test.AssertEquals(t, prob.Detail, tc.detail)
+		test.AssertEquals(t, probs.ProblemDetailsToStatusCode(prob), http.StatusForbidden)
+	}
+
+	decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "present.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.AssertEquals(t, decision.reason, caaAllowed)
+}
+
+func TestCAAWildcardDenyAll(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	// issuewild ";" forbids wildcard issuance even though issue names us.
+	decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "*.wildcard-deny.com"}, core.ChallengeTypeDNS01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.present, "Records should be present")
+	test.Assert(t, !decision.valid, "Wildcard issuance should be denied")
+	test.AssertEquals(t, decision.owner, "wildcard-deny.com")
+
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "wildcard-deny.com"}, core.ChallengeTypeDNS01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Non-wildcard issuance should be allowed")
+
+	// Without issuewild records, a wildcard falls back to issue.
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "*.present.com"}, core.ChallengeTypeDNS01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Wildcard issuance should be allowed by issue")
+}
+
+func TestCAAReservedFlags(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	ident := core.AcmeIdentifier{Type: "dns", Value: "example.com"}
+	log.Clear()
+
+	// The critical bit and its bit-1 alias aren't reserved.
+	caaSet := &CAASet{
+		Name: "example.com",
+		Issue: []*dns.CAA{
+			{Flag: 128, Tag: "issue", Value: "letsencrypt.org"},
+			{Flag: 1, Tag: "issue", Value: "example.net"},
+		},
+	}
+	test.Assert(t, caaSet.reservedFlags() == nil, "Critical bits reported as reserved")
+
+	caaSet.Issue = append(caaSet.Issue, &dns.CAA{Flag: 2, Tag: "issue", Value: "example.org"})
+	caaSet.Iodef = []*dns.CAA{{Flag: 64 | 1, Tag: "iodef", Value: "mailto:security@example.com"}}
+	caaSet.Unknown = []*dns.CAA{{Flag: 128 | 4, Tag: "tbs", Value: "x"}}
+	test.AssertEquals(t, len(caaSet.reservedFlags()), 3)
+
+	// Nothing is reported unless asked for.
+	caaSet.Unknown = nil
+	decision := va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.ReservedFlags"], int64(0))
+
+	// Reporting them doesn't change the decision.
+	va.CAAReportReservedFlags = true
+	decision = va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.ReservedFlags"], int64(2))
+	test.AssertEquals(t, len(log.GetAllMatching("CAA issue record at example.com sets reserved flag bits 0x2")), 1)
+	test.AssertEquals(t, len(log.GetAllMatching("CAA iodef record at example.com sets reserved flag bits 0x40")), 1)
+}
+
+func TestCAAUnflaggedUnknown(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	ident := core.AcmeIdentifier{Type: "dns", Value: "example.com"}
+	log.Clear()
+
+	caaSet := &CAASet{
+		Name:    "example.com",
+		Issue:   []*dns.CAA{{Tag: "issue", Value: "letsencrypt.org"}},
+		Iodef:   []*dns.CAA{{Tag: "iodef", Value: "mailto:security@example.com"}},
+		Unknown: []*dns.CAA{{Tag: "tbs", Value: "x"}, {Flag: 2, Tag: "other", Value: "y"}},
+	}
+	decision := va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.UnflaggedUnknown"], int64(0))
+
+	// Only the unknown record without flags is reported, and the decision
+	// stands.
+	va.CAAReportUnflaggedUnknown = true
+	decision = va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.UnflaggedUnknown"], int64(1))
+	test.AssertEquals(t, len(log.GetAllMatching("CAA tbs record at example.com has no flags set")), 1)
+	test.AssertEquals(t, len(log.GetAllMatching("CAA other record")), 0)
+}
+
+func TestCAAConflicts(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	log.Clear()
+
+	caaSet := &CAASet{
+		Name: "example.com",
+		Issue: []*dns.CAA{
+			{Tag: "issue", Value: ";"},
+			{Tag: "issue", Value: "letsencrypt.org"},
+		},
+		Issuewild: []*dns.CAA{{Tag: "issuewild", Value: ";"}},
+	}
+	test.AssertDeepEquals(t, caaSet.conflicts(), []string{"issue"})
+
+	// The record naming us still authorizes issuance, but the conflict is
+	// reported.
+	decision := va.evaluateCAASet(core.AcmeIdentifier{Type: "dns", Value: "example.com"}, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.Conflict"], int64(1))
+	test.AssertEquals(t, len(log.GetAllMatching("include both a deny-all issue record")), 1)
+
+	caaSet.Issuewild = append(caaSet.Issuewild, &dns.CAA{Tag: "issuewild", Value: "example.net"})
+	test.AssertDeepEquals(t, caaSet.conflicts(), []string{"issue", "issuewild"})
+	caaSet.Issue = caaSet.Issue[1:]
+	test.AssertDeepEquals(t, caaSet.conflicts(), []string{"issuewild"})
+	caaSet.Issuewild = caaSet.Issuewild[1:]
+	test.Assert(t, caaSet.conflicts() == nil, "No conflicts should remain")
+}
+
+func TestCAAFallbackIssuerDomain(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "new-brand.example"
+	va.CAAFallbackIssuerDomain = "letsencrypt.org"
+	ident := core.AcmeIdentifier{Type: "dns", Value: "example.com"}
+	caaSet := func(values ...string) *CAASet {
+		set := &CAASet{Name: "example.com"}
+		for _, value := range values {
+			set.Issue = append(set.Issue, &dns.CAA{Tag: "issue", Value: value})
+		}
+		return set
+	}
+
+	// A primary match is logged as such, and the fallback isn't consulted.
+	log.Clear()
+	decision := va.evaluateCAASet(ident, caaSet("new-brand.example", "letsencrypt.org"), core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Primary identity should be authorized")
+	test.AssertEquals(t, decision.issuer, "new-brand.example")
+	test.AssertEquals(t, len(log.GetAllMatching("authorize primary identity new-brand.example")), 1)
+	test.AssertEquals(t, len(log.GetAllMatching("fallback identity")), 0)
+	test.AssertEquals(t, stats.Counters["VA.CAA.AuthorizedByFallback"], int64(0))
+
+	// Records naming only the legacy identity authorize through the
+	// fallback, which is logged distinctly.
+	log.Clear()
+	decision = va.evaluateCAASet(ident, caaSet("letsencrypt.org"), core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Fallback identity should be authorized")
+	test.AssertEquals(t, decision.issuer, "letsencrypt.org")
+	test.AssertEquals(t, len(log.GetAllMatching("don't authorize primary identity new-brand.example .*; fallback identity letsencrypt.org authorizes it")), 1)
+	test.AssertEquals(t, stats.Counters["VA.CAA.AuthorizedByFallback"], int64(1))
+
+	// Neither identity named.
+	decision = va.evaluateCAASet(ident, caaSet("example.net"), core.ChallengeTypeHTTP01, "")
+	test.Assert(t, !decision.valid, "Neither identity should be authorized")
+
+	// Methods permitted for either identity are reported on refusal.
+	decision = va.evaluateCAASet(ident, caaSet("new-brand.example; validationmethods=dns-01", "letsencrypt.org; validationmethods=tls-sni-01"), core.ChallengeTypeHTTP01, "")
+	test.Assert(t, !decision.valid, "http-01 shouldn't be authorized")
+	test.AssertDeepEquals(t, decision.allowedMethods, []string{"dns-01", "tls-sni-01"})
+}
+
+func TestCAAAccountURIAndMethods(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAAccountURIPrefix = "https://acme.example/acct/"
+	ident := core.AcmeIdentifier{Type: "dns", Value: "example.com"}
+	caaSet := &CAASet{Name: "example.com", Issue: []*dns.CAA{
+		{Tag: "issue", Value: "letsencrypt.org; accounturi=https://acme.example/acct/1; validationmethods=http-01"},
+	}}
+
+	// Issuance needs both the account and the method to match.
+	for _, tc := range []struct {
+		regID  int64
+		method string
+		valid  bool
+		reason caaReason
+	}{
+		{1, core.ChallengeTypeHTTP01, true, caaAllowed},
+		{1, core.ChallengeTypeDNS01, false, caaMethodNotAllowed},
+		{2, core.ChallengeTypeHTTP01, false, caaAccountURIMismatch},
+		{2, core.ChallengeTypeDNS01, false, caaAccountURIMismatch},
+	} {
+		decision := va.evaluateCAASet(ident, caaSet, tc.method, va.caaAccountURI(tc.regID))
+		test.AssertEquals(t, decision.valid, tc.valid)
+		test.AssertEquals(t, decision.reason, tc.reason)
+	}
+
+	// Satisfying each parameter on a different record isn't enough.
+	split := &CAASet{Name: "example.com", Issue: []*dns.CAA{
+		{Tag: "issue", Value: "letsencrypt.org; accounturi=https://acme.example/acct/1; validationmethods=http-01"},
+		{Tag: "issue", Value: "letsencrypt.org; accounturi=https://acme.example/acct/2; validationmethods=dns-01"},
+	}}
+	decision := va.evaluateCAASet(ident, split, core.ChallengeTypeDNS01, va.caaAccountURI(1))
+	test.Assert(t, !decision.valid, "dns-01 shouldn't be authorized for account 1")
+	test.AssertDeepEquals(t, decision.allowedMethods, []string{"http-01"})
+
+	// Checks for different accounts are cached apart.
+	va.DNSResolver = &caaAccountResolver{}
+	va.CAAResultCacheTTL = time.Minute
+	ctx := withCAAAccountURI(context.Background(), va.caaAccountURI(1))
+	decision, err := va.checkCAAWithCache(ctx, ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Account 1 should be authorized")
+	ctx = withCAAAccountURI(context.Background(), va.caaAccountURI(2))
+	decision, err = va.checkCAAWithCache(ctx, ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Account 2 shouldn't be authorized")
+
+	// Without a prefix, accounturi parameters are ignored.
+	va.CAAAccountURIPrefix = ""
+	decision = va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, va.caaAccountURI(2))
+	test.Assert(t, decision.valid, "accounturi should be ignored")
+}
+
+func TestCAAParameterDenialReasons(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAAccountURIPrefix = "https://acme.example/acct/"
+	ident := core.AcmeIdentifier{Type: "dns", Value: "example.com"}
+	caaSet := func(value string) *CAASet {
+		return &CAASet{Name: "example.com", Issue: []*dns.CAA{{Tag: "issue", Value: value}}}
+	}
+
+	// A validationmethods exclusion names the methods permitted.
+	decision := va.evaluateCAASet(ident, caaSet("letsencrypt.org; validationmethods=dns-01"), core.ChallengeTypeHTTP01, va.caaAccountURI(1))
+	test.AssertEquals(t, decision.reason, caaMethodNotAllowed)
+	test.AssertEquals(t, caaProblem("example.com", decision).Detail,
+		`CAA record for example.com prevents issuance using validation method "http-01"; allowed methods: dns-01`)
+	test.AssertEquals(t, stats.Counters["VA.CAA.MethodNotAllowed"], int64(1))
+
+	// An accounturi mismatch says so.
+	decision = va.evaluateCAASet(ident, caaSet("letsencrypt.org; accounturi=https://acme.example/acct/2"), core.ChallengeTypeHTTP01, va.caaAccountURI(1))
+	test.AssertEquals(t, decision.reason, caaAccountURIMismatch)
+	test.AssertEquals(t, caaProblem("example.com", decision).Detail,
+		"CAA record for example.com prevents issuance to this account; accounturi names other accounts")
+	test.AssertEquals(t, stats.Counters["VA.CAA.AccountURIMismatch"], int64(1))
+
+	// Records that don't name us at all are neither.
+	decision = va.evaluateCAASet(ident, caaSet("example.net; accounturi=https://acme.example/acct/2"), core.ChallengeTypeHTTP01, va.caaAccountURI(1))
+	test.AssertEquals(t, decision.reason, caaUnauthorized)
+	test.AssertEquals(t, stats.Counters["VA.CAA.AccountURIMismatch"], int64(1))
+}
+
+func TestPerformValidationCAAAccountURI(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &caaAccountResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAAAccountURIPrefix = "https://acme.example/acct/"
+
+	chalDNS := core.DNSChallenge01(accountKey)
+	chalDNS.Token = expectedToken
+	keyAuthorization, _ := core.NewKeyAuthorization(chalDNS.Token, accountKey)
+	chalDNS.KeyAuthorization = &keyAuthorization
+
+	// The issue property is bound to account 1, so only its validations
+	// pass the CAA check.
+	_, err := va.PerformValidation("good-dns01.com", chalDNS, core.Authorization{RegistrationID: 1})
+	prob, _ := err.(*probs.ProblemDetails)
+	test.Assert(t, prob == nil, fmt.Sprintf("Validation for account 1 failed: %s", prob))
+	_, err = va.PerformValidation("good-dns01.com", chalDNS, core.Authorization{RegistrationID: 2})
+	prob, _ = err.(*probs.ProblemDetails)
+	test.AssertNotNil(t, prob, "Validation for account 2 passed the CAA check")
+	test.AssertEquals(t, prob.Type, probs.CAAProblem)
+	test.AssertEquals(t, prob.Detail, "CAA record for good-dns01.com prevents issuance to this account; accounturi names other accounts")
+}
+
+// caaAccountResolver serves an issue property bound to account 1 at
+// example.com and good-dns01.com.
+type caaAccountResolver struct {
+	bdns.MockDNSResolver
+}
+
+func (car *caaAccountResolver) LookupCAA(_ context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	if domain != "example.com" && domain != "good-dns01.com" {
+		return nil, nil, nil
+	}
+	return []*dns.CAA{{Tag: "issue", Value: "letsencrypt.org; accounturi=https://acme.example/acct/1"}}, nil, nil
+}
+
+func TestCAAIssuewildFallback(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	wildcard := core.AcmeIdentifier{Type: "dns", Value: "*.wildcard-deny.com"}
+
+	// By default issuewild takes precedence, without falling back to issue.
+	decision, err := va.checkCAARecords(context.Background(), wildcard, core.ChallengeTypeDNS01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Wildcard issuance should be denied by issuewild")
+
+	// With the fallback, an issuewild record naming another CA gives way to
+	// the issue record naming us.
+	va.CAAIssuewildFallback = true
+	otherCA := &CAASet{
+		Name:      "example.com",
+		Issue:     []*dns.CAA{{Tag: "issue", Value: "letsencrypt.org"}},
+		Issuewild: []*dns.CAA{{Tag: "issuewild", Value: "other-ca.example"}},
+	}
+	decision = va.evaluateCAASet(core.AcmeIdentifier{Type: "dns", Value: "*.example.com"}, otherCA, core.ChallengeTypeDNS01, "")
+	test.Assert(t, decision.valid, "Wildcard issuance should fall back to issue")
+
+	// An explicit issuewild ";" still forbids wildcard issuance.
+	decision, err = va.checkCAARecords(context.Background(), wildcard, core.ChallengeTypeDNS01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "issuewild \";\" should not fall back")
+
+	// An issuewild record naming us is still used, even when it refuses
+	// the method in use.
+	caaSet := &CAASet{
+		Name:      "example.com",
+		Issue:     []*dns.CAA{{Tag: "issue", Value: "letsencrypt.org"}},
+		Issuewild: []*dns.CAA{{Tag: "issuewild", Value: "letsencrypt.org; validationmethods=http-01"}},
+	}
+	decision = va.evaluateCAASet(core.AcmeIdentifier{Type: "dns", Value: "*.example.com"}, caaSet, core.ChallengeTypeDNS01, "")
+	test.Assert(t, !decision.valid, "issuewild naming us should not fall back")
+	test.AssertEquals(t, decision.reason, caaMethodNotAllowed)
+}
+
+func TestCAAWildcardSynthesized(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	ident := core.AcmeIdentifier{Type: "dns", Value: "www.wildcard-caa.com"}
+	decision, err := va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.synthesized, "Decision should rest on synthesized records")
+	test.Assert(t, decision.valid, "Synthesized records authorizing us should allow issuance")
+	test.AssertEquals(t, decision.owner, "www.wildcard-caa.com")
+	test.AssertEquals(t, stats.Counters["VA.CAA.WildcardSynthesized"], int64(1))
+
+	log.Clear()
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "CAA check should have passed")
+	test.AssertEquals(t, len(log.GetAllMatching(`CAA decision for www\.wildcard-caa\.com rests on records synthesized from a wildcard`)), 1)
+
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "present.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.synthesized, "Ordinary records aren't synthesized")
+}
+
+func TestCAABlankRecords(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	blank := core.AcmeIdentifier{Type: "dns", Value: "blank.com"}
+	blankIssue := core.AcmeIdentifier{Type: "dns", Value: "blank-issue.com"}
+
+	// By default a blank record set is the same as no records.
+	decision, err := va.checkCAARecords(context.Background(), blank, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.present, "Blank records should be treated as absent")
+	test.Assert(t, decision.valid, "Blank records should allow issuance")
+
+	// A blank issue value forbids issuance either way.
+	decision, err = va.checkCAARecords(context.Background(), blankIssue, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Blank issue value should forbid issuance")
+
+	va.CAABlankRecordsAreErrors = true
+	_, err = va.checkCAARecords(context.Background(), blank, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, err, errBlankCAARecords)
+	prob := va.checkCAA(context.Background(), blank, core.ChallengeTypeHTTP01)
+	test.AssertNotNil(t, prob, "Blank records should fail the check")
+	test.AssertEquals(t, prob.Detail, "CAA records for blank.com are all blank")
+
+	decision, err = va.checkCAARecords(context.Background(), blankIssue, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "Blank issue value isn't a blank set")
+	test.Assert(t, !decision.valid, "Blank issue value should forbid issuance")
+}
+
+func TestCAAOwnerName(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	testCases := []struct {
+		domain string
+		owner  string
+	}{
+		{"present.com", "present.com"},
+		{"www.present.com", "present.com"},
+		{"a.b.reserved.com", "reserved.com"},
+		{"nx.critical.com", "critical.com"},
+		{"absent.com", ""},
+	}
+	for _, tc := range testCases {
+		decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: tc.domain}, core.ChallengeTypeHTTP01)
+		test.AssertNotError(t, err, "CAA check failed")
+		if decision.owner != tc.owner {
+			t.Errorf("Checking %s: got owner %q, expected %q", tc.domain, decision.owner, tc.owner)
+		}
+	}
+
+	log.Clear()
+	prob := va.checkCAA(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.present.com"}, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "CAA check should have passed")
+	test.AssertEquals(t, len(log.GetAllMatching(`Checked CAA records for www\.present\.com, .*Found at: "present\.com"`)), 1)
+}
+
+func TestCAADNAME(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	va.CAARuleset = CAARulesetRFC6844
+
+	// dname.com itself authorizes us, but names below it are redirected to
+	// dname-target.com, which doesn't.
+	decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "dname.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "The DNAME owner's own records should apply to it")
+	test.AssertEquals(t, decision.owner, "dname.com")
+
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.dname.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "The redirected tree's records should apply")
+	test.AssertEquals(t, decision.owner, "dname-target.com")
+	test.AssertEquals(t, stats.Counters["VA.CAA.DNAMERedirect"], int64(1))
+
+	_, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.dname-loop-a.com"}, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, err, errTooManyDNAMERedirects)
+}
+
+func TestCAARuleset(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	identifier := core.AcmeIdentifier{Type: "dns", Value: "www.dname.com"}
+
+	// RFC 8659, the default, climbs www.dname.com's own ancestors, so
+	// dname.com's records apply.
+	decision, err := va.checkCAARecords(context.Background(), identifier, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Issuance should be allowed under RFC 8659")
+	test.AssertEquals(t, decision.owner, "dname.com")
+	test.AssertEquals(t, stats.Counters["VA.CAA.DNAMERedirect"], int64(0))
+
+	// RFC 6844 climbs the redirected name's ancestors instead.
+	va.CAARuleset = CAARulesetRFC6844
+	decision, err = va.checkCAARecords(context.Background(), identifier, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Issuance should be denied under RFC 6844")
+	test.AssertEquals(t, decision.owner, "dname-target.com")
+
+	test.Assert(t, ValidCAARuleset(""), "Empty ruleset should select the default")
+	test.Assert(t, ValidCAARuleset(CAARulesetRFC8659), "RFC 8659 should be valid")
+	test.Assert(t, !ValidCAARuleset("rfc1034"), "Unknown ruleset should be invalid")
+}
+
+func TestDNAMETarget(t *testing.T) {
+	dname := func(owner, target string) *dns.DNAME {
+		return &dns.DNAME{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeDNAME}, Target: target}
+	}
+	testCases := []struct {
+		name   string
+		dnames []*dns.DNAME
+		target string
+	}{
+		{"www.example.com", nil, "www.example.com"},
+		{"www.example.com", []*dns.DNAME{dname("example.com.", "example.net.")}, "www.example.net"},
+		{"a.b.Example.COM", []*dns.DNAME{dname("EXAMPLE.com.", "example.net.")}, "a.b.example.net"},
+		// A DNAME doesn't apply to its own owner name.
+		{"example.com", []*dns.DNAME{dname("example.com.", "example.net.")}, "example.com"},
+		{"www.notexample.com", []*dns.DNAME{dname("example.com.", "example.net.")}, "www.notexample.com"},
+		// Chained DNAMEs are applied in order.
+		{"www.example.com", []*dns.DNAME{
+			dname("example.com.", "example.net."),
+			dname("example.net.", "example.org."),
+		}, "www.example.org"},
+	}
+	for _, tc := range testCases {
+		if target := dnameTarget(tc.name, tc.dnames); target != tc.target {
+			t.Errorf("dnameTarget(%q): got %q, expected %q", tc.name, target, tc.target)
+		}
+	}
+}
+
+func TestCAARequireRegisteredDomainAnswer(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	// Without the option, a server failure looks like no records.
+	decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.servfail-empty.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+
+	va.CAARequireRegisteredDomainAnswer = true
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.absent.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check with an authoritative empty answer failed")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+
+	for _, name := range []string{"servfail-empty.com", "www.servfail-empty.com"} {
+		_, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: name}, core.ChallengeTypeHTTP01)
+		test.AssertEquals(t, err, errRegisteredDomainUnanswered)
+	}
+	prob := va.checkCAA(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.servfail-empty.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotNil(t, prob, "CAA check should have failed")
+	test.AssertEquals(t, prob.Type, probs.ConnectionProblem)
+
+	// Records found elsewhere in the tree are enough on their own.
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "present.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+}
+
+func TestCAALameDelegation(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	// servfail-empty.com's lookups fail, as they would if its nameservers
+	// didn't answer authoritatively.
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	log.Clear()
+
+	// By default the lame ancestor is reported, but treated as having no
+	// records.
+	ident := core.AcmeIdentifier{Type: "dns", Value: "www.servfail-empty.com"}
+	decision, err := va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.LameDelegation"], int64(1))
+	test.AssertEquals(t, len(log.GetAllMatching(`No answer checking CAA for www.servfail-empty.com at servfail-empty.com`)), 1)
+
+	va.CAALameDelegationsAreErrors = true
+	_, err = va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertEquals(t, err, errLameDelegation)
+	prob := va.checkCAA(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotNil(t, prob, "CAA check should have failed")
+	test.AssertEquals(t, prob.Type, probs.ConnectionProblem)
+
+	// Records found below the lame ancestor make it irrelevant, and a
+	// failure for the name itself isn't an ancestor's.
+	for _, name := range []string{"present.servfail-empty.com", "servfail-empty.com"} {
+		decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: name}, core.ChallengeTypeHTTP01)
+		test.AssertNotError(t, err, fmt.Sprintf("CAA check for %s failed", name))
+		test.Assert(t, decision.valid, fmt.Sprintf("Issuance for %s should be allowed", name))
+	}
+	test.AssertEquals(t, stats.Counters["VA.CAA.LameDelegation"], int64(3))
+}
+
+func TestCAAShadowedAncestor(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	// unknown-critical.present.com has a critical unknown property, while
+	// present.com authorizes us.
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	ident := core.AcmeIdentifier{Type: "dns", Value: "unknown-critical.present.com"}
+	const shadowed = `blocked at exact name despite ancestor policy: critical unknown property at unknown-critical.present.com, while records at present.com authorize letsencrypt.org`
+
+	// By default the denial is not told apart from others.
+	log.Clear()
+	decision, err := va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Issuance should be denied")
+	test.AssertEquals(t, decision.reason, caaCriticalUnknown)
+	test.AssertEquals(t, len(log.GetAllMatching(shadowed)), 0)
+
+	va.CAAReportShadowedAncestors = true
+	decision, err = va.checkCAARecords(context.Background(), ident, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.valid, "Issuance should still be denied")
+	test.AssertEquals(t, decision.reason, caaCriticalUnknown)
+	test.AssertEquals(t, decision.owner, "unknown-critical.present.com")
+	test.AssertEquals(t, stats.Counters["VA.CAA.CriticalUnknownShadowsAncestor"], int64(1))
+	test.AssertEquals(t, len(log.GetAllMatching(shadowed)), 1)
+	// The ancestor lookup isn't counted as another check.
+	test.AssertEquals(t, len(stats.Timings["VA.CAA.LookupsPerCheck"]), 2)
+	test.AssertEquals(t, stats.Counters["VA.CAA.CriticalFlag.Bit128"]+stats.Counters["VA.CAA.CriticalFlag.Bit1"], int64(2))
+
+	// An ancestor that wouldn't authorize us isn't reported.
+	_, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "unknown-critical.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.CriticalUnknownShadowsAncestor"], int64(1))
+}
+
+func TestCAAQueryLogSampling(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+	va.sample = mrand.New(mrand.NewSource(1)).Float64
+
+	// Nothing is logged for allowed checks by default.
+	log.Clear()
+	_, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "present.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.AssertEquals(t, len(log.GetAllMatching(`CAA queries for`)), 0)
+
+	va.CAAQueryLogSampleRate = 0.25
+	const checks = 400
+	for i := 0; i < checks; i++ {
+		_, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "www.present.com"}, core.ChallengeTypeHTTP01)
+		test.AssertNotError(t, err, "CAA check failed")
+	}
+	logged := len(log.GetAllMatching(`CAA queries for www\.present\.com: \[com, present\.com, www\.present\.com\]`))
+	test.Assert(t, logged > checks/8 && logged < checks*3/8, fmt.Sprintf("Logged %d of %d checks at a rate of 0.25", logged, checks))
+
+	// Denials are always logged.
+	va.CAAQueryLogSampleRate = 0
+	log.Clear()
+	for i := 0; i < 10; i++ {
+		_, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "reserved.com"}, core.ChallengeTypeHTTP01)
+		test.AssertNotError(t, err, "CAA check failed")
+	}
+	test.AssertEquals(t, len(log.GetAllMatching(`CAA queries for reserved\.com: .*Valid for issuance: false, Found at: "reserved\.com"`)), 10)
+
+	// A VA without a sample function, as built by a struct literal, still
+	// samples.
+	literal := &ValidationAuthorityImpl{log: va.log, CAAQueryLogSampleRate: 1}
+	log.Clear()
+	literal.logCAAQueries("present.com", caaDecision{valid: true}, map[string]bool{"present.com": true}, bdns.RTTSummary{})
+	test.AssertEquals(t, len(log.GetAllMatching(`CAA queries for present\.com: \[present\.com\]`)), 1)
+}
+
+func TestCAANoneRelevant(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.DNSResolver = &bdns.MockDNSResolver{}
+	va.IssuerDomain = "letsencrypt.org"
+
+	// Only iodef and non-critical unknown records: issuance is allowed, but
+	// the domain is counted separately from one with no records at all.
+	decision, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "iodef-only.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, decision.present, "Records should be present")
+	test.Assert(t, !decision.relevant, "Records should not be relevant")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	test.AssertEquals(t, stats.Counters["VA.CAA.NoneRelevant"], int64(1))
+	test.AssertEquals(t, stats.Counters["VA.CAA.None"], int64(0))
+
+	decision, err = va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "absent.com"}, core.ChallengeTypeHTTP01)
+	test.AssertNotError(t, err, "CAA check failed")
+	test.Assert(t, !decision.present, "Records should not be present")
+	test.AssertEquals(t, stats.Counters["VA.CAA.NoneRelevant"], int64(1))
+	test.AssertEquals(t, stats.Counters["VA.CAA.None"], int64(1))
+
+	log.Clear()
+	prob := va.checkCAA(context.Background(), core.AcmeIdentifier{Type: "dns", Value: "iodef-only.com"}, core.ChallengeTypeHTTP01)
+	test.Assert(t, prob == nil, "CAA check should have passed")
+	test.AssertEquals(t, len(log.GetAllMatching(`Checked CAA records for iodef-only\.com, \[Present: true, Relevant: false, Valid for issuance: true`)), 1)
+}
+
+func TestNewCAASetMixedCaseTags(t *testing.T) {
+	issue := &dns.CAA{Flag: 128, Tag: "Issue", Value: "letsencrypt.org"}
+	issuewild := &dns.CAA{Tag: "ISSUEWILD", Value: ";"}
+	iodef := &dns.CAA{Flag: 128, Tag: "IoDef", Value: "mailto:security@example.com"}
+	caaSet := newCAASet([]*dns.CAA{issue, issuewild, iodef})
+	test.AssertEquals(t, len(caaSet.Issue), 1)
+	test.AssertEquals(t, len(caaSet.Issuewild), 1)
+	test.AssertEquals(t, len(caaSet.Iodef), 1)
+	test.AssertEquals(t, len(caaSet.Unknown), 0)
+	stats, _ := statsd.NewNoopClient()
+	test.Assert(t, !caaSet.criticalUnknown(stats), "Critical records with known tags shouldn't block issuance")
+
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	decision := va.evaluateCAASet(core.AcmeIdentifier{Type: "dns", Value: "example.com"}, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Mixed-case issue record should authorize us")
+}
+
+func TestCAACriticalFlagStats(t *testing.T) {
+	testCases := []struct {
+		domain       string
+		bit128, bit1 int64
+	}{
+		{"unknown-critical.com", 1, 0},
+		{"unknown-critical2.com", 0, 1},
+		{"unknown-noncritical.com", 0, 0},
+	}
+	for _, tc := range testCases {
+		stats := mocks.NewStatter()
+		va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+		va.DNSResolver = &bdns.MockDNSResolver{}
+		va.IssuerDomain = "letsencrypt.org"
+		_, err := va.checkCAARecords(context.Background(), core.AcmeIdentifier{Type: "dns", Value: tc.domain}, core.ChallengeTypeHTTP01)
+		test.AssertNotError(t, err, "CAA check failed")
+		if stats.Counters["VA.CAA.CriticalFlag.Bit128"] != tc.bit128 || stats.Counters["VA.CAA.CriticalFlag.Bit1"] != tc.bit1 {
+			t.Errorf("%s: got Bit128=%d Bit1=%d, expected Bit128=%d Bit1=%d", tc.domain,
+				stats.Counters["VA.CAA.CriticalFlag.Bit128"], stats.Counters["VA.CAA.CriticalFlag.Bit1"], tc.bit128, tc.bit1)
+		}
+	}
+}
+
+func TestParseCAAIssueValue(t *testing.T) {
+	testCases := []struct {
+		value    string
+		issuer   string
+		params   map[string]string
+		trailing string
+	}{
+		{"letsencrypt.org", "letsencrypt.org", map[string]string{}, ""},
+		{";", "", map[string]string{}, ""},
+		{"letsencrypt.org;", "letsencrypt.org", map[string]string{}, ""},
+		{"  letsencrypt.org  ;foo=bar;baz=bar", "letsencrypt.org", map[string]string{"foo": "bar", "baz": "bar"}, ""},
+		{"letsencrypt.org; ValidationMethods = http-01 ", "letsencrypt.org", map[string]string{"validationmethods": "http-01"}, ""},
+		{"letsencrypt.org; novalue", "letsencrypt.org", map[string]string{}, "novalue"},
+		{"letsencrypt.org # comment", "letsencrypt.org", map[string]string{}, "# comment"},
+		{"letsencrypt.org # comment; foo=bar", "letsencrypt.org", map[string]string{"foo": "bar"}, "# comment; foo=bar"},
+		{"letsencrypt.org; bad tag=x; accounturi=https://acme.example/acct/1", "letsencrypt.org",
+			map[string]string{"accounturi": "https://acme.example/acct/1"}, "bad tag=x; accounturi=https://acme.example/acct/1"},
+		{"letsencrypt.org;;;", "letsencrypt.org", map[string]string{}, ";;"},
+		{"letsencrypt.org; foo=bar; #comment", "letsencrypt.org", map[string]string{"foo": "bar"}, "#comment"},
+		{"letsencrypt.org; foo=bar; b@d=baz", "letsencrypt.org", map[string]string{"foo": "bar"}, "b@d=baz"},
+	}
+	for _, tc := range testCases {
+		issuer, params, trailing := parseCAAIssueValue(tc.value)
+		test.AssertEquals(t, issuer, tc.issuer)
+		test.AssertDeepEquals(t, params, tc.params)
+		test.AssertEquals(t, trailing, tc.trailing)
+	}
+}
+
+func TestCAATrailingGarbage(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	log.Clear()
+
+	for _, value := range []string{"letsencrypt.org # comment", "letsencrypt.org;;;"} {
+		caaSet := &CAASet{Name: "example.com", Issue: []*dns.CAA{{Tag: "issue", Value: value}}}
+		ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "example.com"}
+		decision := va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+		test.Assert(t, decision.valid, fmt.Sprintf("%q should authorize letsencrypt.org", value))
+	}
+	test.AssertEquals(t, stats.Counters["VA.CAA.TrailingGarbage"], int64(2))
+	test.AssertEquals(t, len(log.GetAllMatching("Ignoring trailing content")), 2)
+
+	// Garbage before a parameter doesn't lift the restriction it sets.
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "example.com"}
+	for _, value := range []string{
+		"letsencrypt.org; bad tag=x; accounturi=https://acme.example/acct/1",
+		"letsencrypt.org # comment; accounturi=https://acme.example/acct/1",
+	} {
+		caaSet := &CAASet{Name: "example.com", Issue: []*dns.CAA{{Tag: "issue", Value: value}}}
+		decision := va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "https://acme.example/acct/2")
+		test.Assert(t, !decision.valid, fmt.Sprintf("%q should not authorize another account", value))
+		test.AssertEquals(t, decision.reason, caaAccountURIMismatch)
+	}
+	caaSet := &CAASet{Name: "example.com", Issue: []*dns.CAA{{Tag: "issue", Value: "letsencrypt.org; b@d; validationmethods=dns-01"}}}
+	decision := va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	test.AssertEquals(t, decision.reason, caaMethodNotAllowed)
+}
+
+func TestCAALongValues(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	long := strings.Repeat("a", 65000)
+
+	issuer, params, trailing := parseCAAIssueValue("letsencrypt.org; accounturi=" + long)
+	test.AssertEquals(t, issuer, "letsencrypt.org")
+	test.AssertEquals(t, params["accounturi"], long)
+	test.AssertEquals(t, trailing, "")
+	issuer, params, trailing = parseCAAIssueValue("letsencrypt.org" + strings.Repeat("; a=b", 13000))
+	test.AssertEquals(t, issuer, "letsencrypt.org")
+	test.AssertEquals(t, len(params), 1)
+	test.AssertEquals(t, trailing, "")
+
+	// Long values are cut short in the log, and in problem details.
+	log.Clear()
+	ident := core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "example.com"}
+	caaSet := &CAASet{Name: "example.com", Issue: []*dns.CAA{{Tag: "issue", Value: "letsencrypt.org #" + long}}}
+	decision := va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Issuance should be allowed")
+	lines := log.GetAllMatching("Ignoring trailing content")
+	test.AssertEquals(t, len(lines), 1)
+	test.Assert(t, len(lines[0].Message) < 4*maxCAAValueOutput, "Logged value should be truncated")
+	test.Assert(t, strings.Contains(lines[0].Message, "(64745 more bytes)"), "Truncation should be noted")
+
+	methods := strings.TrimSuffix(strings.Repeat("dns-01,", 10000), ",")
+	caaSet = &CAASet{Name: "example.com", Issue: []*dns.CAA{{Tag: "issue", Value: "letsencrypt.org; validationmethods=" + methods}}}
+	decision = va.evaluateCAASet(ident, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, !decision.valid, "Issuance should be refused")
+	prob := caaProblem("example.com", decision)
+	test.Assert(t, len(prob.Detail) < 2*maxCAAValueOutput, "Problem detail should be truncated")
+}
+
+// benchmarkParseCAAIssueValue parses value. Comparing sizes shows that
+// parsing takes time in proportion to a value's length.
+func benchmarkParseCAAIssueValue(b *testing.B, value string) {
+	b.SetBytes(int64(len(value)))
+	for i := 0; i < b.N; i++ {
+		parseCAAIssueValue(value)
+	}
+}
+
+func BenchmarkParseCAAIssueValueParameter1K(b *testing.B) {
+	benchmarkParseCAAIssueValue(b, "letsencrypt.org; accounturi="+strings.Repeat("a", 1<<10))
+}
+
+func BenchmarkParseCAAIssueValueParameter64K(b *testing.B) {
+	benchmarkParseCAAIssueValue(b, "letsencrypt.org; accounturi="+strings.Repeat("a", 64<<10))
+}
+
+func BenchmarkParseCAAIssueValueParameters1K(b *testing.B) {
+	benchmarkParseCAAIssueValue(b, "letsencrypt.org"+strings.Repeat("; a=b", (1<<10)/5))
+}
+
+func BenchmarkParseCAAIssueValueParameters64K(b *testing.B) {
+	benchmarkParseCAAIssueValue(b, "letsencrypt.org"+strings.Repeat("; a=b", (64<<10)/5))
+}
+
+func BenchmarkParseCAAIssueValueTrailing1K(b *testing.B) {
+	benchmarkParseCAAIssueValue(b, "letsencrypt.org #"+strings.Repeat(";", 1<<10))
+}
+
+func BenchmarkParseCAAIssueValueTrailing64K(b *testing.B) {
+	benchmarkParseCAAIssueValue(b, "letsencrypt.org #"+strings.Repeat(";", 64<<10))
+}
+
+func TestParseIodef(t *testing.T) {
+	testCases := []struct {
+		value  string
+		target IodefTarget
+		ok     bool
+	}{
+		{"mailto:security@example.com", IodefTarget{"mailto", "security@example.com"}, true},
+		{" MAILTO:security@example.com ", IodefTarget{"mailto", "security@example.com"}, true},
+		{"https://iodef.example.com/report", IodefTarget{"https", "https://iodef.example.com/report"}, true},
+		{"http://iodef.example.com/report", IodefTarget{}, false},
+		{"mailto:example.com", IodefTarget{}, false},
+		{"mailto:security@", IodefTarget{}, false},
+		{"https:///report", IodefTarget{}, false},
+		{"security@example.com", IodefTarget{}, false},
+		{"", IodefTarget{}, false},
+		{"%zz", IodefTarget{}, false},
+	}
+	for _, tc := range testCases {
+		target, ok := parseIodef(tc.value)
+		if ok != tc.ok || target != tc.target {
+			t.Errorf("parseIodef(%q): got %#v, %t, expected %#v, %t", tc.value, target, ok, tc.target, tc.ok)
+		}
+	}
+}
+
+func TestCAAIodefTargets(t *testing.T) {
+	stats := mocks.NewStatter()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, &stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	caaSet := newCAASet([]*dns.CAA{
+		{Tag: "issue", Value: "symantec.com"},
+		{Tag: "iodef", Value: "mailto:security@example.com"},
+		{Tag: "iodef", Value: "https://iodef.example.com/report"},
+		{Tag: "iodef", Value: "ftp://iodef.example.com/"},
+	})
+	log.Clear()
+	decision := va.evaluateCAASet(core.AcmeIdentifier{Type: "dns", Value: "example.com"}, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, !decision.valid, "Issuance should be denied")
+	test.AssertDeepEquals(t, decision.iodefs, []IodefTarget{
+		{Scheme: "mailto", Target: "security@example.com"},
+		{Scheme: "https", Target: "https://iodef.example.com/report"},
+	})
+	test.AssertEquals(t, stats.Counters["VA.CAA.InvalidIodef"], int64(1))
+	test.AssertEquals(t, len(log.GetAllMatching(`Ignoring invalid CAA iodef value "ftp://iodef\.example\.com/"`)), 1)
+
+	// A malformed iodef record doesn't block issuance.
+	caaSet = newCAASet([]*dns.CAA{
+		{Tag: "issue", Value: "letsencrypt.org"},
+		{Tag: "iodef", Value: "not a url"},
+	})
+	decision = va.evaluateCAASet(core.AcmeIdentifier{Type: "dns", Value: "example.com"}, caaSet, core.ChallengeTypeHTTP01, "")
+	test.Assert(t, decision.valid, "Invalid iodef shouldn't block issuance")
+	test.AssertEquals(t, len(decision.iodefs), 0)
+}
+
 func TestDNSValidationFailure(t *testing.T) {
 	stats, _ := statsd.NewNoopClient()
 	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
@@ -890,6 +2226,62 @@ func TestDNSValidationOK(t *testing.T) {
 	test.Assert(t, authz.Challenges[0].Status == core.StatusValid, "Should be valid.")
 }
 
+// queryResolver records the type and name of each CAA and TXT query it is
+// asked, answering with the mock's records.
+type queryResolver struct {
+	bdns.MockDNSResolver
+	sync.Mutex
+	queries []string
+}
+
+func (qr *queryResolver) record(query string) {
+	qr.Lock()
+	defer qr.Unlock()
+	qr.queries = append(qr.queries, query)
+}
+
+func (qr *queryResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	qr.record("CAA " + domain)
+	return qr.MockDNSResolver.LookupCAA(ctx, domain)
+}
+
+func (qr *queryResolver) LookupTXT(ctx context.Context, domain string) ([]string, []string, error) {
+	qr.record("TXT " + domain)
+	return qr.MockDNSResolver.LookupTXT(ctx, domain)
+}
+
+func TestPurposeResolvers(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	va.IssuerDomain = "letsencrypt.org"
+	defaultResolver, caaResolver, txtResolver := &queryResolver{}, &queryResolver{}, &queryResolver{}
+	va.DNSResolver = defaultResolver
+	va.PurposeResolvers = map[string]bdns.DNSResolver{
+		ResolverPurposeCAA:   caaResolver,
+		ResolverPurposeDNS01: txtResolver,
+	}
+
+	chalDNS := core.DNSChallenge01(accountKey)
+	chalDNS.Token = expectedToken
+	keyAuthorization, _ := core.NewKeyAuthorization(chalDNS.Token, accountKey)
+	chalDNS.KeyAuthorization = &keyAuthorization
+	_, prob := va.validateChallengeAndCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "good-dns01.com"}, chalDNS)
+	test.Assert(t, prob == nil, fmt.Sprintf("Validation failed: %s", prob))
+
+	sort.Strings(caaResolver.queries)
+	test.AssertDeepEquals(t, caaResolver.queries, []string{"CAA com", "CAA good-dns01.com"})
+	test.AssertDeepEquals(t, txtResolver.queries, []string{"TXT _acme-challenge.good-dns01.com"})
+	test.AssertEquals(t, len(defaultResolver.queries), 0)
+
+	// Without an override, every query goes to DNSResolver.
+	va.PurposeResolvers = nil
+	_, prob = va.validateChallengeAndCAA(context.Background(), core.AcmeIdentifier{Type: core.IdentifierDNS, Value: "good-dns01.com"}, chalDNS)
+	test.Assert(t, prob == nil, fmt.Sprintf("Validation failed: %s", prob))
+	test.AssertEquals(t, len(defaultResolver.queries), 3)
+	test.Assert(t, ValidResolverPurpose(ResolverPurposeCAA), "caa should be a valid purpose")
+	test.Assert(t, !ValidResolverPurpose(core.ChallengeTypeHTTP01), "http-01 should not be a valid purpose")
+}
+
 func TestDNSValidationNoAuthorityOK(t *testing.T) {
 	stats, _ := statsd.NewNoopClient()
 	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
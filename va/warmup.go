@@ -0,0 +1,52 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// RunWarmupProbes looks up the CAA records of each of names in parallel, so
+// that the upstream resolver's cache is filled before the VA starts taking
+// requests. It returns once every probe has finished or timeout has passed,
+// whichever comes first. Probe failures are only logged.
+func (va *ValidationAuthorityImpl) RunWarmupProbes(ctx context.Context, names []string, timeout time.Duration) {
+	if len(names) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := va.clk.Now()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if _, err := va.getCAASet(ctx, strings.ToLower(name)); err != nil {
+				va.log.Warning(fmt.Sprintf("Warm-up probe for %s failed: %s", name, err))
+			}
+		}(name)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		va.stats.TimingDuration("VA.WarmupProbes.Latency", va.clk.Now().Sub(start), 1.0)
+	case <-ctx.Done():
+		va.stats.Inc("VA.WarmupProbes.TimedOut", 1, 1.0)
+		va.log.Warning(fmt.Sprintf("Warm-up probes didn't finish within %s", timeout))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package va
+
+import (
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/jmhodges/clock"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/miekg/dns"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/letsencrypt/boulder/bdns"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// blockingResolver holds every CAA lookup until release is closed.
+type blockingResolver struct {
+	bdns.MockDNSResolver
+	release chan struct{}
+}
+
+func (br *blockingResolver) LookupCAA(ctx context.Context, domain string) ([]*dns.CAA, []*dns.DNAME, error) {
+	<-br.release
+	return nil, nil, nil
+}
+
+func TestRunWarmupProbes(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	resolver := &blockingResolver{release: make(chan struct{})}
+	va.DNSResolver = resolver
+
+	ready := make(chan struct{})
+	go func() {
+		va.RunWarmupProbes(context.Background(), []string{"example.com", "example.net"}, time.Minute)
+		close(ready)
+	}()
+	select {
+	case <-ready:
+		t.Fatal("Warm-up finished before its probes completed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(resolver.release)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("Warm-up didn't finish after its probes completed")
+	}
+}
+
+func TestRunWarmupProbesTimeout(t *testing.T) {
+	stats, _ := statsd.NewNoopClient()
+	va := NewValidationAuthorityImpl(&PortConfig{}, nil, stats, clock.Default())
+	resolver := &blockingResolver{release: make(chan struct{})}
+	defer close(resolver.release)
+	va.DNSResolver = resolver
+
+	start := time.Now()
+	va.RunWarmupProbes(context.Background(), []string{"example.com"}, 10*time.Millisecond)
+	test.Assert(t, time.Since(start) < time.Second, "Warm-up should give up after its timeout")
+}